@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DEFAULT_ADMIN_HISTORY is the number of errors kept for the admin console
+	DEFAULT_ADMIN_HISTORY = 100
+	// DEFAULT_ADMIN_AUDIT_LIMIT is the number of audit entries shown on the admin console
+	DEFAULT_ADMIN_AUDIT_LIMIT = 20
+	// DEFAULT_ADMIN_TIMEOUT bounds the backend calls of an admin console request
+	DEFAULT_ADMIN_TIMEOUT = 15 * time.Second
+)
+
+// ActiveAlert is a firing alert, as last received
+type ActiveAlert struct {
+	Tenant      string            `json:"tenant"`
+	GroupKey    string            `json:"group_key,omitempty"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	Component   string            `json:"component"`
+	Labels      map[string]string `json:"labels"`
+	StartsAt    string            `json:"starts_at,omitempty"`
+	ReceivedAt  time.Time         `json:"received_at"`
+	// Components are the component ids per backend of the route, 0 if the component is unknown there
+	Components map[string]int `json:"components"`
+	DryRun     bool           `json:"dry_run,omitempty"`
+}
+
+// AdminError is an error met while forwarding an alert
+type AdminError struct {
+	Time      time.Time `json:"time"`
+	Tenant    string    `json:"tenant"`
+	Backend   string    `json:"backend"`
+	Component string    `json:"component,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Error     string    `json:"error"`
+}
+
+// AdminRoute is a route, as shown on the admin console
+type AdminRoute struct {
+	Tenant       string            `json:"tenant"`
+	Match        map[string]string `json:"match"`
+	Backends     []string          `json:"backends"`
+	FireAfter    string            `json:"fire_after,omitempty"`
+	ResolveAfter string            `json:"resolve_after,omitempty"`
+	FlapWindow   string            `json:"flap_window,omitempty"`
+	DryRun       bool              `json:"dry_run,omitempty"`
+}
+
+// AdminIncident is an incident open on a component the bridge alerted
+type AdminIncident struct {
+	Tenant      string `json:"tenant"`
+	Backend     string `json:"backend"`
+	Component   string `json:"component"`
+	ComponentID int    `json:"component_id"`
+	IncidentID  int    `json:"incident_id"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// adminComponent is a component the bridge alerted on a backend
+type adminComponent struct {
+	tenant  string
+	backend string
+	name    string
+	id      int
+}
+
+// AdminConsole serves the admin web UI (behind its own authentication), and keeps what it
+// shows: the active alerts, the components alerted since the start, and the last errors.
+// A nil AdminConsole keeps nothing
+type AdminConsole struct {
+	Auth *Authenticator
+
+	lock       sync.Mutex
+	size       int
+	alerts     map[string]*ActiveAlert
+	components map[string]adminComponent
+	errors     []AdminError // oldest first
+}
+
+func NewAdminConsole(auth *Authenticator, size int) *AdminConsole {
+	if size <= 0 {
+		size = DEFAULT_ADMIN_HISTORY
+	}
+	return &AdminConsole{
+		Auth:       auth,
+		size:       size,
+		alerts:     make(map[string]*ActiveAlert),
+		components: make(map[string]adminComponent),
+	}
+}
+
+func activeAlertKey(tenant, fingerprint, component string) string {
+	if fingerprint == "" {
+		fingerprint = "component=" + component
+	}
+	return tenant + "/" + fingerprint
+}
+
+// Alert records the last status of an alert, and the components it maps to per backend
+func (a *AdminConsole) Alert(tenant, groupKey string, alert PrometheusAlertDetail, component string, components map[string]int, dryRun bool) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for backend, id := range components {
+		if id != 0 {
+			a.components[componentKey(tenant, backend, id)] = adminComponent{tenant: tenant, backend: backend, name: component, id: id}
+		}
+	}
+
+	key := activeAlertKey(tenant, alert.Fingerprint, component)
+	if alert.Status == "resolved" {
+		delete(a.alerts, key)
+		return
+	}
+	a.alerts[key] = &ActiveAlert{
+		Tenant:      tenant,
+		GroupKey:    groupKey,
+		Fingerprint: alert.Fingerprint,
+		Component:   component,
+		Labels:      alert.Labels,
+		StartsAt:    alert.StartAt,
+		ReceivedAt:  time.Now().UTC(),
+		Components:  components,
+		DryRun:      dryRun,
+	}
+}
+
+// Error keeps an error met while forwarding an alert
+func (a *AdminConsole) Error(ctx context.Context, tenant, backend, component, message string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.errors = append(a.errors, AdminError{
+		Time:      time.Now().UTC(),
+		Tenant:    tenant,
+		Backend:   backend,
+		Component: component,
+		RequestID: RequestIDFrom(ctx),
+		Error:     message,
+	})
+	if len(a.errors) > a.size {
+		a.errors = append([]AdminError{}, a.errors[len(a.errors)-a.size:]...)
+	}
+}
+
+// Alerts returns the active alerts, sorted by tenant and component
+func (a *AdminConsole) Alerts() []ActiveAlert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	alerts := make([]ActiveAlert, 0, len(a.alerts))
+	for _, alert := range a.alerts {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Tenant != alerts[j].Tenant {
+			return alerts[i].Tenant < alerts[j].Tenant
+		}
+		if alerts[i].Component != alerts[j].Component {
+			return alerts[i].Component < alerts[j].Component
+		}
+		return alerts[i].Fingerprint < alerts[j].Fingerprint
+	})
+	return alerts
+}
+
+// Errors returns the last errors, the most recent first
+func (a *AdminConsole) Errors() []AdminError {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	errors := make([]AdminError, 0, len(a.errors))
+	for i := len(a.errors) - 1; i >= 0; i-- {
+		errors = append(errors, a.errors[i])
+	}
+	return errors
+}
+
+// firing returns true if an active alert maps to the component on the backend
+func (a *AdminConsole) firing(tenant, backend string, componentID int) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, alert := range a.alerts {
+		if alert.Tenant == tenant && alert.Components[backend] == componentID {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AdminConsole) alertedComponents() []adminComponent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	components := make([]adminComponent, 0, len(a.components))
+	for _, component := range a.components {
+		components = append(components, component)
+	}
+	sort.Slice(components, func(i, j int) bool {
+		return componentKey(components[i].tenant, components[i].backend, components[i].id) <
+			componentKey(components[j].tenant, components[j].backend, components[j].id)
+	})
+	return components
+}
+
+// tenantConfig returns the configuration of a tenant ("default" being the main one), or nil
+func (config *PrometheusCachetConfig) tenantConfig(tenant string) *PrometheusCachetConfig {
+	if tenant == "" || tenant == config.TenantName() {
+		return config
+	}
+	return config.Tenants[tenant]
+}
+
+// adminRoutes lists the routes of the configuration and its tenants, ending
+// with the default backend used when no route matches
+func adminRoutes(config *PrometheusCachetConfig) []AdminRoute {
+	configs := []*PrometheusCachetConfig{config}
+	tenants := make([]string, 0, len(config.Tenants))
+	for name := range config.Tenants {
+		tenants = append(tenants, name)
+	}
+	sort.Strings(tenants)
+	for _, name := range tenants {
+		configs = append(configs, config.Tenants[name])
+	}
+
+	routes := make([]AdminRoute, 0)
+	for _, c := range configs {
+		for _, route := range c.Routes {
+			routes = append(routes, AdminRoute{
+				Tenant:       c.TenantName(),
+				Match:        route.Match,
+				Backends:     route.Backends,
+				FireAfter:    adminDuration(route.HoldDown.FireAfter),
+				ResolveAfter: adminDuration(route.HoldDown.ResolveAfter),
+				FlapWindow:   adminDuration(route.HoldDown.FlapWindow),
+				DryRun:       route.DryRun,
+			})
+		}
+		if c.Cachet != nil {
+			routes = append(routes, AdminRoute{Tenant: c.TenantName(), Match: map[string]string{}, Backends: []string{DEFAULT_BACKEND}})
+		}
+	}
+	return routes
+}
+
+func adminDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// openIncidents searches the incidents not fixed of the components alerted since the start.
+// The backends failing are reported in errors
+func (a *AdminConsole) openIncidents(ctx context.Context, config *PrometheusCachetConfig) ([]AdminIncident, map[string]string) {
+	incidents := make([]AdminIncident, 0)
+	errors := make(map[string]string)
+	for _, component := range a.alertedComponents() {
+		name := component.tenant + "/" + component.backend
+		if _, failed := errors[name]; failed {
+			continue
+		}
+		tenant := config.tenantConfig(component.tenant)
+		if tenant == nil {
+			continue
+		}
+		backend := tenant.Backend(component.backend)
+		if backend == nil {
+			continue
+		}
+		found, err := backend.SearchIncidentsContext(ctx, component.id)
+		if err != nil {
+			errors[name] = err.Error()
+			continue
+		}
+		for _, incident := range found {
+			if incident.Status == 4 {
+				continue
+			}
+			incidents = append(incidents, AdminIncident{
+				Tenant:      component.tenant,
+				Backend:     component.backend,
+				Component:   component.name,
+				ComponentID: component.id,
+				IncidentID:  incident.Id,
+				Status:      incidentStatusName(incident.Status),
+				CreatedAt:   incident.CreatedAt,
+				UpdatedAt:   incident.UpdatedAt,
+			})
+		}
+	}
+	return incidents, errors
+}
+
+// StateHandler serves what the admin console shows
+func (a *AdminConsole) StateHandler(config *PrometheusCachetConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), DEFAULT_ADMIN_TIMEOUT)
+		defer cancel()
+
+		incidents, backendErrors := a.openIncidents(ctx, config)
+		state := gin.H{
+			"routes":         adminRoutes(config),
+			"alerts":         a.Alerts(),
+			"incidents":      incidents,
+			"backend_errors": backendErrors,
+			"errors":         a.Errors(),
+			"overrides":      config.Overrides.List(),
+		}
+		if config.Audit != nil {
+			entries, err := config.Audit.Query(AuditFilter{Limit: DEFAULT_ADMIN_AUDIT_LIMIT})
+			if err != nil {
+				backendErrors["audit"] = err.Error()
+			}
+			state["audit"] = entries
+		}
+		c.JSON(http.StatusOK, state)
+	}
+}
+
+// AdminAction is the body of the admin console actions
+type AdminAction struct {
+	Tenant    string `json:"tenant"`
+	Backend   string `json:"backend"`
+	Component string `json:"component" binding:"required"`
+}
+
+// syncComponent makes the incidents of a component follow its status: an incident is opened if
+// firing and none is open, else the open incidents are resolved with message. It returns the number of changes
+func syncComponent(ctx context.Context, backend Cachet, component string, componentID int, firing bool, message string) (int, error) {
+	incidents, err := backend.SearchIncidentsContext(ctx, componentID)
+	if err != nil {
+		return 0, err
+	}
+	if firing {
+		if len(incidents) > 0 && incidents[0].Status != 4 {
+			return 0, nil
+		}
+		if err := backend.CreateIncidentContext(ctx, component, componentID, 4, 4); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	resolved := 0
+	for _, incident := range incidents {
+		if incident.Status == 4 {
+			continue
+		}
+		if err := backend.UpdateIncidentContext(ctx, component, componentID, incident.Id, 1, message); err != nil {
+			return resolved, err
+		}
+		resolved++
+	}
+	return resolved, nil
+}
+
+// ActionHandler serves an action of the admin console on a component:
+//   - resolve: the open incidents are resolved, whatever the alerts
+//   - resync: the status page follows the active alerts: an incident is opened if one
+//     is firing and none is open, else the open incidents are resolved
+//
+// The body must be JSON, which a cross-site form cannot send
+func (a *AdminConsole) ActionHandler(config *PrometheusCachetConfig, resync bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.ContentType() != "application/json" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "expected a JSON body"})
+			return
+		}
+		var action AdminAction
+		if err := c.ShouldBindJSON(&action); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if action.Backend == "" {
+			action.Backend = DEFAULT_BACKEND
+		}
+		tenant := config.tenantConfig(action.Tenant)
+		if tenant == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown tenant '%s'", action.Tenant)})
+			return
+		}
+		backend := tenant.Backend(action.Backend)
+		if backend == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown backend '%s'", action.Backend)})
+			return
+		}
+
+		tenantName := tenant.TenantName()
+		logger := LoggerFrom(c.Request.Context()).With("tenant", tenantName, "backend", action.Backend, "component", action.Component)
+		ctx, cancel := context.WithTimeout(WithLogger(c.Request.Context(), logger), DEFAULT_ADMIN_TIMEOUT)
+		defer cancel()
+
+		componentID, err := backend.SearchComponentContext(ctx, action.Component)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("component %s: %v", action.Component, err)})
+			return
+		}
+
+		firing := resync && a.firing(tenantName, action.Backend, componentID)
+		message := fmt.Sprintf("Service %s flagged as up from the admin console", action.Component)
+		changes, err := syncComponent(ctx, backend, action.Component, componentID, firing, message)
+		if err != nil {
+			logger.Warn("admin: unable to update the component", "resync", resync, "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		config.Dedupe.Forwarded(tenantName, action.Backend, componentID, alertStatus(firing))
+
+		logger.Info("admin: component updated", "resync", resync, "firing", firing, "changes", changes)
+		c.JSON(http.StatusOK, gin.H{"component": action.Component, "firing": firing, "changes": changes})
+	}
+}
+
+// PageHandler serves the admin web UI, which has no external assets
+func (a *AdminConsole) PageHandler(c *gin.Context) {
+	c.Header("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(adminPage))
+}
+
+// Register adds the admin console and admin API routes to the router
+func (a *AdminConsole) Register(router *gin.Engine, config *PrometheusCachetConfig) {
+	// never served without credentials
+	if !a.Auth.Enabled() {
+		DefaultLogger().Error("the admin UI has no credential, it is disabled")
+		return
+	}
+	reject := func(c *gin.Context, status int) {
+		LoggerFrom(c.Request.Context()).Warn("wrong admin Authorization header", "client_ip", c.ClientIP(), "status", status)
+	}
+	admin := router.Group("/admin", a.Auth.Middleware(reject))
+	admin.GET("", a.PageHandler)
+	admin.GET("/api/state", a.StateHandler(config))
+	// only the leader writes on the status pages: the actions are forwarded to it
+	admin.POST("/api/resolve", config.HA.Middleware, a.ActionHandler(config, false))
+	admin.POST("/api/resync", config.HA.Middleware, a.ActionHandler(config, true))
+
+	// the overrides are held by the leader
+	overrides := router.Group("/api/overrides", a.Auth.Middleware(reject), config.HA.Middleware)
+	overrides.GET("", config.Overrides.ListHandler)
+	overrides.GET("/:component", config.Overrides.GetHandler(config))
+	overrides.PUT("/:component", config.Overrides.PutHandler(config))
+	overrides.DELETE("/:component", config.Overrides.DeleteHandler(config))
+
+	// the changes are recorded by the leader, which processes the webhooks
+	if config.Audit != nil {
+		router.GET("/audit", a.Auth.Middleware(reject), config.HA.Middleware, config.Audit.Handler)
+	}
+	router.GET("/dryrun", a.Auth.Middleware(reject), config.HA.Middleware, config.DryRun.Handler)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+	"github.com/stretchr/testify/assert"
+)
+
+type adminState struct {
+	Routes        []AdminRoute      `json:"routes"`
+	Alerts        []ActiveAlert     `json:"alerts"`
+	Incidents     []AdminIncident   `json:"incidents"`
+	BackendErrors map[string]string `json:"backend_errors"`
+	Errors        []AdminError      `json:"errors"`
+}
+
+func adminRequest(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("admin", "adminPassword")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// newTestAdminConsole accepts the basic auth of adminRequest
+func newTestAdminConsole() *AdminConsole {
+	auth, _ := NewAuthenticator("admin", nil, nil, map[string]string{"admin": "adminPassword"})
+	return NewAdminConsole(auth, 0)
+}
+
+func readAdminState(t *testing.T, router http.Handler) adminState {
+	w := adminRequest(router, "GET", "/admin/api/state", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var state adminState
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &state))
+	return state
+}
+
+func TestAdminConsole(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+
+	auth, _ := NewAuthenticator("admin", nil, nil, map[string]string{"admin": "adminPassword"})
+	cachet := NewCachetImpl(fake.URL, "1234567890abcdef", fake.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+	config := PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "promToken",
+		Cachet:          cachet,
+		Routes:          []Route{{Match: map[string]string{"team": "web"}, Backends: []string{"missing"}}},
+		Admin:           NewAdminConsole(auth, 0),
+	}
+	router := PrepareGinRouter(&config)
+
+	// the admin UI has its own credentials
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.Header.Set("Authorization", "Bearer promToken")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = adminRequest(router, "GET", "/admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<title>prometheus-cachethq admin</title>")
+	assert.Contains(t, w.Header().Get("Content-Security-Policy"), "default-src 'none'")
+
+	sendTestAlert(t, router, "promToken", "firing", "component21")
+	state := readAdminState(t, router)
+	assert.Equal(t, 2, len(state.Routes))
+	assert.Equal(t, []string{"missing"}, state.Routes[0].Backends)
+	assert.Equal(t, []string{DEFAULT_BACKEND}, state.Routes[1].Backends)
+	assert.Equal(t, 1, len(state.Alerts))
+	assert.Equal(t, "component21", state.Alerts[0].Component)
+	assert.Equal(t, map[string]int{DEFAULT_BACKEND: 1}, state.Alerts[0].Components)
+	assert.Equal(t, 1, len(state.Incidents))
+	assert.Equal(t, "identified", state.Incidents[0].Status)
+
+	// force resolve, while the alert is still firing
+	w = adminRequest(router, "POST", "/admin/api/resolve", `{"backend":"default","component":"component21"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, cachetfake.INCIDENT_FIXED, lastIncidentStatus(fake))
+	assert.Equal(t, 0, len(readAdminState(t, router).Incidents))
+
+	// re-sync: the incident is opened again
+	w = adminRequest(router, "POST", "/admin/api/resync", `{"component":"component21"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"firing":true`)
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+	assert.Equal(t, 2, len(fake.Incidents(0)))
+
+	// the alert is resolved, but the status page missed it
+	config.Admin.Alert(DEFAULT_BACKEND, "", PrometheusAlertDetail{Status: "resolved", Fingerprint: "f1a2"}, "component21", nil, false)
+	assert.Equal(t, 0, len(readAdminState(t, router).Alerts))
+	w = adminRequest(router, "POST", "/admin/api/resync", `{"component":"component21"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"changes":1`)
+	assert.Equal(t, cachetfake.INCIDENT_FIXED, lastIncidentStatus(fake))
+
+	// the actions need a JSON body (no cross-site form)
+	req = httptest.NewRequest("POST", "/admin/api/resolve", bytes.NewBufferString("component=component21"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "adminPassword")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	w = adminRequest(router, "POST", "/admin/api/resolve", `{"tenant":"teamz","component":"component21"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// the errors are kept
+	jsonStr := `{"status":"firing","alerts":[{"status":"firing","labels":{"alertname":"component21","team":"web"}}],"version":"4"}`
+	req = httptest.NewRequest("POST", "/alert", bytes.NewBufferString(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer promToken")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	state = readAdminState(t, router)
+	assert.Equal(t, 1, len(state.Errors))
+	assert.Equal(t, "missing", state.Errors[0].Backend)
+	assert.Equal(t, "component21", state.Errors[0].Component)
+	assert.Equal(t, "unknown backend", state.Errors[0].Error)
+}
+
+func TestAdminConsoleDisabled(t *testing.T) {
+	config := PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "promToken",
+	}
+	router := PrepareGinRouter(&config)
+
+	w := adminRequest(router, "GET", "/admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// blank credentials do not leave the admin UI open
+func TestAdminConsoleNoCredential(t *testing.T) {
+	auth, _ := NewAuthenticator("admin", []string{""}, nil, map[string]string{})
+	config := PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "promToken",
+		Admin:           NewAdminConsole(auth, 0),
+	}
+	router := PrepareGinRouter(&config)
+
+	for _, path := range []string{"/admin", "/admin/api/state", "/api/overrides"} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
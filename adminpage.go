@@ -0,0 +1,180 @@
+package main
+
+// adminPage is the admin web UI: a single page without external assets, rendering
+// /admin/api/state, and calling /admin/api/resolve and /admin/api/resync
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>prometheus-cachethq admin</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 3px 8px; border-bottom: 1px solid #eee; vertical-align: top; }
+th { background: #f4f4f4; }
+code { font-size: 0.9em; }
+.empty { color: #888; font-style: italic; }
+.error { color: #b00; }
+.ok { color: #070; }
+.missing { color: #888; }
+button { font-size: 0.85em; margin-right: 4px; }
+#status { float: right; color: #666; }
+</style>
+</head>
+<body>
+<h1>prometheus-cachethq <span id="status"></span></h1>
+<div id="message"></div>
+
+<h2>Active alerts</h2>
+<div id="alerts"></div>
+
+<h2>Open incidents</h2>
+<div id="incidents"></div>
+
+<h2>Overrides</h2>
+<div id="overrides"></div>
+
+<h2>Routes</h2>
+<div id="routes"></div>
+
+<h2>Recent errors</h2>
+<div id="errors"></div>
+
+<h2>Recent changes (audit)</h2>
+<div id="audit"></div>
+
+<script>
+"use strict";
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text !== undefined && text !== null) { e.textContent = String(text); }
+  if (cls) { e.className = cls; }
+  return e;
+}
+
+function labels(m) {
+  return Object.keys(m || {}).sort().map(function (k) { return k + '="' + m[k] + '"'; }).join(", ");
+}
+
+function table(id, headers, rows) {
+  var div = document.getElementById(id);
+  div.textContent = "";
+  if (!rows || rows.length === 0) {
+    div.appendChild(el("p", "none", "empty"));
+    return;
+  }
+  var t = el("table"), tr = el("tr");
+  headers.forEach(function (h) { tr.appendChild(el("th", h)); });
+  t.appendChild(tr);
+  rows.forEach(function (row) {
+    var tr = el("tr");
+    row.forEach(function (cell) {
+      var td = el("td");
+      if (cell instanceof Node) { td.appendChild(cell); } else { td.textContent = cell === undefined || cell === null ? "" : String(cell); }
+      tr.appendChild(td);
+    });
+    t.appendChild(tr);
+  });
+  div.appendChild(t);
+}
+
+function actions(tenant, backend, component) {
+  var span = el("span");
+  [["resolve", "Force resolve"], ["resync", "Re-sync"]].forEach(function (a) {
+    var b = el("button", a[1]);
+    b.onclick = function () { act(a[0], tenant, backend, component); };
+    span.appendChild(b);
+  });
+  return span;
+}
+
+function act(action, tenant, backend, component) {
+  if (action === "resolve" && !confirm("Resolve the open incidents of " + component + " on " + tenant + "/" + backend + "?")) {
+    return;
+  }
+  fetch("/admin/api/" + action, {
+    method: "POST",
+    credentials: "same-origin",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ tenant: tenant, backend: backend, component: component })
+  }).then(function (r) {
+    return r.json().then(function (body) { return { ok: r.ok, body: body }; });
+  }).then(function (r) {
+    var m = document.getElementById("message");
+    m.textContent = r.ok ? component + ": " + r.body.changes + " change(s)" : component + ": " + r.body.error;
+    m.className = r.ok ? "ok" : "error";
+    refresh();
+  });
+}
+
+function render(state) {
+  table("alerts", ["Tenant", "Component", "Backends", "Labels", "Starts at", "Actions"], (state.alerts || []).map(function (a) {
+    var backends = el("span"), buttons = el("span");
+    Object.keys(a.components || {}).sort().forEach(function (b) {
+      var id = a.components[b];
+      backends.appendChild(el("div", b + ": " + (id ? "#" + id : "not found") + (a.dry_run ? " (dry-run)" : ""), id ? "" : "missing"));
+      if (id) {
+        var d = el("div");
+        d.appendChild(actions(a.tenant, b, a.component));
+        buttons.appendChild(d);
+      }
+    });
+    return [a.tenant, a.component, backends, el("code", labels(a.labels)), a.starts_at, buttons];
+  }));
+
+  var incidents = (state.incidents || []).map(function (i) {
+    return [i.tenant, i.backend, i.component, "#" + i.incident_id, i.status, i.created_at, i.updated_at, actions(i.tenant, i.backend, i.component)];
+  });
+  Object.keys(state.backend_errors || {}).sort().forEach(function (b) {
+    incidents.push([b, "", "", "", el("span", state.backend_errors[b], "error"), "", "", ""]);
+  });
+  table("incidents", ["Tenant", "Backend", "Component", "Incident", "Status", "Created", "Updated", "Actions"], incidents);
+
+  table("overrides", ["Tenant", "Component", "Status", "Reason", "Created", "Expires", "Last alert"], (state.overrides || []).map(function (o) {
+    return [o.tenant, o.component, o.status, o.reason, o.created_at, o.expires_at, o.firing === undefined ? "" : (o.firing ? "firing" : "resolved")];
+  }));
+
+  table("routes", ["Tenant", "Match", "Backends", "Fire after", "Resolve after", "Flap window", "Dry run"], (state.routes || []).map(function (r) {
+    return [r.tenant, el("code", labels(r.match) || "(no route matching)"), r.backends.join(", "), r.fire_after, r.resolve_after, r.flap_window, r.dry_run ? "yes" : ""];
+  }));
+
+  table("errors", ["Time", "Tenant", "Backend", "Component", "Request", "Error"], (state.errors || []).map(function (e) {
+    return [e.time, e.tenant, e.backend, e.component, e.request_id, el("span", e.error, "error")];
+  }));
+
+  if (state.audit === undefined) {
+    var audit = document.getElementById("audit");
+    audit.textContent = "";
+    audit.appendChild(el("p", "the audit log is disabled (audit_file)", "empty"));
+  } else {
+    table("audit", ["Time", "Action", "Tenant", "Backend", "Component", "Incident", "Status", "Result"], state.audit.map(function (e) {
+      return [e.time, e.action, e.tenant, e.backend, e.component, e.incident_id ? "#" + e.incident_id : "", e.new_status,
+        e.success ? el("span", "ok", "ok") : el("span", e.error, "error")];
+    }));
+  }
+}
+
+function refresh() {
+  var status = document.getElementById("status");
+  fetch("/admin/api/state", { credentials: "same-origin" }).then(function (r) {
+    if (!r.ok) { throw new Error("HTTP " + r.status); }
+    return r.json();
+  }).then(function (state) {
+    render(state);
+    status.textContent = "updated " + new Date().toLocaleTimeString();
+    status.className = "";
+  }).catch(function (err) {
+    status.textContent = "refresh failed: " + err.message;
+    status.className = "error";
+  });
+}
+
+refresh();
+setInterval(refresh, 15000);
+</script>
+</body>
+</html>
+`
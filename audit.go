@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DEFAULT_AUDIT_MAX_SIZE is the size (in MB) of the audit file triggering a rotation
+	DEFAULT_AUDIT_MAX_SIZE = 100
+	// DEFAULT_AUDIT_MAX_FILES is the number of rotated audit files kept
+	DEFAULT_AUDIT_MAX_FILES = 5
+	// DEFAULT_AUDIT_LIMIT is the number of entries returned by /audit, if not given
+	DEFAULT_AUDIT_LIMIT = 100
+)
+
+const (
+	AUDIT_INCIDENT_CREATED = "incident_created"
+	AUDIT_INCIDENT_UPDATED = "incident_updated"
+	// AUDIT_INCIDENT_WATCHING is an incident set as "Watching", the component keeping its status
+	AUDIT_INCIDENT_WATCHING = "incident_watching"
+)
+
+// AuditEntry records one change made by the bridge on a status page
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Tenant      string    `json:"tenant"`
+	Backend     string    `json:"backend"`
+	RequestID   string    `json:"request_id,omitempty"`
+	GroupKey    string    `json:"group_key,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Component   string    `json:"component"`
+	ComponentID int       `json:"component_id"`
+	IncidentID  int       `json:"incident_id,omitempty"`
+	// OldStatus is the incident status before an update (0 if unknown)
+	OldStatus int `json:"old_status,omitempty"`
+	NewStatus int `json:"new_status"`
+	// OldComponentStatus is the component status before the change, as last listed or
+	// set by the bridge (0 if unknown, i.e. the webhook backend has no component status)
+	OldComponentStatus int    `json:"old_component_status,omitempty"`
+	NewComponentStatus int    `json:"new_component_status,omitempty"`
+	Message            string `json:"message,omitempty"`
+	// HTTPStatus are the status codes of the requests sent to the backend
+	HTTPStatus []int  `json:"http_status,omitempty"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+}
+
+// AuditFilter selects the audit entries, empty fields matching everything
+type AuditFilter struct {
+	Tenant      string
+	Backend     string
+	Component   string
+	GroupKey    string
+	Fingerprint string
+	Action      string
+	Since       time.Time
+	Until       time.Time
+	Limit       int
+}
+
+func (f *AuditFilter) matches(entry *AuditEntry) bool {
+	return (f.Tenant == "" || f.Tenant == entry.Tenant) &&
+		(f.Backend == "" || f.Backend == entry.Backend) &&
+		(f.Component == "" || f.Component == entry.Component) &&
+		(f.GroupKey == "" || f.GroupKey == entry.GroupKey) &&
+		(f.Fingerprint == "" || f.Fingerprint == entry.Fingerprint) &&
+		(f.Action == "" || f.Action == entry.Action) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.Time.Before(f.Until))
+}
+
+// rotatingFile appends JSON lines to a file, rotated when it reaches maxSize bytes:
+// file is renamed file.1, file.1 file.2... up to maxFiles
+type rotatingFile struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	os.Remove(f.rotatedPath(f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(f.rotatedPath(i), f.rotatedPath(i+1))
+	}
+	if f.maxFiles > 0 {
+		if err := os.Rename(f.path, f.rotatedPath(1)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+// append writes v as a JSON line
+func (f *rotatingFile) append(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// snapshot opens the current file and the rotated ones (the most recent first) with their size.
+// The lock is only held to open them: once opened, they are read while being appended or rotated
+func (f *rotatingFile) snapshot() ([]*os.File, []int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	files := make([]*os.File, 0, f.maxFiles+1)
+	sizes := make([]int64, 0, f.maxFiles+1)
+	for i := 0; i <= f.maxFiles; i++ {
+		path := f.path
+		if i > 0 {
+			path = f.rotatedPath(i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err == nil {
+			var info os.FileInfo
+			if info, err = file.Stat(); err == nil {
+				files = append(files, file)
+				sizes = append(sizes, info.Size())
+				continue
+			}
+			file.Close()
+		}
+		for _, file := range files {
+			file.Close()
+		}
+		return nil, nil, err
+	}
+	if len(sizes) > 0 {
+		// only the lines fully written
+		sizes[0] = f.size
+	}
+	return files, sizes, nil
+}
+
+// Close closes the file
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
+
+// AuditLog appends the entries as JSON lines to a rotated file
+type AuditLog struct {
+	*rotatingFile
+}
+
+func NewAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	file, err := newRotatingFile(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file}, nil
+}
+
+// Record appends an entry to the audit file
+func (a *AuditLog) Record(entry *AuditEntry) error {
+	return a.append(entry)
+}
+
+// Query returns the entries matching the filter, the most recent first. The files are read
+// from their end without holding the lock, and only until the limit is reached
+func (a *AuditLog) Query(filter AuditFilter) ([]*AuditEntry, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DEFAULT_AUDIT_LIMIT
+	}
+
+	files, sizes, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	// from the current file to the oldest rotated one
+	entries := make([]*AuditEntry, 0)
+	for i, file := range files {
+		err := scanLinesBackward(file, sizes[i], func(line []byte) bool {
+			var entry AuditEntry
+			if json.Unmarshal(line, &entry) != nil || !filter.matches(&entry) {
+				return true
+			}
+			entries = append(entries, &entry)
+			return len(entries) < filter.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) >= filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// scanLinesBackward calls fn with the lines of the first size bytes of the file, the last
+// one first, until fn returns false. The line is only valid during the call
+func scanLinesBackward(file *os.File, size int64, fn func(line []byte) bool) error {
+	const blockSize = 64 * 1024
+	// buf holds the bytes read, whose lines were not given yet
+	var buf []byte
+	for offset := size; offset > 0; {
+		n := int64(blockSize)
+		if n > offset {
+			n = offset
+		}
+		offset -= n
+		block := make([]byte, n, n+int64(len(buf)))
+		if _, err := file.ReadAt(block, offset); err != nil {
+			return err
+		}
+		buf = append(block, buf...)
+
+		// the bytes before the first newline may be the end of a line not fully read yet
+		for {
+			i := bytes.LastIndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			line := buf[i+1:]
+			buf = buf[:i]
+			if len(line) > 0 && !fn(line) {
+				return nil
+			}
+		}
+	}
+	if len(buf) > 0 {
+		fn(buf)
+	}
+	return nil
+}
+
+// Handler serves the audit entries, filtered by the query parameters tenant, backend,
+// component, group_key, fingerprint, action, since and until (RFC3339), and limit
+func (a *AuditLog) Handler(c *gin.Context) {
+	filter := AuditFilter{
+		Tenant:      c.Query("tenant"),
+		Backend:     c.Query("backend"),
+		Component:   c.Query("component"),
+		GroupKey:    c.Query("group_key"),
+		Fingerprint: c.Query("fingerprint"),
+		Action:      c.Query("action"),
+	}
+	var err error
+	if since := c.Query("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since: " + err.Error()})
+			return
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid until: " + err.Error()})
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit: " + err.Error()})
+			return
+		}
+	}
+
+	entries, err := a.Query(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// AlertInfo describes the alert being processed, for the audit of the backends calls
+type AlertInfo struct {
+	GroupKey    string
+	Fingerprint string
+}
+
+type alertInfoKey struct{}
+
+// WithAlertInfo returns a context carrying the alert being processed
+func WithAlertInfo(ctx context.Context, info AlertInfo) context.Context {
+	return context.WithValue(ctx, alertInfoKey{}, info)
+}
+
+// AlertInfoFrom returns the alert being processed (zero value if none)
+func AlertInfoFrom(ctx context.Context) AlertInfo {
+	info, _ := ctx.Value(alertInfoKey{}).(AlertInfo)
+	return info
+}
+
+// backendRecorder collects what a backend reports of its requests: the status codes of the
+// answers, the id of the incident created and the status of the components listed
+type backendRecorder struct {
+	lock       sync.Mutex
+	statuses   []int
+	incidentID int
+	components map[int]int
+}
+
+type backendRecorderKey struct{}
+
+func withBackendRecorder(ctx context.Context) (context.Context, *backendRecorder) {
+	recorder := &backendRecorder{components: make(map[int]int)}
+	return context.WithValue(ctx, backendRecorderKey{}, recorder), recorder
+}
+
+// recordHTTPStatus is called by the backends for each answer received
+func recordHTTPStatus(ctx context.Context, status int) {
+	if recorder, ok := ctx.Value(backendRecorderKey{}).(*backendRecorder); ok {
+		recorder.lock.Lock()
+		recorder.statuses = append(recorder.statuses, status)
+		recorder.lock.Unlock()
+	}
+}
+
+// recordIncidentID is called by the backends with the id of the incident created
+func recordIncidentID(ctx context.Context, incidentID int) {
+	if recorder, ok := ctx.Value(backendRecorderKey{}).(*backendRecorder); ok {
+		recorder.lock.Lock()
+		recorder.incidentID = incidentID
+		recorder.lock.Unlock()
+	}
+}
+
+// recordComponentStatus is called by the backends with the status of each component listed
+func recordComponentStatus(ctx context.Context, componentID, status int) {
+	if recorder, ok := ctx.Value(backendRecorderKey{}).(*backendRecorder); ok {
+		recorder.lock.Lock()
+		recorder.components[componentID] = status
+		recorder.lock.Unlock()
+	}
+}
+
+// auditingCachet records the incidents created and updated on the wrapped backend. The previous
+// statuses come from the components listed and the incidents searched before, without more requests
+type auditingCachet struct {
+	backend Cachet
+	tenant  string
+	name    string
+	audit   *AuditLog
+
+	lock sync.Mutex
+	// components is the last known status of the components (0 if the backend does not tell)
+	components map[int]int
+	// incidents is the last known status of the incidents, per component
+	incidents map[int]map[int]int
+}
+
+// WithAudit records the changes made on the backend in the audit log (if not nil)
+func WithAudit(backend Cachet, tenant, name string, audit *AuditLog) Cachet {
+	if audit == nil || backend == nil {
+		return backend
+	}
+	return &auditingCachet{
+		backend:    backend,
+		tenant:     tenant,
+		name:       name,
+		audit:      audit,
+		components: make(map[int]int),
+		incidents:  make(map[int]map[int]int),
+	}
+}
+
+// incidentStatuses returns the incident and component statuses set for an alert status
+func incidentStatuses(status int) (int, int) {
+	if status == 1 {
+		return 4, 1 // "Fixed", "Operational"
+	}
+	return 2, 4 // "Identified", "Major Outage"
+}
+
+// previous returns the last known status of a component and of one of its incidents (0 if unknown)
+func (a *auditingCachet) previous(componentID, incidentID int) (int, int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.components[componentID], a.incidents[componentID][incidentID]
+}
+
+// changed remembers the statuses set by a successful change
+func (a *auditingCachet) changed(entry *AuditEntry) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if entry.NewComponentStatus != 0 {
+		a.components[entry.ComponentID] = entry.NewComponentStatus
+	}
+	if entry.IncidentID != 0 {
+		if a.incidents[entry.ComponentID] == nil {
+			a.incidents[entry.ComponentID] = make(map[int]int)
+		}
+		a.incidents[entry.ComponentID][entry.IncidentID] = entry.NewStatus
+	}
+}
+
+func (a *auditingCachet) record(ctx context.Context, entry *AuditEntry, recorder *backendRecorder, err error) {
+	info := AlertInfoFrom(ctx)
+	entry.Time = time.Now().UTC()
+	entry.Tenant = a.tenant
+	entry.Backend = a.name
+	entry.RequestID = RequestIDFrom(ctx)
+	entry.GroupKey = info.GroupKey
+	entry.Fingerprint = info.Fingerprint
+	entry.HTTPStatus = recorder.statuses
+	entry.Success = err == nil
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		a.changed(entry)
+	}
+	if recordErr := a.audit.Record(entry); recordErr != nil {
+		LoggerFrom(ctx).Error("unable to write the audit log", "error", recordErr)
+	}
+}
+
+func (a *auditingCachet) PingContext(ctx context.Context) error {
+	return pingBackend(ctx, a.backend)
+}
+
+func (a *auditingCachet) CheckWriteContext(ctx context.Context) error {
+	return checkBackendWrite(ctx, a.backend)
+}
+
+func (a *auditingCachet) ListComponentsContext(ctx context.Context) (map[string]int, error) {
+	recorderCtx, recorder := withBackendRecorder(ctx)
+	components, err := a.backend.ListComponentsContext(recorderCtx)
+	if err == nil {
+		a.lock.Lock()
+		for componentID, status := range recorder.components {
+			a.components[componentID] = status
+		}
+		a.lock.Unlock()
+	}
+	return components, err
+}
+
+func (a *auditingCachet) SearchComponentContext(ctx context.Context, name string) (int, error) {
+	return a.backend.SearchComponentContext(ctx, name)
+}
+
+func (a *auditingCachet) ReadIncidentContext(ctx context.Context, incidentId int) (*CachetIncident, error) {
+	return a.backend.ReadIncidentContext(ctx, incidentId)
+}
+
+func (a *auditingCachet) SearchIncidentsContext(ctx context.Context, componentId int) ([]*CachetIncident, error) {
+	incidents, err := a.backend.SearchIncidentsContext(ctx, componentId)
+	if err == nil {
+		statuses := make(map[int]int)
+		for _, incident := range incidents {
+			statuses[incident.Id] = incident.Status
+		}
+		a.lock.Lock()
+		a.incidents[componentId] = statuses
+		a.lock.Unlock()
+	}
+	return incidents, err
+}
+
+func (a *auditingCachet) CreateIncidentContext(ctx context.Context, componentName string, componentID, status int, componentStatus int) error {
+	oldComponentStatus, _ := a.previous(componentID, 0)
+	recorderCtx, recorder := withBackendRecorder(ctx)
+	err := a.backend.CreateIncidentContext(recorderCtx, componentName, componentID, status, componentStatus)
+
+	newStatus, _ := incidentStatuses(status)
+	a.record(ctx, &AuditEntry{
+		Action:             AUDIT_INCIDENT_CREATED,
+		Component:          componentName,
+		ComponentID:        componentID,
+		IncidentID:         recorder.incidentID,
+		NewStatus:          newStatus,
+		OldComponentStatus: oldComponentStatus,
+		NewComponentStatus: componentStatus,
+	}, recorder, err)
+	return err
+}
+
+func (a *auditingCachet) UpdateIncidentContext(ctx context.Context, componentName string, componentID, incidentId, status int, message string) error {
+	oldComponentStatus, oldStatus := a.previous(componentID, incidentId)
+	recorderCtx, recorder := withBackendRecorder(ctx)
+	err := a.backend.UpdateIncidentContext(recorderCtx, componentName, componentID, incidentId, status, message)
+
+	newStatus, newComponentStatus := incidentStatuses(status)
+	a.record(ctx, &AuditEntry{
+		Action:             AUDIT_INCIDENT_UPDATED,
+		Component:          componentName,
+		ComponentID:        componentID,
+		IncidentID:         incidentId,
+		OldStatus:          oldStatus,
+		NewStatus:          newStatus,
+		OldComponentStatus: oldComponentStatus,
+		NewComponentStatus: newComponentStatus,
+		Message:            message,
+	}, recorder, err)
+	return err
+}
+
+func (a *auditingCachet) WatchIncidentContext(ctx context.Context, componentName string, componentID, incidentId int, message string) error {
+	oldComponentStatus, oldStatus := a.previous(componentID, incidentId)
+	recorderCtx, recorder := withBackendRecorder(ctx)
+	err := watchBackendIncident(recorderCtx, a.backend, componentName, componentID, incidentId, message)
+
+	// the component keeps its status
+	a.record(ctx, &AuditEntry{
+		Action:             AUDIT_INCIDENT_WATCHING,
+		Component:          componentName,
+		ComponentID:        componentID,
+		IncidentID:         incidentId,
+		OldStatus:          oldStatus,
+		NewStatus:          3, // "Watching"
+		OldComponentStatus: oldComponentStatus,
+		NewComponentStatus: oldComponentStatus,
+		Message:            message,
+	}, recorder, err)
+	return err
+}
+
+// WrapBackends replaces each backend of the configuration and its tenants
+// by wrap(tenant, name, backend), i.e. to add a decorator
+func (config *PrometheusCachetConfig) WrapBackends(wrap func(tenant, name string, backend Cachet) Cachet) {
+	if config.Cachet != nil {
+		config.Cachet = wrap(config.TenantName(), DEFAULT_BACKEND, config.Cachet)
+	}
+	for name, backend := range config.Backends {
+		config.Backends[name] = wrap(config.TenantName(), name, backend)
+	}
+	for _, tenant := range config.Tenants {
+		tenant.WrapBackends(wrap)
+	}
+}
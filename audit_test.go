@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+	audit, err := NewAuditLog(path, 400, 2)
+	assert.Nil(t, err)
+	defer audit.Close()
+
+	for i := 1; i <= 12; i++ {
+		assert.Nil(t, audit.Record(&AuditEntry{Action: AUDIT_INCIDENT_CREATED, Backend: "default", Component: "API", ComponentID: i}))
+	}
+
+	_, err = os.Stat(path + ".1")
+	assert.Nil(t, err)
+	_, err = os.Stat(path + ".2")
+	assert.Nil(t, err)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// the most recent first, the oldest ones being rotated out
+	entries, err := audit.Query(AuditFilter{})
+	assert.Nil(t, err)
+	assert.True(t, len(entries) < 12)
+	assert.Equal(t, 12, entries[0].ComponentID)
+	assert.Equal(t, 11, entries[1].ComponentID)
+
+	entries, err = audit.Query(AuditFilter{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	entries, err = audit.Query(AuditFilter{Backend: "other"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	// the queries do not block the entries being recorded (and rotated)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 13; i <= 60; i++ {
+			audit.Record(&AuditEntry{Action: AUDIT_INCIDENT_CREATED, Backend: "default", Component: "API", ComponentID: i})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		entries, err = audit.Query(AuditFilter{Limit: 3})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(entries))
+		assert.True(t, entries[0].ComponentID > entries[1].ComponentID)
+	}
+	<-done
+	entries, err = audit.Query(AuditFilter{Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 60, entries[0].ComponentID)
+}
+
+// the lines are given from the last one, across the blocks read
+func TestScanLinesBackward(t *testing.T) {
+	f, err := ioutil.TempFile("", "lines")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	long := strings.Repeat("x", 100*1024)
+	_, err = f.WriteString("first\n" + long + "\nthird\npartial")
+	assert.Nil(t, err)
+
+	// the partial line being written is not part of the size
+	lines := make([]string, 0)
+	size := int64(len("first\n" + long + "\nthird\n"))
+	assert.Nil(t, scanLinesBackward(f, size, func(line []byte) bool {
+		lines = append(lines, string(line))
+		return true
+	}))
+	assert.Equal(t, []string{"third", long, "first"}, lines)
+
+	// stopped once enough lines are read
+	lines = lines[:0]
+	assert.Nil(t, scanLinesBackward(f, size, func(line []byte) bool {
+		lines = append(lines, string(line))
+		return len(lines) < 2
+	}))
+	assert.Equal(t, []string{"third", long}, lines)
+}
+
+// each incident created or updated is audited with the webhook that triggered it
+func TestAuditWebhooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hook.Close()
+
+	audit, err := NewAuditLog(filepath.Join(dir, "audit.jsonl"), 0, 0)
+	assert.Nil(t, err)
+	defer audit.Close()
+
+	config := PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "secret",
+		SquashIncident:  true,
+		Cachet:          NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+		Audit:           audit,
+		Admin:           newTestAdminConsole(),
+	}
+	config.WrapBackends(func(tenant, name string, backend Cachet) Cachet {
+		return WithAudit(backend, tenant, name, audit)
+	})
+	router := PrepareGinRouter(&config)
+
+	for _, status := range []string{"firing", "resolved"} {
+		jsonStr := []byte(`{"receiver":"cachethq-receiver","groupKey":"{}:{alertname=\"component21\"}","status":"` + status + `","alerts":[{"status":"` + status + `","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}`)
+		req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// the audit API needs the admin credentials
+	req := httptest.NewRequest("GET", "/audit", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = adminRequest(router, "GET", "/audit?component=component21", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var answer struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &answer))
+	assert.Equal(t, 3, len(answer.Entries))
+
+	// the resolution first: a squashed incident is updated twice
+	updated := answer.Entries[0]
+	assert.Equal(t, AUDIT_INCIDENT_UPDATED, updated.Action)
+	assert.Equal(t, DEFAULT_BACKEND, updated.Tenant)
+	assert.Equal(t, DEFAULT_BACKEND, updated.Backend)
+	assert.Equal(t, 4, updated.OldStatus)
+	assert.Equal(t, 4, updated.NewStatus)
+	assert.Equal(t, 1, updated.NewComponentStatus)
+	assert.Equal(t, 2, answer.Entries[1].OldStatus)
+	assert.Equal(t, 4, answer.Entries[1].OldComponentStatus)
+
+	created := answer.Entries[2]
+	assert.Equal(t, AUDIT_INCIDENT_CREATED, created.Action)
+	assert.Equal(t, `{}:{alertname="component21"}`, created.GroupKey)
+	assert.Equal(t, "f1a2", created.Fingerprint)
+	assert.Equal(t, "component21", created.Component)
+	assert.Equal(t, 1, created.IncidentID)
+	assert.Equal(t, 2, created.NewStatus)
+	assert.Equal(t, 4, created.NewComponentStatus)
+	assert.Equal(t, []int{http.StatusAccepted}, created.HTTPStatus)
+	assert.True(t, created.Success)
+	assert.NotEqual(t, "", created.RequestID)
+
+	w = adminRequest(router, "GET", "/audit?action=incident_created&since=2000-01-01T00:00:00Z", "")
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &answer))
+	assert.Equal(t, 1, len(answer.Entries))
+
+	w = adminRequest(router, "GET", "/audit?since=yesterday", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// the incident created and the previous statuses are audited, without reading the incidents updated
+func TestAuditCachet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	cachet := NewCachetImpl(fake.URL, "1234567890abcdef", fake.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+
+	audit, err := NewAuditLog(filepath.Join(dir, "audit.jsonl"), 0, 0)
+	assert.Nil(t, err)
+	defer audit.Close()
+
+	config := PrometheusCachetConfig{
+		LabelName:      "alertname",
+		SquashIncident: true,
+		Cachet:         cachet,
+		Audit:          audit,
+	}
+	config.WrapBackends(func(tenant, name string, backend Cachet) Cachet {
+		return WithAudit(backend, tenant, name, audit)
+	})
+	router := PrepareGinRouter(&config)
+
+	for _, status := range []string{"firing", "resolved"} {
+		jsonStr := []byte(`{"receiver":"cachethq-receiver","status":"` + status + `","alerts":[{"status":"` + status + `","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}`)
+		req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	entries, err := audit.Query(AuditFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	incidentID := fake.Incidents(0)[0].ID
+
+	created := entries[2]
+	assert.Equal(t, AUDIT_INCIDENT_CREATED, created.Action)
+	assert.Equal(t, incidentID, created.IncidentID)
+	assert.Equal(t, 1, created.OldComponentStatus)
+	assert.Equal(t, 4, created.NewComponentStatus)
+
+	// a squashed incident is updated twice
+	updated := entries[1]
+	assert.Equal(t, AUDIT_INCIDENT_UPDATED, updated.Action)
+	assert.Equal(t, incidentID, updated.IncidentID)
+	assert.Equal(t, 2, updated.OldStatus)
+	assert.Equal(t, 4, updated.NewStatus)
+	assert.Equal(t, 4, updated.OldComponentStatus)
+	assert.Equal(t, 1, updated.NewComponentStatus)
+	assert.Equal(t, []int{http.StatusOK}, updated.HTTPStatus)
+	assert.Equal(t, 4, entries[0].OldStatus)
+	assert.Equal(t, 1, entries[0].OldComponentStatus)
+
+	// only read by the squashing, to tell how long the service was down
+	reads := 0
+	for _, request := range fake.Requests() {
+		if strings.HasPrefix(request, fmt.Sprintf("GET /api/v1/incidents/%d", incidentID)) {
+			reads++
+		}
+	}
+	assert.Equal(t, 1, reads)
+}
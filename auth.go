@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how often a token file is checked for modification
+var tokenFileCheckInterval = 5 * time.Second
+
+// tokenFile holds the tokens found in a file (one per line), typically a Kubernetes
+// secret mount, reloaded when the file changes
+type tokenFile struct {
+	path string
+
+	lock    sync.Mutex
+	checked time.Time
+	modTime time.Time
+	size    int64
+	tokens  []string
+}
+
+func newTokenFile(path string) (*tokenFile, error) {
+	f := &tokenFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *tokenFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.checked = time.Now()
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size && f.tokens != nil {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	tokens := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if token := strings.TrimSpace(scanner.Text()); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	f.tokens = tokens
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// Tokens returns the current tokens. If the file cannot be read anymore, the last known tokens are kept
+func (f *tokenFile) Tokens() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if time.Since(f.checked) >= tokenFileCheckInterval {
+		f.reload()
+	}
+	return f.tokens
+}
+
+// Authenticator checks the bearer token (or basic auth) of the incoming requests
+type Authenticator struct {
+	realm      string
+	tokens     []string
+	tokenFiles []*tokenFile
+	basicAuth  map[string]string
+}
+
+// NewAuthenticator creates an Authenticator accepting
+// - tokens: bearer tokens
+// - tokenFiles: files containing bearer tokens (one per line)
+// - basicAuth: user => password for basic authentication
+func NewAuthenticator(realm string, tokens []string, tokenFiles []string, basicAuth map[string]string) (*Authenticator, error) {
+	a := &Authenticator{
+		realm:     realm,
+		basicAuth: basicAuth,
+	}
+	for _, token := range tokens {
+		if token != "" {
+			a.tokens = append(a.tokens, token)
+		}
+	}
+	for _, path := range tokenFiles {
+		f, err := newTokenFile(path)
+		if err != nil {
+			return nil, err
+		}
+		a.tokenFiles = append(a.tokenFiles, f)
+	}
+	return a, nil
+}
+
+// ParseBasicAuth converts "user1:password1,user2:password2" into a map. The passwords must not be empty
+func ParseBasicAuth(users string) (map[string]string, error) {
+	basicAuth := make(map[string]string)
+	for _, user := range strings.Split(users, ",") {
+		user = strings.TrimSpace(user)
+		if user == "" {
+			continue
+		}
+		i := strings.Index(user, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("basic auth must be in the form user:password")
+		}
+		if i == len(user)-1 {
+			return nil, fmt.Errorf("basic auth of %s has an empty password", user[:i])
+		}
+		basicAuth[user[:i]] = user[i+1:]
+	}
+	return basicAuth, nil
+}
+
+// Enabled returns false if no credential is configured (i.e. everybody is accepted)
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0 || len(a.tokenFiles) > 0 || len(a.basicAuth) > 0
+}
+
+// secretEqual compares in constant time, whatever the lengths
+func secretEqual(given, expected string) bool {
+	h1 := sha256.Sum256([]byte(given))
+	h2 := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(h1[:], h2[:]) == 1
+}
+
+func (a *Authenticator) checkToken(given string) bool {
+	accepted := false
+	// no early exit: all the tokens are compared
+	for _, token := range a.tokens {
+		if secretEqual(given, token) {
+			accepted = true
+		}
+	}
+	for _, f := range a.tokenFiles {
+		for _, token := range f.Tokens() {
+			if secretEqual(given, token) {
+				accepted = true
+			}
+		}
+	}
+	return accepted
+}
+
+func (a *Authenticator) checkBasicAuth(user, password string) bool {
+	expected, ok := a.basicAuth[user]
+	if !ok {
+		// compare anyway, to not leak which users exist
+		secretEqual(password, password+"x")
+		return false
+	}
+	return secretEqual(password, expected)
+}
+
+const (
+	credentialMissing = iota
+	credentialInvalid
+	credentialValid
+)
+
+// verify returns credentialValid if the request is authenticated, credentialMissing if
+// no (supported) credential was given, credentialInvalid if the credential is wrong
+func (a *Authenticator) verify(r *http.Request) int {
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		if a.checkToken(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))) {
+			return credentialValid
+		}
+		return credentialInvalid
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && len(a.basicAuth) > 0 {
+		if a.checkBasicAuth(user, password) {
+			return credentialValid
+		}
+		return credentialInvalid
+	}
+
+	return credentialMissing
+}
+
+// Check returns http.StatusOK if the request is authenticated, http.StatusUnauthorized if
+// no (supported) credential was given, or if it is wrong
+func (a *Authenticator) Check(r *http.Request) int {
+	if !a.Enabled() || a.verify(r) == credentialValid {
+		return http.StatusOK
+	}
+	return http.StatusUnauthorized
+}
+
+// Accepts returns true if the request has a credential configured on this Authenticator
+func (a *Authenticator) Accepts(r *http.Request) bool {
+	return a.Enabled() && a.verify(r) == credentialValid
+}
+
+// Authenticate checks the request, and answers it (401 with WWW-Authenticate) if it is not
+// authenticated. onReject (optional) is called with the HTTP status of each rejected request
+func (a *Authenticator) Authenticate(c *gin.Context, onReject func(c *gin.Context, status int)) bool {
+	if !a.Enabled() {
+		return true
+	}
+	credential := a.verify(c.Request)
+	if credential == credentialValid {
+		return true
+	}
+
+	if onReject != nil {
+		onReject(c, http.StatusUnauthorized)
+	}
+	if credential == credentialInvalid {
+		// RFC 6750 section 3.1: a wrong token is challenged again, with the reason
+		if strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") {
+			c.Writer.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="invalid_token"`, a.realm))
+		} else {
+			c.Writer.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, a.realm))
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "wrong Authorization header"})
+		return false
+	}
+	if len(a.tokens) > 0 || len(a.tokenFiles) > 0 {
+		c.Writer.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, a.realm))
+	}
+	if len(a.basicAuth) > 0 {
+		c.Writer.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, a.realm))
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing Authorization header"})
+	return false
+}
+
+// Middleware returns a gin handler aborting the non authenticated requests
+func (a *Authenticator) Middleware(onReject func(c *gin.Context, status int)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.Authenticate(c, onReject) {
+			c.Next()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func authRouter(auth *Authenticator) *gin.Engine {
+	router := gin.New()
+	router.POST("/alert", auth.Middleware(nil), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "OK"})
+	})
+	return router
+}
+
+func authRequest(router *gin.Engine, setup func(r *http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/alert", nil)
+	if setup != nil {
+		setup(req)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func TestAuthenticatorTokens(t *testing.T) {
+	auth, err := NewAuthenticator("test", []string{"old", "new"}, nil, nil)
+	assert.Nil(t, err)
+	router := authRouter(auth)
+
+	assert.Equal(t, http.StatusOK, authRequest(router, bearer("old")).Code)
+	assert.Equal(t, http.StatusOK, authRequest(router, bearer("new")).Code)
+	w := authRequest(router, bearer("newer"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, []string{`Bearer realm="test", error="invalid_token"`}, w.Header()["Www-Authenticate"])
+
+	w = authRequest(router, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, []string{`Bearer realm="test"`}, w.Header()["Www-Authenticate"])
+
+	// no credential configured: everybody is accepted
+	open, err := NewAuthenticator("test", []string{""}, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, authRequest(authRouter(open), nil).Code)
+}
+
+func TestAuthenticatorBasicAuth(t *testing.T) {
+	users, err := ParseBasicAuth("alertmanager:secret, other:pass:word")
+	assert.Nil(t, err)
+	assert.Equal(t, "pass:word", users["other"])
+
+	_, err = ParseBasicAuth("nopassword")
+	assert.NotNil(t, err)
+	_, err = ParseBasicAuth("admin:")
+	assert.NotNil(t, err)
+
+	auth, err := NewAuthenticator("test", []string{"token"}, nil, users)
+	assert.Nil(t, err)
+	router := authRouter(auth)
+
+	assert.Equal(t, http.StatusOK, authRequest(router, func(r *http.Request) { r.SetBasicAuth("alertmanager", "secret") }).Code)
+	w := authRequest(router, func(r *http.Request) { r.SetBasicAuth("alertmanager", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, []string{`Basic realm="test"`}, w.Header()["Www-Authenticate"])
+	assert.Equal(t, http.StatusUnauthorized, authRequest(router, func(r *http.Request) { r.SetBasicAuth("unknown", "secret") }).Code)
+	assert.Equal(t, http.StatusOK, authRequest(router, bearer("token")).Code)
+
+	w = authRequest(router, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, []string{`Bearer realm="test"`, `Basic realm="test"`}, w.Header()["Www-Authenticate"])
+}
+
+func TestAuthenticatorTokenFile(t *testing.T) {
+	previous := tokenFileCheckInterval
+	tokenFileCheckInterval = 0
+	defer func() { tokenFileCheckInterval = previous }()
+
+	f, err := ioutil.TempFile("", "token")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("first\n\nsecond\n"), 0600))
+
+	_, err = NewAuthenticator("test", nil, []string{"/nonexistent/token"}, nil)
+	assert.NotNil(t, err)
+
+	auth, err := NewAuthenticator("test", nil, []string{f.Name()}, nil)
+	assert.Nil(t, err)
+	router := authRouter(auth)
+
+	assert.Equal(t, http.StatusOK, authRequest(router, bearer("first")).Code)
+	assert.Equal(t, http.StatusOK, authRequest(router, bearer("second")).Code)
+	assert.Equal(t, http.StatusUnauthorized, authRequest(router, bearer("third")).Code)
+
+	// the secret is rotated
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("third\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(f.Name(), later, later))
+
+	assert.Equal(t, http.StatusOK, authRequest(router, bearer("third")).Code)
+	assert.Equal(t, http.StatusUnauthorized, authRequest(router, bearer("first")).Code)
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 type CachetIncident struct {
@@ -18,31 +21,35 @@ type CachetIncident struct {
 	UpdatedAt   string `json:"updated_at"`
 }
 
-// Cachet is a facade to CachetHQ client calls
+// Cachet is a facade to status page client calls. CachetImpl talks to CachetHQ,
+// StatuspageImpl to Atlassian Statuspage.io and WebhookImpl to a generic webhook.
+// Component and incident status follow the CachetHQ conventions whatever the backend.
+// Every call takes a context: a cancelled or expired context aborts the pending requests.
+// The methods without context (ListComponents, CreateIncident...) are no longer part of
+// the interface: only CachetImpl keeps them, an implementation must provide the ones below
 type Cachet interface {
-	// List will fetch the different CachetHQ components (id/name) via a GET /api/v1/components
-	// it will return a map[componentname]componentid
-	ListComponents() (map[string]int, error)
+	// ListComponentsContext returns the components of the status page: map[componentname]componentid
+	ListComponentsContext(ctx context.Context) (map[string]int, error)
 
-	SearchComponent(name string) (int, error)
+	// SearchComponentContext returns the id of the component named name
+	SearchComponentContext(ctx context.Context, name string) (int, error)
 
-	// Return an incident
-	ReadIncident(incidentId int) (*CachetIncident, error)
+	// ReadIncidentContext returns an incident
+	ReadIncidentContext(ctx context.Context, incidentId int) (*CachetIncident, error)
 
-	// Returns all incidents for a given component, ASC sorted (i.e. the last incident, is the first in the list)
-	SearchIncidents(componentId int) ([]*CachetIncident, error)
+	// SearchIncidentsContext returns all incidents for a given component, the last incident first
+	SearchIncidentsContext(ctx context.Context, componentId int) ([]*CachetIncident, error)
 
-	// CreateIncident will create a new incident for the choosen CachetHQ components (id/name) via a POST /api/v1/incidents
-	// component status: component status: https://docs.cachethq.io/docs/component-statuses
+	// CreateIncidentContext opens an incident on a component, or records a resolved one
 	// - status = 1 for alert resolved
 	// - status = 4 for alert fatal
-	CreateIncident(componentName string, componentID, status int, componentStatus int) error
+	// the component gets componentStatus: https://docs.cachethq.io/docs/component-statuses
+	CreateIncidentContext(ctx context.Context, componentName string, componentID, status int, componentStatus int) error
 
-	// UpdateIncident will create a new incident update for the choosen CachetHQ components (id/name) via a PUT /api/v1/incidents/<incidentid>
-	// component status: component status: https://docs.cachethq.io/docs/component-statuses
-	// - status = 1 for alert resolved
-	// - status = 4 for alert fatal
-	UpdateIncident(componentName string, componentID, incidentId, status int, message string) error
+	// UpdateIncidentContext adds an update with message to an incident of a component
+	// - status = 1 for alert resolved: the incident is fixed, the component operational
+	// - status = 4 for alert fatal: the incident stays open, the component in major outage
+	UpdateIncidentContext(ctx context.Context, componentName string, componentID, incidentId, status int, message string) error
 }
 
 // cf https://docs.cachethq.io/reference#update-a-component
@@ -110,8 +117,9 @@ type cachetHqComponentList struct {
 		} `json:"pagination"`
 	} `json:"meta"`
 	Data []struct {
-		Id   int    `json:"id"`
-		Name string `json:"name"`
+		Id     int    `json:"id"`
+		Name   string `json:"name"`
+		Status int    `json:"status"`
 	} `json:"data"`
 }
 
@@ -139,13 +147,36 @@ type cachetHqIncident struct {
 	ComponentStatus int    `json:"component_status"`
 }
 
+const (
+	CACHET_API_AUTO = 0
+	CACHET_API_V2   = 2
+	CACHET_API_V3   = 3
+)
+
+// CachetAPIError is returned when CachetHQ answers with a non 2xx HTTP code
+type CachetAPIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *CachetAPIError) Error() string {
+	return fmt.Sprintf("CachetHQ %s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
 type CachetImpl struct {
 	apiURL string
 	apiKey string
 	client *http.Client
+
+	// CACHET_API_V2 or CACHET_API_V3, CACHET_API_AUTO while not detected yet
+	versionLock sync.Mutex
+	version     int
 }
 
-// NewCachetImpl creates a new Cachet interface implementation
+// NewCachetImpl creates a new Cachet interface implementation.
+// The CachetHQ API version is detected on the first call, unless set by SetAPIVersion
 func NewCachetImpl(apiURL, apiKey string, client *http.Client) *CachetImpl {
 	// by precaution, remove the '/' at the end of apiURL
 	apiURL = strings.TrimRight(apiURL, "/")
@@ -157,42 +188,250 @@ func NewCachetImpl(apiURL, apiKey string, client *http.Client) *CachetImpl {
 	}
 }
 
-func (c *CachetImpl) ListComponents() (map[string]int, error) {
-	componentsID := make(map[string]int)
-	var message cachetHqComponentList
+// SetAPIVersion forces the CachetHQ API dialect (CACHET_API_V2, CACHET_API_V3, or CACHET_API_AUTO to detect it)
+func (c *CachetImpl) SetAPIVersion(version int) {
+	c.versionLock.Lock()
+	defer c.versionLock.Unlock()
+	c.version = version
+}
 
-	// we loop "only" on the max first 100 pages
-	for page := 1; page < 100; page++ {
-		nextPage := fmt.Sprintf("%s/api/v1/components?page=%d", c.apiURL, page)
+// ParseCachetAPIVersion converts a "auto", "2" or "3" parameter into a CACHET_API_* constant
+func ParseCachetAPIVersion(version string) (int, error) {
+	switch version {
+	case "", "auto":
+		return CACHET_API_AUTO, nil
+	case "2":
+		return CACHET_API_V2, nil
+	case "3":
+		return CACHET_API_V3, nil
+	}
+	return CACHET_API_AUTO, fmt.Errorf("unknown CachetHQ api version '%s' (expected auto, 2 or 3)", version)
+}
 
-		req, err := http.NewRequest(http.MethodGet, nextPage, nil)
-		if err != nil {
-			return nil, err
+// cf https://docs.cachethq.io/reference#version
+// {
+//    "meta": {
+//        "on_latest": true,
+//        "latest": {...}
+//    },
+//    "data": "2.3.15"
+// }
+type cachetHqVersion struct {
+	Data json.RawMessage `json:"data"`
+}
+
+// APIVersion returns the CachetHQ API dialect, asking /api/v1/version (Cachet 2.x) and
+// then /api/version (Cachet 3.x) if not known yet. If none answers, we stay on Cachet 2.x
+func (c *CachetImpl) APIVersion() (int, error) {
+	return c.apiVersion(context.Background())
+}
+
+func (c *CachetImpl) apiVersion(ctx context.Context) (int, error) {
+	c.versionLock.Lock()
+	defer c.versionLock.Unlock()
+
+	if c.version != CACHET_API_AUTO {
+		return c.version, nil
+	}
+
+	var message cachetHqVersion
+	err := c.do(ctx, CACHET_API_V2, http.MethodGet, "/api/v1/version", nil, &message)
+	if err == nil {
+		c.version = CACHET_API_V2
+		// Cachet 3.x may still answer the v1 version endpoint
+		var version string
+		if json.Unmarshal(message.Data, &version) == nil && strings.HasPrefix(version, "3") {
+			c.version = CACHET_API_V3
 		}
+		return c.version, nil
+	}
+	if _, ok := err.(*CachetAPIError); !ok {
+		// network error, we will try again later
+		return CACHET_API_AUTO, err
+	}
+
+	err = c.do(ctx, CACHET_API_V3, http.MethodGet, "/api/version", nil, nil)
+	if err == nil {
+		c.version = CACHET_API_V3
+		return c.version, nil
+	}
+	if _, ok := err.(*CachetAPIError); !ok {
+		return CACHET_API_AUTO, err
+	}
+
+	LoggerFrom(ctx).Warn("unable to detect the CachetHQ api version, using Cachet 2.x", "url", c.apiURL)
+	c.version = CACHET_API_V2
+	return c.version, nil
+}
 
-		req.Header.Set("Content-Type", "application/json")
+// do sends a request using the authentication of the given api version, and decodes the answer into result
+func (c *CachetImpl) do(ctx context.Context, version int, method, path string, payload interface{}, result interface{}) (err error) {
+	ctx, span := StartSpan(ctx, "CachetHQ "+method, SPAN_KIND_CLIENT)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	var buf bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&buf).Encode(payload); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, &buf)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if version == CACHET_API_V3 {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	} else {
 		req.Header.Set("X-Cachet-Token", c.apiKey)
+	}
+	if span != nil {
+		req.Header.Set("traceparent", span.TraceParent())
+		span.SetAttribute("http.method", method)
+		span.SetAttribute("http.url", redactURL(req.URL))
+	}
 
-		resp, err := c.client.Do(req)
-		if err != nil {
-			return nil, err
+	requestBody := buf.Bytes()
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		traceHTTP(ctx, req, requestBody, 0, nil, start, err)
+		return err
+	}
+	defer resp.Body.Close()
+	recordHTTPStatus(ctx, resp.StatusCode)
+	span.SetAttribute("http.status_code", resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	traceHTTP(ctx, req, requestBody, resp.StatusCode, body, start, err)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &CachetAPIError{
+			Method:     method,
+			URL:        path,
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	if result != nil {
+		if informative, ok := result.(informativeResult); ok {
+			// the request succeeded, whatever the answer
+			json.Unmarshal(body, informative.result)
+			return nil
 		}
-		defer resp.Body.Close()
-
-		body, err := ioutil.ReadAll(resp.Body)
-		if resp.StatusCode != 200 {
-			if err != nil {
-				return nil, err
-			}
-			log.Println(string(body))
+		return json.Unmarshal(body, result)
+	}
+	return nil
+}
+
+// informativeResult is an answer only read for information (i.e. the id of an incident created):
+// the request is not to be retried if it cannot be parsed
+type informativeResult struct {
+	result interface{}
+}
+
+// PingContext checks that CachetHQ answers its ping endpoint, and accepts our token
+// (the subscribers are only listed to authenticated users)
+func (c *CachetImpl) PingContext(ctx context.Context) error {
+	version, err := c.apiVersion(ctx)
+	if err != nil {
+		return err
+	}
+	prefix := "/api/v1"
+	if version == CACHET_API_V3 {
+		prefix = "/api"
+	}
+	if err := c.do(ctx, version, http.MethodGet, prefix+"/ping", nil, nil); err != nil {
+		return err
+	}
+	return c.do(ctx, version, http.MethodGet, prefix+"/subscribers?per_page=1", nil, nil)
+}
+
+// CheckWriteContext updates the incident 0, which does not exist: CachetHQ answers 404 (or rejects
+// the update as invalid, 400/422) if the token is allowed to write, and 401/403 if not. Nothing is
+// created on the status page, an incident being never numbered 0
+func (c *CachetImpl) CheckWriteContext(ctx context.Context) error {
+	version, err := c.apiVersion(ctx)
+	if err != nil {
+		return err
+	}
+	path := "/api/v1/incidents/0"
+	if version == CACHET_API_V3 {
+		path = "/api/incidents/0"
+	}
+
+	err = c.do(ctx, version, http.MethodPut, path, struct{}{}, nil)
+	if err == nil {
+		return fmt.Errorf("unexpected answer to the write check: the incident 0 was updated")
+	}
+	if apiErr, ok := err.(*CachetAPIError); ok {
+		switch apiErr.StatusCode {
+		case http.StatusNotFound, http.StatusBadRequest, http.StatusUnprocessableEntity:
+			return nil
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("the token is not allowed to write incidents (%d)", apiErr.StatusCode)
 		}
+	}
+	return err
+}
+
+// ListComponents, SearchComponent, ReadIncident, SearchIncidents, CreateIncident and
+// UpdateIncident are the calls without deadline, which were the Cachet interface before
+// the contexts: they are kept for the existing callers of CachetImpl
+func (c *CachetImpl) ListComponents() (map[string]int, error) {
+	return c.ListComponentsContext(context.Background())
+}
+
+func (c *CachetImpl) SearchComponent(name string) (int, error) {
+	return c.SearchComponentContext(context.Background(), name)
+}
+
+func (c *CachetImpl) ReadIncident(incidentId int) (*CachetIncident, error) {
+	return c.ReadIncidentContext(context.Background(), incidentId)
+}
+
+func (c *CachetImpl) SearchIncidents(componentId int) ([]*CachetIncident, error) {
+	return c.SearchIncidentsContext(context.Background(), componentId)
+}
 
-		if err := json.Unmarshal(body, &message); err != nil {
+func (c *CachetImpl) CreateIncident(componentName string, componentID, status int, componentStatus int) error {
+	return c.CreateIncidentContext(context.Background(), componentName, componentID, status, componentStatus)
+}
+
+func (c *CachetImpl) UpdateIncident(componentName string, componentID, incidentId, status int, message string) error {
+	return c.UpdateIncidentContext(context.Background(), componentName, componentID, incidentId, status, message)
+}
+
+func (c *CachetImpl) ListComponentsContext(ctx context.Context) (map[string]int, error) {
+	version, err := c.apiVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version == CACHET_API_V3 {
+		return c.listComponentsV3(ctx)
+	}
+
+	componentsID := make(map[string]int)
+	var message cachetHqComponentList
+
+	// we loop "only" on the max first 100 pages
+	for page := 1; page < 100; page++ {
+		if err := c.do(ctx, version, http.MethodGet, fmt.Sprintf("/api/v1/components?page=%d", page), nil, &message); err != nil {
 			return nil, err
 		}
 
 		for _, data := range message.Data {
 			componentsID[data.Name] = data.Id
+			recordComponentStatus(ctx, data.Id, data.Status)
 		}
 
 		// is there a next page?
@@ -204,34 +443,17 @@ func (c *CachetImpl) ListComponents() (map[string]int, error) {
 	return componentsID, nil
 }
 
-func (c *CachetImpl) SearchComponent(name string) (int, error) {
-	var message cachetHqComponentList
-
-	page := fmt.Sprintf("%s/api/v1/components?name=%s&page=1", c.apiURL, name)
-
-	req, err := http.NewRequest(http.MethodGet, page, nil)
+func (c *CachetImpl) SearchComponentContext(ctx context.Context, name string) (int, error) {
+	version, err := c.apiVersion(ctx)
 	if err != nil {
 		return -1, err
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Cachet-Token", c.apiKey)
-
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return -1, err
+	if version == CACHET_API_V3 {
+		return c.searchComponentV3(ctx, name)
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		if err != nil {
-			return -1, err
-		}
-		log.Println(string(body))
-	}
-
-	if err := json.Unmarshal(body, &message); err != nil {
+	var message cachetHqComponentList
+	if err := c.do(ctx, version, http.MethodGet, fmt.Sprintf("/api/v1/components?name=%s&page=1", url.QueryEscape(name)), nil, &message); err != nil {
 		return -1, err
 	}
 
@@ -242,7 +464,12 @@ func (c *CachetImpl) SearchComponent(name string) (int, error) {
 	return -1, fmt.Errorf("no component found")
 }
 
-func (c *CachetImpl) CreateIncident(componentName string, componentID, status int, componentStatus int) error {
+func (c *CachetImpl) CreateIncidentContext(ctx context.Context, componentName string, componentID, status int, componentStatus int) error {
+	version, err := c.apiVersion(ctx)
+	if err != nil {
+		return err
+	}
+
 	incidentName := fmt.Sprintf("%s down", componentName)
 	incidentMessage := fmt.Sprintf("Prometheus flagged service %s as down", componentName)
 	incidentStatus := 2 // "Identified"
@@ -254,6 +481,10 @@ func (c *CachetImpl) CreateIncident(componentName string, componentID, status in
 		incidentStatus = 4 // "Fixed"
 	}
 
+	if version == CACHET_API_V3 {
+		return c.createIncidentV3(ctx, incidentName, incidentMessage, incidentStatus, componentID, componentStatus)
+	}
+
 	incident := &cachetHqIncident{
 		Name:            incidentName,
 		Message:         incidentMessage,
@@ -263,39 +494,20 @@ func (c *CachetImpl) CreateIncident(componentName string, componentID, status in
 		ComponentStatus: componentStatus,
 	}
 
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(incident); err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v1/incidents", c.apiURL), &buf)
-	if err != nil {
+	var created cachetHqIncidentRead
+	if err := c.do(ctx, version, http.MethodPost, "/api/v1/incidents", incident, informativeResult{&created}); err != nil {
 		return err
 	}
+	recordIncidentID(ctx, created.Data.Id)
+	return nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Cachet-Token", c.apiKey)
-
-	resp, err := c.client.Do(req)
+func (c *CachetImpl) UpdateIncidentContext(ctx context.Context, componentName string, componentID, incidentId, status int, message string) error {
+	version, err := c.apiVersion(ctx)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
-		log.Println(string(b))
-	}
-	//body, _ := ioutil.ReadAll(resp.Body)
-	//log.Println("response from CachetHQ when sending alert: ", string(body))
 
-	return nil
-}
-
-func (c *CachetImpl) UpdateIncident(componentName string, componentID, incidentId, status int, message string) error {
 	incidentName := fmt.Sprintf("%s down", componentName)
 	incidentMessage := message
 	incidentStatus := 2  // "Identified"
@@ -309,6 +521,10 @@ func (c *CachetImpl) UpdateIncident(componentName string, componentID, incidentI
 		componentStatus = 1 // "Operational"
 	}
 
+	if version == CACHET_API_V3 {
+		return c.updateIncidentV3(ctx, incidentId, incidentMessage, incidentStatus, componentID, componentStatus)
+	}
+
 	incident := &cachetHqIncident{
 		Name:            incidentName,
 		Message:         incidentMessage,
@@ -318,64 +534,24 @@ func (c *CachetImpl) UpdateIncident(componentName string, componentID, incidentI
 		ComponentStatus: componentStatus,
 	}
 
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(incident); err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/v1/incidents/%d", c.apiURL, incidentId), &buf)
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Cachet-Token", c.apiKey)
+	return c.do(ctx, version, http.MethodPut, fmt.Sprintf("/api/v1/incidents/%d", incidentId), incident, nil)
+}
 
-	resp, err := c.client.Do(req)
+func (c *CachetImpl) SearchIncidentsContext(ctx context.Context, componentId int) ([]*CachetIncident, error) {
+	version, err := c.apiVersion(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
-		log.Println(string(b))
+	if version == CACHET_API_V3 {
+		return c.searchIncidentsV3(ctx, componentId)
 	}
-	return nil
-}
 
-func (c *CachetImpl) SearchIncidents(componentId int) ([]*CachetIncident, error) {
 	incidents := make([]*CachetIncident, 0)
 	var message cachetHqIncidemntsList
 
 	// pagination doesn't work
-	nextPage := fmt.Sprintf("%s/api/v1/incidents?component_id=%d&sort=id&order=desc&per_page=1000", c.apiURL, componentId)
-	req, err := http.NewRequest(http.MethodGet, nextPage, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Cachet-Token", c.apiKey)
-
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		if err != nil {
-			return nil, err
-		}
-		log.Println(string(body))
-	}
-
-	if err := json.Unmarshal(body, &message); err != nil {
+	nextPage := fmt.Sprintf("/api/v1/incidents?component_id=%d&sort=id&order=desc&per_page=1000", componentId)
+	if err := c.do(ctx, version, http.MethodGet, nextPage, nil, &message); err != nil {
 		return nil, err
 	}
 
@@ -387,36 +563,48 @@ func (c *CachetImpl) SearchIncidents(componentId int) ([]*CachetIncident, error)
 	return incidents, nil
 }
 
-func (c *CachetImpl) ReadIncident(incidentId int) (*CachetIncident, error) {
-	var incident cachetHqIncidentRead
-
-	request := fmt.Sprintf("%s/api/v1/incidents/%d", c.apiURL, incidentId)
-
-	req, err := http.NewRequest(http.MethodGet, request, nil)
+func (c *CachetImpl) ReadIncidentContext(ctx context.Context, incidentId int) (*CachetIncident, error) {
+	version, err := c.apiVersion(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if version == CACHET_API_V3 {
+		return c.readIncidentV3(ctx, incidentId)
+	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Cachet-Token", c.apiKey)
-
-	resp, err := c.client.Do(req)
-	if err != nil {
+	var incident cachetHqIncidentRead
+	if err := c.do(ctx, version, http.MethodGet, fmt.Sprintf("/api/v1/incidents/%d", incidentId), nil, &incident); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		if err != nil {
-			return nil, err
+	return &incident.Data, nil
+}
+
+// cachetHqIncidentWatch sets an incident as "Watching", the component keeping its status
+type cachetHqIncidentWatch struct {
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+	Visible int    `json:"visible"`
+}
+
+// WatchIncidentContext sets an incident as "Watching" (the fix is being monitored), with a message
+func (c *CachetImpl) WatchIncidentContext(ctx context.Context, componentName string, componentID, incidentId int, message string) error {
+	version, err := c.apiVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version == CACHET_API_V3 {
+		update := &cachet3IncidentUpdate{
+			Message: message,
+			Status:  cachet3IncidentStatus[3],
 		}
-		log.Println(string(body))
+		return c.do(ctx, CACHET_API_V3, http.MethodPost, fmt.Sprintf("/api/incidents/%d/updates", incidentId), update, nil)
 	}
 
-	if err := json.Unmarshal(body, &incident); err != nil {
-		return nil, err
+	incident := &cachetHqIncidentWatch{
+		Message: message,
+		Status:  3, // "Watching"
+		Visible: 1,
 	}
-
-	return &incident.Data, nil
+	return c.do(ctx, version, http.MethodPut, fmt.Sprintf("/api/v1/incidents/%d", incidentId), incident, nil)
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Cachet 3.x serves its API under /api (Bearer authentication), names its
+// statuses, and wraps resources in a JSON:API like envelope:
+//
+//	{
+//	    "data": [
+//	        {
+//	            "id": "1",
+//	            "type": "components",
+//	            "attributes": {
+//	                "name": "API",
+//	                "status": {"human": "Operational", "value": 1},
+//	                "created_at": {"human": "1 hour ago", "string": "2024-01-01T12:00:00.000000Z"}
+//	            }
+//	        }
+//	    ],
+//	    "meta": {"current_page": 1, "last_page": 1}
+//	}
+
+// Cachet incident status => Cachet 3.x incident status
+var cachet3IncidentStatus = map[int]string{
+	1: "investigating",
+	2: "identified",
+	3: "watching",
+	4: "fixed",
+}
+
+// Cachet component status => Cachet 3.x component status
+var cachet3ComponentStatus = map[int]string{
+	1: "operational",
+	2: "performance_issues",
+	3: "partial_outage",
+	4: "major_outage",
+}
+
+// cachet3Value accepts the different encodings Cachet 3.x uses for ids, statuses
+// and dates: 1, "1", "fixed", {"value": 1} or {"string": "2024-01-01T12:00:00Z"}
+type cachet3Value string
+
+func (v *cachet3Value) UnmarshalJSON(data []byte) error {
+	var object struct {
+		Value  json.RawMessage `json:"value"`
+		String string          `json:"string"`
+	}
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+		if object.String != "" {
+			*v = cachet3Value(object.String)
+			return nil
+		}
+		return v.UnmarshalJSON(object.Value)
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*v = cachet3Value(str)
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return err
+	}
+	*v = cachet3Value(number.String())
+	return nil
+}
+
+func (v cachet3Value) Int() int {
+	i, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+// IncidentStatus returns the Cachet incident status, whether Cachet 3.x sent a number or a name
+func (v cachet3Value) IncidentStatus() int {
+	for status, name := range cachet3IncidentStatus {
+		if name == string(v) {
+			return status
+		}
+	}
+	return v.Int()
+}
+
+// ComponentStatus returns the Cachet component status, whether Cachet 3.x sent a number or a name
+func (v cachet3Value) ComponentStatus() int {
+	for status, name := range cachet3ComponentStatus {
+		if name == string(v) {
+			return status
+		}
+	}
+	return v.Int()
+}
+
+// Date returns the date using the Cachet 2.x layout
+func (v cachet3Value) Date() string {
+	t, err := time.Parse(time.RFC3339Nano, string(v))
+	if err != nil {
+		return string(v)
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+type cachet3Attributes struct {
+	Name        string       `json:"name"`
+	Status      cachet3Value `json:"status"`
+	ComponentID cachet3Value `json:"component_id"`
+	CreatedAt   cachet3Value `json:"created_at"`
+	UpdatedAt   cachet3Value `json:"updated_at"`
+}
+
+type cachet3Resource struct {
+	Id         cachet3Value      `json:"id"`
+	Attributes cachet3Attributes `json:"attributes"`
+}
+
+type cachet3List struct {
+	Data []cachet3Resource `json:"data"`
+	Meta struct {
+		CurrentPage int `json:"current_page"`
+		LastPage    int `json:"last_page"`
+	} `json:"meta"`
+}
+
+type cachet3Read struct {
+	Data cachet3Resource `json:"data"`
+}
+
+type cachet3Incident struct {
+	Name        string `json:"name"`
+	Message     string `json:"message"`
+	Status      string `json:"status"`
+	Visible     bool   `json:"visible"`
+	ComponentID int    `json:"component_id"`
+}
+
+type cachet3IncidentUpdate struct {
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+type cachet3Component struct {
+	Status string `json:"status"`
+}
+
+func (r *cachet3Resource) incident() *CachetIncident {
+	return &CachetIncident{
+		Id:          r.Id.Int(),
+		ComponentId: r.Attributes.ComponentID.Int(),
+		Status:      r.Attributes.Status.IncidentStatus(),
+		CreatedAt:   r.Attributes.CreatedAt.Date(),
+		UpdatedAt:   r.Attributes.UpdatedAt.Date(),
+	}
+}
+
+func (c *CachetImpl) listComponentsV3(ctx context.Context) (map[string]int, error) {
+	componentsID := make(map[string]int)
+
+	// we loop "only" on the max first 100 pages
+	for page := 1; page < 100; page++ {
+		var message cachet3List
+		if err := c.do(ctx, CACHET_API_V3, http.MethodGet, fmt.Sprintf("/api/components?page=%d&per_page=100", page), nil, &message); err != nil {
+			return nil, err
+		}
+
+		for _, data := range message.Data {
+			componentsID[data.Attributes.Name] = data.Id.Int()
+			recordComponentStatus(ctx, data.Id.Int(), data.Attributes.Status.ComponentStatus())
+		}
+
+		if message.Meta.CurrentPage >= message.Meta.LastPage {
+			return componentsID, nil
+		}
+	}
+	return componentsID, nil
+}
+
+func (c *CachetImpl) searchComponentV3(ctx context.Context, name string) (int, error) {
+	var message cachet3List
+	if err := c.do(ctx, CACHET_API_V3, http.MethodGet, "/api/components?filter[name]="+url.QueryEscape(name), nil, &message); err != nil {
+		return -1, err
+	}
+
+	if len(message.Data) == 1 {
+		return message.Data[0].Id.Int(), nil
+	}
+
+	return -1, fmt.Errorf("no component found")
+}
+
+func (c *CachetImpl) readIncidentV3(ctx context.Context, incidentId int) (*CachetIncident, error) {
+	var message cachet3Read
+	if err := c.do(ctx, CACHET_API_V3, http.MethodGet, fmt.Sprintf("/api/incidents/%d", incidentId), nil, &message); err != nil {
+		return nil, err
+	}
+	return message.Data.incident(), nil
+}
+
+func (c *CachetImpl) searchIncidentsV3(ctx context.Context, componentId int) ([]*CachetIncident, error) {
+	var message cachet3List
+	if err := c.do(ctx, CACHET_API_V3, http.MethodGet, fmt.Sprintf("/api/incidents?filter[component_id]=%d&sort=-id&per_page=100", componentId), nil, &message); err != nil {
+		return nil, err
+	}
+
+	incidents := make([]*CachetIncident, 0)
+	for i := range message.Data {
+		incidents = append(incidents, message.Data[i].incident())
+	}
+	return incidents, nil
+}
+
+// in Cachet 3.x, incidents no longer carry the component status: it must be updated on its own
+func (c *CachetImpl) updateComponentV3(ctx context.Context, componentID, componentStatus int) error {
+	component := &cachet3Component{
+		Status: cachet3ComponentStatus[componentStatus],
+	}
+	return c.do(ctx, CACHET_API_V3, http.MethodPut, fmt.Sprintf("/api/components/%d", componentID), component, nil)
+}
+
+func (c *CachetImpl) createIncidentV3(ctx context.Context, name, message string, incidentStatus, componentID, componentStatus int) error {
+	incident := &cachet3Incident{
+		Name:        name,
+		Message:     message,
+		Status:      cachet3IncidentStatus[incidentStatus],
+		Visible:     true,
+		ComponentID: componentID,
+	}
+	var created cachet3Read
+	if err := c.do(ctx, CACHET_API_V3, http.MethodPost, "/api/incidents", incident, informativeResult{&created}); err != nil {
+		return err
+	}
+	recordIncidentID(ctx, created.Data.Id.Int())
+	return c.updateComponentV3(ctx, componentID, componentStatus)
+}
+
+// in Cachet 3.x, an incident is not modified in place anymore, but receives an incident update
+func (c *CachetImpl) updateIncidentV3(ctx context.Context, incidentId int, message string, incidentStatus, componentID, componentStatus int) error {
+	update := &cachet3IncidentUpdate{
+		Message: message,
+		Status:  cachet3IncidentStatus[incidentStatus],
+	}
+	if err := c.do(ctx, CACHET_API_V3, http.MethodPost, fmt.Sprintf("/api/incidents/%d/updates", incidentId), update, nil); err != nil {
+		return err
+	}
+	return c.updateComponentV3(ctx, componentID, componentStatus)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the mock Cachet 3.x defines 1 component: "API" with one open incident
+func TestCachet3(t *testing.T) {
+	var created cachet3Incident
+	var update cachet3IncidentUpdate
+	var component cachet3Component
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.Path == "/api/v1/version" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		if r.Method == "GET" && r.URL.Path == "/api/version" {
+			io.WriteString(w, `{"data":{"version":"3.0.0"}}`)
+		} else if r.Method == "GET" && r.URL.Path == "/api/components" {
+			io.WriteString(w, `{"data":[{"id":"1","type":"components","attributes":{"name":"API","status":{"human":"Operational","value":1}}}],"meta":{"current_page":1,"last_page":1}}`)
+		} else if r.Method == "GET" && r.URL.Path == "/api/incidents" {
+			assert.Equal(t, "1", r.URL.Query().Get("filter[component_id]"))
+			io.WriteString(w, `{"data":[{"id":2,"type":"incidents","attributes":{"name":"API down","status":{"human":"Identified","value":2},"component_id":1,"created_at":{"string":"2019-11-15T10:00:00.000000Z"},"updated_at":"2019-11-15T10:30:00Z"}}]}`)
+		} else if r.Method == "GET" && r.URL.Path == "/api/incidents/2" {
+			io.WriteString(w, `{"data":{"id":2,"type":"incidents","attributes":{"name":"API up","status":"fixed","component_id":"1"}}}`)
+		} else if r.Method == "POST" && r.URL.Path == "/api/incidents" {
+			json.NewDecoder(r.Body).Decode(&created)
+			io.WriteString(w, `{"data":{"id":3}}`)
+		} else if r.Method == "POST" && r.URL.Path == "/api/incidents/2/updates" {
+			json.NewDecoder(r.Body).Decode(&update)
+			io.WriteString(w, `{"data":{"id":1}}`)
+		} else if r.Method == "PUT" && r.URL.Path == "/api/components/1" {
+			json.NewDecoder(r.Body).Decode(&component)
+			io.WriteString(w, `{"data":{"id":1}}`)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	cachet := NewCachetImpl(ts.URL, "secret", ts.Client())
+
+	version, err := cachet.APIVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, CACHET_API_V3, version)
+
+	components, err := cachet.ListComponents()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"API": 1}, components)
+
+	incidents, err := cachet.SearchIncidents(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(incidents))
+	assert.Equal(t, 2, incidents[0].Id)
+	assert.Equal(t, 2, incidents[0].Status)
+	assert.Equal(t, 1, incidents[0].ComponentId)
+	assert.Equal(t, "2019-11-15 10:00:00", incidents[0].CreatedAt)
+	assert.Equal(t, "2019-11-15 10:30:00", incidents[0].UpdatedAt)
+
+	incident, err := cachet.ReadIncident(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, incident.Status)
+	assert.Equal(t, 1, incident.ComponentId)
+
+	err = cachet.CreateIncident("API", 1, 4, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, "identified", created.Status)
+	assert.Equal(t, 1, created.ComponentID)
+	assert.Equal(t, "major_outage", component.Status)
+
+	err = cachet.UpdateIncident("API", 1, 2, 1, "back")
+	assert.Nil(t, err)
+	assert.Equal(t, "fixed", update.Status)
+	assert.Equal(t, "back", update.Message)
+	assert.Equal(t, "operational", component.Status)
+}
+
+func TestCachetAPIVersionDetection(t *testing.T) {
+	answer := `{"data":"2.3.15"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/version" {
+			assert.Equal(t, "secret", r.Header.Get("X-Cachet-Token"))
+			io.WriteString(w, answer)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	version, err := NewCachetImpl(ts.URL, "secret", ts.Client()).APIVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, CACHET_API_V2, version)
+
+	answer = `{"data":"3.0.1"}`
+	version, err = NewCachetImpl(ts.URL, "secret", ts.Client()).APIVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, CACHET_API_V3, version)
+
+	// forced by configuration: no detection
+	cachet := NewCachetImpl(ts.URL, "secret", ts.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+	version, err = cachet.APIVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, CACHET_API_V2, version)
+
+	_, err = ParseCachetAPIVersion("4")
+	assert.NotNil(t, err)
+}
+
+// non 2xx answers are reported as errors
+func TestCachetAPIError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"errors":[{"status":401,"title":"Unauthorized"}]}`)
+	}))
+	defer ts.Close()
+
+	cachet := NewCachetImpl(ts.URL, "wrong", ts.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+
+	err := cachet.CreateIncident("API", 1, 4, 4)
+	assert.NotNil(t, err)
+	apiErr, ok := err.(*CachetAPIError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+}
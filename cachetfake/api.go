@@ -0,0 +1,541 @@
+package cachetfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// errorMessage is the CachetHQ error answer
+//
+//	{"errors":[{"id":"...","status":400,"title":"Bad Request","detail":"The request cannot be fulfilled due to bad syntax."}]}
+type errorMessage struct {
+	Errors []errorDetail `json:"errors"`
+}
+
+type errorDetail struct {
+	Status int    `json:"status"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+type pagination struct {
+	Total       int `json:"total"`
+	Count       int `json:"count"`
+	PerPage     int `json:"per_page"`
+	CurrentPage int `json:"current_page"`
+	TotalPages  int `json:"total_pages"`
+	Links       struct {
+		NextPage     *string `json:"next_page"`
+		PreviousPage *string `json:"previous_page"`
+	} `json:"links"`
+}
+
+type listMessage struct {
+	Meta struct {
+		Pagination pagination `json:"pagination"`
+	} `json:"meta"`
+	Data interface{} `json:"data"`
+}
+
+type dataMessage struct {
+	Data interface{} `json:"data"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, message interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(message)
+}
+
+func writeError(w http.ResponseWriter, status int, title, detail string) {
+	writeJSON(w, status, &errorMessage{Errors: []errorDetail{{Status: status, Title: title, Detail: detail}}})
+}
+
+// writePage answers the requested page (page and per_page query parameters) of a list
+func writePage(w http.ResponseWriter, r *http.Request, total int, slice func(from, to int) interface{}) {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.FormValue("per_page"))
+	if perPage < 1 {
+		perPage = DEFAULT_PER_PAGE
+	}
+
+	from := (page - 1) * perPage
+	if from > total {
+		from = total
+	}
+	to := from + perPage
+	if to > total {
+		to = total
+	}
+
+	var message listMessage
+	p := &message.Meta.Pagination
+	p.Total = total
+	p.Count = to - from
+	p.PerPage = perPage
+	p.CurrentPage = page
+	p.TotalPages = (total + perPage - 1) / perPage
+	if p.TotalPages == 0 {
+		p.TotalPages = 1
+	}
+	link := func(page int) *string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		url := "http://" + r.Host + r.URL.Path + "?" + query.Encode()
+		return &url
+	}
+	if page < p.TotalPages {
+		p.Links.NextPage = link(page + 1)
+	}
+	if page > 1 {
+		p.Links.PreviousPage = link(page - 1)
+	}
+	message.Data = slice(from, to)
+	writeJSON(w, http.StatusOK, &message)
+}
+
+// authorize checks the X-Cachet-Token of the protected requests, and answers the error if refused
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, write bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.writeTokens) == 0 && len(s.readTokens) == 0 {
+		return true
+	}
+	token := r.Header.Get("X-Cachet-Token")
+	if s.writeTokens[token] {
+		return true
+	}
+	if s.readTokens[token] {
+		if !write {
+			return true
+		}
+		writeError(w, http.StatusForbidden, "Forbidden", "The token is not allowed to change the status page.")
+		return false
+	}
+	writeError(w, http.StatusUnauthorized, "Unauthorized", "You are not authorized to view this content.")
+	return false
+}
+
+// route dispatches a request on the /api/v1 endpoints, given the path elements after /api/v1
+func (s *Server) route(w http.ResponseWriter, r *http.Request, path []string) {
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+
+	switch {
+	case len(path) == 1 && path[0] == "ping" && !write:
+		writeJSON(w, http.StatusOK, &dataMessage{Data: "Pong!"})
+		return
+	case len(path) == 1 && path[0] == "version" && !write:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"meta": map[string]bool{"on_latest": true}, "data": s.Version})
+		return
+	case len(path) == 1 && path[0] == "subscribers" && !write:
+		if s.authorize(w, r, false) {
+			writePage(w, r, 0, func(from, to int) interface{} { return []struct{}{} })
+		}
+		return
+	}
+
+	if write && !s.authorize(w, r, true) {
+		return
+	}
+
+	switch {
+	case path[0] == "components" && len(path) >= 2 && path[1] == "groups":
+		s.routeGroups(w, r, path[2:])
+	case path[0] == "components":
+		s.routeComponents(w, r, path[1:])
+	case path[0] == "incidents" && len(path) >= 3 && path[2] == "updates":
+		s.routeIncidentUpdates(w, r, path[1], path[3:])
+	case path[0] == "incidents":
+		s.routeIncidents(w, r, path[1:])
+	default:
+		writeError(w, http.StatusNotFound, "Not Found", "unknown endpoint "+r.URL.Path)
+	}
+}
+
+// decode reads the JSON payload of a request, answering 400 if invalid
+func decode(w http.ResponseWriter, r *http.Request, payload interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request", "invalid JSON payload: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func invalid(w http.ResponseWriter, detail string) {
+	writeError(w, http.StatusBadRequest, "Bad Request", detail)
+}
+
+func notFound(w http.ResponseWriter, kind, id string) {
+	writeError(w, http.StatusNotFound, "Not Found", fmt.Sprintf("%s %s not found", kind, id))
+}
+
+// filterInt returns true if the query parameter is absent, or equal to value
+func filterInt(r *http.Request, name string, value int) bool {
+	filter := r.FormValue(name)
+	return filter == "" || filter == strconv.Itoa(value)
+}
+
+type groupPayload struct {
+	Name      *string `json:"name"`
+	Order     *int    `json:"order"`
+	Collapsed *int    `json:"collapsed"`
+}
+
+func (s *Server) routeGroups(w http.ResponseWriter, r *http.Request, path []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		groups := make([]ComponentGroup, 0, len(s.groups))
+		for _, group := range s.groups {
+			if r.FormValue("name") == "" || r.FormValue("name") == group.Name {
+				groups = append(groups, *group)
+			}
+		}
+		writePage(w, r, len(groups), func(from, to int) interface{} { return groups[from:to] })
+	case len(path) == 0 && r.Method == http.MethodPost:
+		var payload groupPayload
+		if !decode(w, r, &payload) {
+			return
+		}
+		if payload.Name == nil || *payload.Name == "" {
+			invalid(w, "The name field is required.")
+			return
+		}
+		now := s.now()
+		group := &ComponentGroup{ID: s.id("group"), Name: *payload.Name, Order: len(s.groups), CreatedAt: now, UpdatedAt: now}
+		if payload.Order != nil {
+			group.Order = *payload.Order
+		}
+		if payload.Collapsed != nil {
+			group.Collapsed = *payload.Collapsed
+		}
+		s.groups = append(s.groups, group)
+		writeJSON(w, http.StatusOK, &dataMessage{Data: group})
+	case len(path) == 1 && r.Method == http.MethodGet:
+		for _, group := range s.groups {
+			if strconv.Itoa(group.ID) == path[0] {
+				writeJSON(w, http.StatusOK, &dataMessage{Data: group})
+				return
+			}
+		}
+		notFound(w, "component group", path[0])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed", r.Method+" "+r.URL.Path)
+	}
+}
+
+type componentPayload struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Link        *string `json:"link"`
+	Status      *int    `json:"status"`
+	Order       *int    `json:"order"`
+	GroupID     *int    `json:"group_id"`
+	Enabled     *bool   `json:"enabled"`
+}
+
+// apply sets the fields given in the payload
+func (p *componentPayload) apply(component *Component) {
+	if p.Name != nil {
+		component.Name = *p.Name
+	}
+	if p.Description != nil {
+		component.Description = *p.Description
+	}
+	if p.Link != nil {
+		component.Link = *p.Link
+	}
+	if p.Status != nil {
+		component.Status = *p.Status
+		component.StatusName = componentStatusNames[*p.Status]
+	}
+	if p.Order != nil {
+		component.Order = *p.Order
+	}
+	if p.GroupID != nil {
+		component.GroupID = *p.GroupID
+	}
+	if p.Enabled != nil {
+		component.Enabled = *p.Enabled
+	}
+}
+
+func validComponentStatus(status *int) bool {
+	return status == nil || componentStatusNames[*status] != ""
+}
+
+func (s *Server) routeComponents(w http.ResponseWriter, r *http.Request, path []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		components := make([]Component, 0, len(s.components))
+		for _, component := range s.components {
+			if (r.FormValue("name") == "" || r.FormValue("name") == component.Name) &&
+				filterInt(r, "status", component.Status) && filterInt(r, "group_id", component.GroupID) {
+				components = append(components, *component)
+			}
+		}
+		writePage(w, r, len(components), func(from, to int) interface{} { return components[from:to] })
+	case len(path) == 0 && r.Method == http.MethodPost:
+		var payload componentPayload
+		if !decode(w, r, &payload) {
+			return
+		}
+		if payload.Name == nil || *payload.Name == "" || payload.Status == nil {
+			invalid(w, "The name and status fields are required.")
+			return
+		}
+		if !validComponentStatus(payload.Status) {
+			invalid(w, "The status must be between 1 and 4.")
+			return
+		}
+		component := &Component{Enabled: true}
+		payload.apply(component)
+		order := component.Order
+		s.addComponent(component)
+		if payload.Order != nil {
+			component.Order = order
+		}
+		writeJSON(w, http.StatusOK, &dataMessage{Data: component})
+	case len(path) == 1:
+		var component *Component
+		index := -1
+		for i, c := range s.components {
+			if strconv.Itoa(c.ID) == path[0] {
+				component, index = c, i
+			}
+		}
+		if component == nil {
+			notFound(w, "component", path[0])
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, &dataMessage{Data: component})
+		case http.MethodPut:
+			var payload componentPayload
+			if !decode(w, r, &payload) {
+				return
+			}
+			if !validComponentStatus(payload.Status) {
+				invalid(w, "The status must be between 1 and 4.")
+				return
+			}
+			payload.apply(component)
+			component.UpdatedAt = s.now()
+			writeJSON(w, http.StatusOK, &dataMessage{Data: component})
+		case http.MethodDelete:
+			s.components = append(s.components[:index], s.components[index+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed", r.Method+" "+r.URL.Path)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed", r.Method+" "+r.URL.Path)
+	}
+}
+
+type incidentPayload struct {
+	Name            *string `json:"name"`
+	Message         *string `json:"message"`
+	Status          *int    `json:"status"`
+	Visible         *int    `json:"visible"`
+	ComponentID     *int    `json:"component_id"`
+	ComponentStatus *int    `json:"component_status"`
+}
+
+// apply sets the fields given in the payload, and the status of the incident component
+func (p *incidentPayload) apply(s *Server, incident *Incident) {
+	if p.Name != nil {
+		incident.Name = *p.Name
+	}
+	if p.Message != nil {
+		incident.Message = *p.Message
+	}
+	if p.Status != nil {
+		incident.Status = *p.Status
+		incident.HumanStatus = incidentStatusNames[*p.Status]
+	}
+	if p.Visible != nil {
+		incident.Visible = *p.Visible
+	}
+	if p.ComponentID != nil {
+		incident.ComponentID = *p.ComponentID
+	}
+	if p.ComponentStatus != nil {
+		s.setComponentStatus(incident.ComponentID, *p.ComponentStatus)
+	}
+}
+
+// validate checks the statuses and the component of the payload, and answers 400 if invalid
+func (p *incidentPayload) validate(s *Server, w http.ResponseWriter) bool {
+	if p.Status != nil && incidentStatusNames[*p.Status] == "" {
+		invalid(w, "The status must be between 0 and 4.")
+		return false
+	}
+	if !validComponentStatus(p.ComponentStatus) {
+		invalid(w, "The component status must be between 1 and 4.")
+		return false
+	}
+	if p.ComponentID != nil && *p.ComponentID != 0 && s.component(*p.ComponentID) == nil {
+		invalid(w, fmt.Sprintf("The component %d does not exist.", *p.ComponentID))
+		return false
+	}
+	return true
+}
+
+func (s *Server) routeIncidents(w http.ResponseWriter, r *http.Request, path []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		incidents := make([]Incident, 0, len(s.incidents))
+		for _, incident := range s.incidents {
+			if filterInt(r, "component_id", incident.ComponentID) && filterInt(r, "status", incident.Status) &&
+				filterInt(r, "visible", incident.Visible) {
+				incidents = append(incidents, *incident)
+			}
+		}
+		// sorted by id, or by creation (which follows the ids)
+		if r.FormValue("order") == "desc" {
+			sort.Slice(incidents, func(i, j int) bool { return incidents[i].ID > incidents[j].ID })
+		}
+		writePage(w, r, len(incidents), func(from, to int) interface{} { return incidents[from:to] })
+	case len(path) == 0 && r.Method == http.MethodPost:
+		var payload incidentPayload
+		if !decode(w, r, &payload) {
+			return
+		}
+		if payload.Name == nil || *payload.Name == "" || payload.Message == nil || *payload.Message == "" || payload.Status == nil {
+			invalid(w, "The name, message and status fields are required.")
+			return
+		}
+		if !payload.validate(s, w) {
+			return
+		}
+		incident := &Incident{Visible: 1}
+		payload.apply(s, incident)
+		s.addIncident(incident)
+		writeJSON(w, http.StatusOK, &dataMessage{Data: incident})
+	case len(path) == 1:
+		incident := s.incidentByPath(path[0])
+		if incident == nil {
+			notFound(w, "incident", path[0])
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, &dataMessage{Data: incident})
+		case http.MethodPut:
+			var payload incidentPayload
+			if !decode(w, r, &payload) || !payload.validate(s, w) {
+				return
+			}
+			payload.apply(s, incident)
+			incident.UpdatedAt = s.now()
+			writeJSON(w, http.StatusOK, &dataMessage{Data: incident})
+		case http.MethodDelete:
+			for i, other := range s.incidents {
+				if other == incident {
+					s.incidents = append(s.incidents[:i], s.incidents[i+1:]...)
+					break
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed", r.Method+" "+r.URL.Path)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed", r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) incidentByPath(id string) *Incident {
+	for _, incident := range s.incidents {
+		if strconv.Itoa(incident.ID) == id {
+			return incident
+		}
+	}
+	return nil
+}
+
+type incidentUpdatePayload struct {
+	Status          *int    `json:"status"`
+	Message         *string `json:"message"`
+	ComponentStatus *int    `json:"component_status"`
+}
+
+func (s *Server) routeIncidentUpdates(w http.ResponseWriter, r *http.Request, incidentID string, path []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	incident := s.incidentByPath(incidentID)
+	if incident == nil {
+		notFound(w, "incident", incidentID)
+		return
+	}
+
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		updates := make([]IncidentUpdate, 0)
+		for _, update := range s.updates {
+			if update.IncidentID == incident.ID {
+				updates = append(updates, *update)
+			}
+		}
+		writePage(w, r, len(updates), func(from, to int) interface{} { return updates[from:to] })
+	case len(path) == 0 && r.Method == http.MethodPost:
+		var payload incidentUpdatePayload
+		if !decode(w, r, &payload) {
+			return
+		}
+		if payload.Status == nil || payload.Message == nil || *payload.Message == "" {
+			invalid(w, "The status and message fields are required.")
+			return
+		}
+		if incidentStatusNames[*payload.Status] == "" || !validComponentStatus(payload.ComponentStatus) {
+			invalid(w, "The status must be between 0 and 4.")
+			return
+		}
+		now := s.now()
+		update := &IncidentUpdate{
+			ID:          s.id("update"),
+			IncidentID:  incident.ID,
+			Status:      *payload.Status,
+			HumanStatus: incidentStatusNames[*payload.Status],
+			Message:     *payload.Message,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		s.updates = append(s.updates, update)
+		incident.Status = update.Status
+		incident.HumanStatus = update.HumanStatus
+		incident.UpdatedAt = now
+		if payload.ComponentStatus != nil {
+			s.setComponentStatus(incident.ComponentID, *payload.ComponentStatus)
+		}
+		writeJSON(w, http.StatusOK, &dataMessage{Data: update})
+	case len(path) == 1 && r.Method == http.MethodGet:
+		for _, update := range s.updates {
+			if update.IncidentID == incident.ID && strconv.Itoa(update.ID) == path[0] {
+				writeJSON(w, http.StatusOK, &dataMessage{Data: update})
+				return
+			}
+		}
+		notFound(w, "incident update", path[0])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed", r.Method+" "+r.URL.Path)
+	}
+}
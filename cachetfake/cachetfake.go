@@ -0,0 +1,432 @@
+// Package cachetfake is an in-process fake of the CachetHQ 2.x API (/api/v1). It keeps
+// its components, groups, incidents and incident updates in memory, and can inject
+// faults and latency. It is used by the tests and by the replay tooling.
+//
+//	fake := cachetfake.NewServer()
+//	defer fake.Close()
+//	fake.SetToken("secret")
+//	componentID := fake.AddComponent("API", 0)
+//	cachet := NewCachetImpl(fake.URL, "secret", fake.Client())
+package cachetfake
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_VERSION is the CachetHQ version answered on /api/v1/version
+	DEFAULT_VERSION = "2.3.15"
+	// DEFAULT_PER_PAGE is the page size of the lists, if not requested
+	DEFAULT_PER_PAGE = 20
+	// TIME_LAYOUT is the layout of the CachetHQ dates
+	TIME_LAYOUT = "2006-01-02 15:04:05"
+)
+
+// CachetHQ component statuses
+const (
+	COMPONENT_OPERATIONAL       = 1
+	COMPONENT_PERFORMANCE_ISSUE = 2
+	COMPONENT_PARTIAL_OUTAGE    = 3
+	COMPONENT_MAJOR_OUTAGE      = 4
+)
+
+// CachetHQ incident statuses
+const (
+	INCIDENT_SCHEDULED     = 0
+	INCIDENT_INVESTIGATING = 1
+	INCIDENT_IDENTIFIED    = 2
+	INCIDENT_WATCHING      = 3
+	INCIDENT_FIXED         = 4
+)
+
+var componentStatusNames = map[int]string{
+	COMPONENT_OPERATIONAL:       "Operational",
+	COMPONENT_PERFORMANCE_ISSUE: "Performance Issues",
+	COMPONENT_PARTIAL_OUTAGE:    "Partial Outage",
+	COMPONENT_MAJOR_OUTAGE:      "Major Outage",
+}
+
+var incidentStatusNames = map[int]string{
+	INCIDENT_SCHEDULED:     "Scheduled",
+	INCIDENT_INVESTIGATING: "Investigating",
+	INCIDENT_IDENTIFIED:    "Identified",
+	INCIDENT_WATCHING:      "Watching",
+	INCIDENT_FIXED:         "Fixed",
+}
+
+// Component is a CachetHQ component
+type Component struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Link        string `json:"link"`
+	Status      int    `json:"status"`
+	StatusName  string `json:"status_name"`
+	Order       int    `json:"order"`
+	GroupID     int    `json:"group_id"`
+	Enabled     bool   `json:"enabled"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// ComponentGroup is a CachetHQ component group
+type ComponentGroup struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Order     int    `json:"order"`
+	Collapsed int    `json:"collapsed"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Incident is a CachetHQ incident
+type Incident struct {
+	ID          int    `json:"id"`
+	ComponentID int    `json:"component_id"`
+	Name        string `json:"name"`
+	Message     string `json:"message"`
+	Status      int    `json:"status"`
+	HumanStatus string `json:"human_status"`
+	Visible     int    `json:"visible"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// IncidentUpdate is an update posted on a CachetHQ incident
+type IncidentUpdate struct {
+	ID          int    `json:"id"`
+	IncidentID  int    `json:"incident_id"`
+	Status      int    `json:"status"`
+	HumanStatus string `json:"human_status"`
+	Message     string `json:"message"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// Fault makes the matching requests fail (Status) or slow (Delay)
+type Fault struct {
+	// Method and Path select the requests (i.e. "POST" and "/api/v1/incidents"), empty matching all
+	Method string
+	Path   string
+	// Status is the HTTP status answered (0: the request is processed after Delay)
+	Status int
+	Body   string
+	Delay  time.Duration
+	// Count is the number of requests affected (0: all of them)
+	Count int
+}
+
+func (f *Fault) matches(r *http.Request) bool {
+	return (f.Method == "" || f.Method == r.Method) && (f.Path == "" || f.Path == r.URL.Path)
+}
+
+// Server is a fake CachetHQ server
+type Server struct {
+	// URL is the base URL of the server (i.e. http://127.0.0.1:34567)
+	URL string
+	// Version is answered on /api/v1/version
+	Version string
+	// Now gives the time of the changes (time.Now by default)
+	Now func() time.Time
+
+	server *httptest.Server
+
+	lock sync.Mutex
+	// writeTokens may change the status page, readTokens only read the protected endpoints.
+	// Without any token, every request is allowed
+	writeTokens map[string]bool
+	readTokens  map[string]bool
+	latency     time.Duration
+	faults      []*Fault
+	requests    []string
+
+	// ids are the last identifiers given, by kind of object
+	ids        map[string]int
+	groups     []*ComponentGroup
+	components []*Component
+	incidents  []*Incident
+	updates    []*IncidentUpdate
+}
+
+// NewServer starts a fake CachetHQ server, to be closed after use
+func NewServer() *Server {
+	s := NewHandler()
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+// NewHandler creates a fake CachetHQ not listening: it is served in process by its Client,
+// or by another server
+func NewHandler() *Server {
+	return &Server{
+		URL:         "http://cachetfake",
+		Version:     DEFAULT_VERSION,
+		Now:         time.Now,
+		writeTokens: make(map[string]bool),
+		readTokens:  make(map[string]bool),
+		ids:         make(map[string]int),
+	}
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// Client returns an HTTP client for the server, calling it in process if not listening
+func (s *Server) Client() *http.Client {
+	if s.server != nil {
+		return s.server.Client()
+	}
+	return &http.Client{Transport: handlerTransport{s}}
+}
+
+// handlerTransport serves the requests with a handler, without network
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// SetToken adds a token allowed to change the status page
+func (s *Server) SetToken(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writeTokens[token] = true
+}
+
+// SetReadOnlyToken adds a token allowed to read, but answered 403 on changes
+func (s *Server) SetReadOnlyToken(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readTokens[token] = true
+}
+
+// SetLatency delays every answer
+func (s *Server) SetLatency(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latency = latency
+}
+
+// InjectFault adds a fault, the first matching one applying
+func (s *Server) InjectFault(fault Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// ClearFaults removes the faults and the latency
+func (s *Server) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = nil
+	s.latency = 0
+}
+
+// Requests returns the requests received, as "METHOD /path?query"
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// now returns the current time as formatted by CachetHQ (s.lock must be held)
+func (s *Server) now() string {
+	return s.Now().UTC().Format(TIME_LAYOUT)
+}
+
+// id returns a new identifier for a kind of object (s.lock must be held)
+func (s *Server) id(kind string) int {
+	s.ids[kind]++
+	return s.ids[kind]
+}
+
+// AddGroup creates a component group, and returns its id
+func (s *Server) AddGroup(name string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.now()
+	group := &ComponentGroup{ID: s.id("group"), Name: name, Order: len(s.groups), CreatedAt: now, UpdatedAt: now}
+	s.groups = append(s.groups, group)
+	return group.ID
+}
+
+// AddComponent creates an operational component in a group (0: none), and returns its id
+func (s *Server) AddComponent(name string, groupID int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.addComponent(&Component{Name: name, GroupID: groupID, Status: COMPONENT_OPERATIONAL, Enabled: true}).ID
+}
+
+func (s *Server) addComponent(component *Component) *Component {
+	now := s.now()
+	component.ID = s.id("component")
+	component.StatusName = componentStatusNames[component.Status]
+	component.Order = len(s.components)
+	component.CreatedAt = now
+	component.UpdatedAt = now
+	s.components = append(s.components, component)
+	return component
+}
+
+// AddIncident creates an incident on a component, and returns its id
+func (s *Server) AddIncident(componentID int, name string, status int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.addIncident(&Incident{ComponentID: componentID, Name: name, Message: name, Status: status, Visible: 1}).ID
+}
+
+func (s *Server) addIncident(incident *Incident) *Incident {
+	now := s.now()
+	incident.ID = s.id("incident")
+	incident.HumanStatus = incidentStatusNames[incident.Status]
+	incident.CreatedAt = now
+	incident.UpdatedAt = now
+	s.incidents = append(s.incidents, incident)
+	return incident
+}
+
+// Component returns a component by its id
+func (s *Server) Component(id int) (Component, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if component := s.component(id); component != nil {
+		return *component, true
+	}
+	return Component{}, false
+}
+
+func (s *Server) component(id int) *Component {
+	for _, component := range s.components {
+		if component.ID == id {
+			return component
+		}
+	}
+	return nil
+}
+
+// ComponentByName returns a component by its name
+func (s *Server) ComponentByName(name string) (Component, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, component := range s.components {
+		if component.Name == name {
+			return *component, true
+		}
+	}
+	return Component{}, false
+}
+
+// Incident returns an incident by its id
+func (s *Server) Incident(id int) (Incident, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if incident := s.incident(id); incident != nil {
+		return *incident, true
+	}
+	return Incident{}, false
+}
+
+func (s *Server) incident(id int) *Incident {
+	for _, incident := range s.incidents {
+		if incident.ID == id {
+			return incident
+		}
+	}
+	return nil
+}
+
+// Incidents returns the incidents of a component (0: all of them), the most recent first
+func (s *Server) Incidents(componentID int) []Incident {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	incidents := make([]Incident, 0)
+	for _, incident := range s.incidents {
+		if componentID == 0 || incident.ComponentID == componentID {
+			incidents = append(incidents, *incident)
+		}
+	}
+	sort.Slice(incidents, func(i, j int) bool { return incidents[i].ID > incidents[j].ID })
+	return incidents
+}
+
+// IncidentUpdates returns the updates posted on an incident, the oldest first
+func (s *Server) IncidentUpdates(incidentID int) []IncidentUpdate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	updates := make([]IncidentUpdate, 0)
+	for _, update := range s.updates {
+		if update.IncidentID == incidentID {
+			updates = append(updates, *update)
+		}
+	}
+	return updates
+}
+
+// setComponentStatus changes the status of a component, if any (s.lock must be held)
+func (s *Server) setComponentStatus(componentID, status int) {
+	if component := s.component(componentID); component != nil && status > 0 {
+		component.Status = status
+		component.StatusName = componentStatusNames[status]
+		component.UpdatedAt = s.now()
+	}
+}
+
+// ServeHTTP serves the /api/v1 endpoints
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	latency := s.latency
+	var fault *Fault
+	for i, f := range s.faults {
+		if f.matches(r) {
+			fault = f
+			if f.Count > 0 {
+				if f.Count--; f.Count == 0 {
+					s.faults = append(s.faults[:i], s.faults[i+1:]...)
+				}
+			}
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	if fault != nil {
+		latency += fault.Delay
+	}
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault != nil && fault.Status != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(fault.Status)
+		w.Write([]byte(fault.Body))
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if !strings.HasPrefix(path, "/api/v1/") {
+		writeError(w, http.StatusNotFound, "Not Found", "unknown endpoint "+r.URL.Path)
+		return
+	}
+	s.route(w, r, strings.Split(strings.TrimPrefix(path, "/api/v1/"), "/"))
+}
@@ -0,0 +1,143 @@
+package cachetfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func request(t *testing.T, s *Server, method, path, token, body string, result interface{}) int {
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewBufferString(body))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Cachet-Token", token)
+	}
+	resp, err := s.Client().Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	if result != nil {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(result))
+	}
+	return resp.StatusCode
+}
+
+type componentList struct {
+	Meta struct {
+		Pagination pagination `json:"pagination"`
+	} `json:"meta"`
+	Data []Component `json:"data"`
+}
+
+func TestComponentsPagination(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	group := s.AddGroup("Websites")
+	for i := 1; i <= 25; i++ {
+		s.AddComponent(fmt.Sprintf("component%d", i), group)
+	}
+
+	var list componentList
+	assert.Equal(t, http.StatusOK, request(t, s, "GET", "/api/v1/components?page=2", "", "", &list))
+	assert.Equal(t, 5, len(list.Data))
+	assert.Equal(t, 21, list.Data[0].ID)
+	assert.Equal(t, 2, list.Meta.Pagination.CurrentPage)
+	assert.Equal(t, 2, list.Meta.Pagination.TotalPages)
+	assert.Equal(t, 25, list.Meta.Pagination.Total)
+	assert.Nil(t, list.Meta.Pagination.Links.NextPage)
+	assert.NotNil(t, list.Meta.Pagination.Links.PreviousPage)
+
+	assert.Equal(t, http.StatusOK, request(t, s, "GET", "/api/v1/components?name=component7", "", "", &list))
+	assert.Equal(t, 1, len(list.Data))
+	assert.Equal(t, 7, list.Data[0].ID)
+	assert.Equal(t, group, list.Data[0].GroupID)
+	assert.Equal(t, "Operational", list.Data[0].StatusName)
+
+	assert.Equal(t, http.StatusNotFound, request(t, s, "GET", "/api/v1/components/99", "", "", nil))
+}
+
+func TestIncidents(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetToken("writer")
+	s.SetReadOnlyToken("reader")
+	s.Now = func() time.Time { return time.Date(2026, 10, 18, 20, 0, 0, 0, time.UTC) }
+	api := s.AddComponent("API", 0)
+
+	incident := `{"name":"API down","message":"API is down","status":2,"component_id":1,"component_status":4,"visible":1}`
+	assert.Equal(t, http.StatusUnauthorized, request(t, s, "POST", "/api/v1/incidents", "", incident, nil))
+	assert.Equal(t, http.StatusForbidden, request(t, s, "POST", "/api/v1/incidents", "reader", incident, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, s, "POST", "/api/v1/incidents", "writer", `{}`, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, s, "POST", "/api/v1/incidents", "writer", `{"name":"x","message":"x","status":2,"component_id":7}`, nil))
+	assert.Equal(t, http.StatusOK, request(t, s, "POST", "/api/v1/incidents", "writer", incident, nil))
+
+	component, _ := s.Component(api)
+	assert.Equal(t, COMPONENT_MAJOR_OUTAGE, component.Status)
+	incidents := s.Incidents(api)
+	assert.Equal(t, 1, len(incidents))
+	assert.Equal(t, INCIDENT_IDENTIFIED, incidents[0].Status)
+	assert.Equal(t, "2026-10-18 20:00:00", incidents[0].CreatedAt)
+
+	// the reads are public
+	var read struct {
+		Data Incident `json:"data"`
+	}
+	assert.Equal(t, http.StatusOK, request(t, s, "GET", "/api/v1/incidents/1", "", "", &read))
+	assert.Equal(t, "API down", read.Data.Name)
+
+	s.Now = func() time.Time { return time.Date(2026, 10, 18, 20, 30, 0, 0, time.UTC) }
+	assert.Equal(t, http.StatusOK, request(t, s, "POST", "/api/v1/incidents/1/updates", "writer", `{"status":3,"message":"fix deployed"}`, nil))
+	assert.Equal(t, http.StatusOK, request(t, s, "PUT", "/api/v1/incidents/1", "writer", `{"status":4,"component_status":1}`, nil))
+	incident1, _ := s.Incident(1)
+	assert.Equal(t, INCIDENT_FIXED, incident1.Status)
+	assert.Equal(t, "2026-10-18 20:30:00", incident1.UpdatedAt)
+	component, _ = s.Component(api)
+	assert.Equal(t, COMPONENT_OPERATIONAL, component.Status)
+	updates := s.IncidentUpdates(1)
+	assert.Equal(t, 1, len(updates))
+	assert.Equal(t, "fix deployed", updates[0].Message)
+
+	s.AddIncident(api, "API slow", INCIDENT_INVESTIGATING)
+	var list struct {
+		Data []Incident `json:"data"`
+	}
+	assert.Equal(t, http.StatusOK, request(t, s, "GET", "/api/v1/incidents?component_id=1&sort=id&order=desc", "", "", &list))
+	assert.Equal(t, 2, len(list.Data))
+	assert.Equal(t, 2, list.Data[0].ID)
+
+	// only authenticated users list the subscribers
+	assert.Equal(t, http.StatusUnauthorized, request(t, s, "GET", "/api/v1/subscribers", "", "", nil))
+	assert.Equal(t, http.StatusOK, request(t, s, "GET", "/api/v1/subscribers", "reader", "", nil))
+}
+
+func TestFaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddComponent("API", 0)
+
+	s.InjectFault(Fault{Method: "GET", Path: "/api/v1/components", Status: http.StatusServiceUnavailable, Count: 2})
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, s, "GET", "/api/v1/components", "", "", nil))
+	assert.Equal(t, http.StatusOK, request(t, s, "GET", "/api/v1/ping", "", "", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, s, "GET", "/api/v1/components", "", "", nil))
+	assert.Equal(t, http.StatusOK, request(t, s, "GET", "/api/v1/components", "", "", nil))
+
+	s.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	assert.Equal(t, http.StatusOK, request(t, s, "GET", "/api/v1/ping", "", "", nil))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	s.ClearFaults()
+	assert.Equal(t, []string{
+		"GET /api/v1/components",
+		"GET /api/v1/ping",
+		"GET /api/v1/components",
+		"GET /api/v1/components",
+		"GET /api/v1/ping",
+	}, s.Requests())
+}
@@ -4,105 +4,57 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/nzin/prometheus_cachethq/cachetfake"
 	"github.com/stretchr/testify/assert"
 )
 
-var (
-	// mux is the HTTP request multiplexer used with the test server.
-	mux *http.ServeMux
-
-	// server is a test HTTP server used to provide mock API responses.
-	mockServer *httptest.Server
-
-	// status updated by cachetHQ bridge
-	finalStatus int
-)
+// setupFakeCachetHQ starts a fake CachetHQ defining 1 component: "component21"
+func setupFakeCachetHQ() *cachetfake.Server {
+	fake := cachetfake.NewServer()
+	fake.SetToken("1234567890abcdef")
+	fake.AddComponent("component21", 0)
+	return fake
+}
 
-// setup sets up a test HTTP server. Tests should register handlers on
-// mux which provide mock responses for the API method being tested.
-func setupMockCachetHQ(t *testing.T) {
-	// fake CachetHQ server
-	mux = http.NewServeMux()
-	mockServer = httptest.NewServer(mux)
-
-	finalStatus = 0
-
-	mux.HandleFunc("/api/v1/components",
-		func(w http.ResponseWriter, r *http.Request) {
-			fmt.Println("mock GET /api/v1/components")
-			assert.Equal(t, "1", r.FormValue("page"))
-			assert.Equal(t, "GET", r.Method)
-			fmt.Fprint(w, `
-					{"meta": {
-				        "pagination": {
-				            "total": 1,
-				            "count": 1,
-				            "per_page": 20,
-				            "current_page": 1,
-				            "total_pages": 1,
-				            "links": {
-				                "next_page": null,
-				                "previous_page": null
-				            }
-				        }
-				    },
-				    "data": [
-				        {
-				            "id": 1,
-				            "name": "component21",
-				            "description": "This is a component",
-				            "link": "",
-				            "status": 1,
-				            "order": 0,
-				            "group_id": 0,
-				            "created_at": "2015-07-24 14:42:10",
-				            "updated_at": "2015-07-24 14:42:10",
-				            "deleted_at": null,
-				            "status_name": "Operational"
-				        }
-				    ]}`)
-		})
-
-	mux.HandleFunc("/api/v1/incidents",
-		func(w http.ResponseWriter, r *http.Request) {
-			fmt.Println("mock POST /api/v1/incidents")
-			assert.Equal(t, "POST", r.Method)
-			type incidentStruct struct {
-				Name            string `json:"name"`
-				Message         string `json:"message"`
-				Status          int    `json:"status"`
-				ComponentID     int    `json:"component_id"`
-				ComponentStatus int    `json:"component_status"`
-			}
-			decoder := json.NewDecoder(r.Body)
-			var incident incidentStruct
-			err := decoder.Decode(&incident)
-			if err == nil {
-				finalStatus = incident.Status
-			}
-		})
+// lastIncidentStatus returns the status of the last incident created by the bridge (0 if none)
+func lastIncidentStatus(fake *cachetfake.Server) int {
+	incidents := fake.Incidents(0)
+	if len(incidents) == 0 {
+		return 0
+	}
+	return incidents[0].Status
 }
 
-// teardown closes the test HTTP server.
-func teardown() {
-	mockServer.Close()
+// sendTestAlert posts the status of the alert f1a2 of component, with the token (if any), and
+// checks the webhook is accepted
+func sendTestAlert(t *testing.T, router http.Handler, token, status, component string) {
+	jsonStr := []byte(`{"receiver":"cachethq-receiver","groupKey":"{}:{alertname=\"` + component + `\"}","status":"` + status + `","alerts":[{"status":"` + status + `","fingerprint":"f1a2","labels":{"alertname":"` + component + `"}}],"version":"4"}`)
+	req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
 }
 
-// the mock cachetHQ defines 1 component: "Component21"
+// the fake cachetHQ defines 1 component: "Component21"
 func TestCachetHqComponent21(t *testing.T) {
-	setupMockCachetHQ(t)
-	defer teardown()
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
 
 	config := PrometheusCachetConfig{
 		LabelName:       "alertname",
 		PrometheusToken: "promToken",
 		LogLevel:        LOG_DEBUG,
-		Cachet:          NewCachetImpl(mockServer.URL, "1234567890abcdef", &http.Client{}),
+		Cachet:          NewCachetImpl(fake.URL, "1234567890abcdef", &http.Client{}),
 	}
 
 	router := PrepareGinRouter(&config)
@@ -133,18 +85,18 @@ func TestCachetHqComponent21(t *testing.T) {
 	defer resp.Body.Close()
 
 	// the status HAS been updated
-	assert.Equal(t, 2, finalStatus)
+	assert.Equal(t, 2, lastIncidentStatus(fake))
 }
 
 func TestCachetHqComponent22(t *testing.T) {
-	setupMockCachetHQ(t)
-	defer teardown()
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
 
 	config := PrometheusCachetConfig{
 		LabelName:       "alertname",
 		PrometheusToken: "promToken",
 		LogLevel:        LOG_DEBUG,
-		Cachet:          NewCachetImpl(mockServer.URL, "1234567890abcdef", &http.Client{}),
+		Cachet:          NewCachetImpl(fake.URL, "1234567890abcdef", &http.Client{}),
 	}
 
 	router := PrepareGinRouter(&config)
@@ -157,7 +109,10 @@ func TestCachetHqComponent22(t *testing.T) {
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	go server.ListenAndServe()
+	// listening before serving: the alert cannot be sent before the server is up
+	listener, err := net.Listen("tcp", server.Addr)
+	assert.Nil(t, err)
+	go server.Serve(listener)
 	defer server.Close()
 
 	// send an alert
@@ -174,5 +129,167 @@ func TestCachetHqComponent22(t *testing.T) {
 	defer resp.Body.Close()
 
 	// the status has NOT been updated because "component22" does not exist
-	assert.Equal(t, 0, finalStatus)
+	assert.Equal(t, 0, lastIncidentStatus(fake))
+}
+
+// alerts matching a route go to the route backend, the others to the default one
+func TestCachetHqRoutes(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+
+	events := make([]webhookEvent, 0)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			events = append(events, event)
+		}
+	}))
+	defer hook.Close()
+
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		LogLevel:  LOG_DEBUG,
+		Cachet:    NewCachetImpl(fake.URL, "1234567890abcdef", &http.Client{}),
+		Backends: map[string]Cachet{
+			"hook": NewWebhookImpl(hook.URL, []string{"component23"}, nil, hook.Client()),
+		},
+		Routes: []Route{
+			{Match: map[string]string{"team": "web"}, Backends: []string{"hook"}},
+		},
+	}
+
+	router := PrepareGinRouter(&config)
+
+	var jsonStr = []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","labels":{"alertname":"component23","team":"web"}},{"status":"firing","labels":{"alertname":"component21"}}],"version":"4"}`)
+	req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "component23", events[0].Component)
+	assert.Equal(t, 2, lastIncidentStatus(fake))
+}
+
+// a failing backend does not prevent the other backends of a route to be updated
+func TestCachetHqFanOut(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	broken := NewCachetImpl(failing.URL, "1234567890abcdef", failing.Client())
+	broken.SetAPIVersion(CACHET_API_V2)
+
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		LogLevel:  LOG_DEBUG,
+		Cachet:    NewCachetImpl(fake.URL, "1234567890abcdef", &http.Client{}),
+		Backends: map[string]Cachet{
+			"internal": broken,
+		},
+		Routes: []Route{
+			{Match: map[string]string{"alertname": "component21"}, Backends: []string{"internal", DEFAULT_BACKEND}},
+		},
+	}
+
+	router := PrepareGinRouter(&config)
+
+	var jsonStr = []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","labels":{"alertname":"component21"}}],"version":"4"}`)
+	req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// the default backend has been updated, and the internal error reported
+	assert.Equal(t, 2, lastIncidentStatus(fake))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var answer struct {
+		Backends map[string]string `json:"backends"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &answer))
+	assert.Contains(t, answer.Backends["internal"], "503")
+	_, ok := answer.Backends[DEFAULT_BACKEND]
+	assert.False(t, ok)
+}
+
+// each tenant has its own tokens and backends
+func TestCachetHqTenants(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+
+	events := make([]webhookEvent, 0)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			events = append(events, event)
+		}
+	}))
+	defer hook.Close()
+
+	config := PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "promToken",
+		LogLevel:        LOG_DEBUG,
+		Cachet:          NewCachetImpl(fake.URL, "1234567890abcdef", &http.Client{}),
+		Tenants: map[string]*PrometheusCachetConfig{
+			"teama": {
+				Tenant:           "teama",
+				PrometheusTokens: []string{"tokenA1", "tokenA2"},
+				LabelName:        "service",
+				Cachet:           NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+			},
+			"teamb": {
+				Tenant:           "teamb",
+				PrometheusTokens: []string{"tokenB"},
+				LabelName:        "alertname",
+				Cachet:           NewCachetImpl(fake.URL, "1234567890abcdef", &http.Client{}),
+			},
+		},
+	}
+
+	router := PrepareGinRouter(&config)
+
+	send := func(path, token string) int {
+		var jsonStr = []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","labels":{"alertname":"component21","service":"component21"}}],"version":"4"}`)
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer(jsonStr))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// team b cannot flip team a components, nor can the main token
+	assert.Equal(t, http.StatusForbidden, send("/alert/teama", "tokenB"))
+	assert.Equal(t, http.StatusForbidden, send("/alert/teama", "promToken"))
+	assert.Equal(t, 0, len(events))
+	assert.Equal(t, 0, lastIncidentStatus(fake))
+
+	// both team a tokens are accepted, and only team a backend is used
+	assert.Equal(t, http.StatusOK, send("/alert/teama", "tokenA2"))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, 0, lastIncidentStatus(fake))
+	assert.Equal(t, http.StatusOK, send("/alert/teama", "tokenA1"))
+	assert.Equal(t, 2, len(events))
+
+	assert.Equal(t, http.StatusNotFound, send("/alert/teamc", "tokenB"))
+	// a tenant token is not allowed on /alert either, a wrong token is not authenticated
+	assert.Equal(t, http.StatusForbidden, send("/alert", "tokenA1"))
+	assert.Equal(t, http.StatusUnauthorized, send("/alert/teama", "wrong"))
+
+	assert.Equal(t, float64(3), config.Metrics.WebhooksRejected.Get("teama", "authorization"))
+	assert.Equal(t, float64(1), config.Metrics.WebhooksRejected.Get(DEFAULT_BACKEND, "authorization"))
+	assert.Equal(t, float64(2), config.Metrics.IncidentsForwarded.Get("teama", DEFAULT_BACKEND))
+	assert.Equal(t, float64(0), config.Metrics.IncidentsForwarded.Get("teamb", DEFAULT_BACKEND))
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), `prometheus_cachethq_incidents_forwarded_total{tenant="teama",backend="default"} 2`)
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileVersion identifies a version of a file, to detect its modification
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(files ...string) ([]fileVersion, error) {
+	versions := make([]fileVersion, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+	return versions, nil
+}
+
+func sameVersions(a, b []fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+// CertificateReloader serves a certificate/key pair, reloaded when the files change
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	expiry   *MetricVec
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	versions []fileVersion
+}
+
+// Reload reloads the certificate if its files changed. On error, the previous certificate is kept
+func (r *CertificateReloader) Reload() error {
+	versions, err := statFiles(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.lock.RLock()
+	unchanged := r.cert != nil && sameVersions(versions, r.versions)
+	r.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	r.lock.Lock()
+	r.cert = &cert
+	r.versions = versions
+	r.lock.Unlock()
+
+	DefaultLogger().Info("loaded certificate", "file", r.certFile, "subject", leaf.Subject.CommonName, "not_after", leaf.NotAfter.Format(time.RFC3339))
+	if r.expiry != nil {
+		r.expiry.Set(float64(leaf.NotAfter.Unix()), r.certFile)
+	}
+	return nil
+}
+
+// Certificate returns the current certificate
+func (r *CertificateReloader) Certificate() *tls.Certificate {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert
+}
+
+// GetCertificate is to be used as tls.Config.GetCertificate (server side)
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate is to be used as tls.Config.GetClientCertificate (client side)
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// CAReloader serves a CA pool, reloaded when the file changes
+type CAReloader struct {
+	file   string
+	expiry *MetricVec
+
+	lock     sync.RWMutex
+	pool     *x509.CertPool
+	versions []fileVersion
+	// generation is incremented at each reload
+	generation int
+}
+
+// Reload reloads the CA if its file changed. On error, the previous CA is kept
+func (r *CAReloader) Reload() error {
+	versions, err := statFiles(r.file)
+	if err != nil {
+		return err
+	}
+
+	r.lock.RLock()
+	unchanged := r.pool != nil && sameVersions(versions, r.versions)
+	r.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return fmt.Errorf("no certificate found in %s", r.file)
+	}
+
+	// the CA file expires with its first certificate
+	var notAfter time.Time
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+				notAfter = cert.NotAfter
+			}
+		}
+	}
+
+	r.lock.Lock()
+	r.pool = pool
+	r.versions = versions
+	r.generation++
+	r.lock.Unlock()
+
+	DefaultLogger().Info("loaded CA", "file", r.file, "not_after", notAfter.Format(time.RFC3339))
+	if r.expiry != nil {
+		r.expiry.Set(float64(notAfter.Unix()), r.file)
+	}
+	return nil
+}
+
+// Pool returns the current CA pool and its generation
+func (r *CAReloader) Pool() (*x509.CertPool, int) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.pool, r.generation
+}
+
+type reloader interface {
+	Reload() error
+}
+
+// CertificateWatcher checks periodically the certificate, key and CA files in use, to
+// hot-swap them when they are rotated (by cert-manager for example)
+type CertificateWatcher struct {
+	expiry *MetricVec
+
+	lock      sync.Mutex
+	reloaders map[string]reloader
+}
+
+// NewCertificateWatcher creates a CertificateWatcher exposing the expiry time of the files in metrics
+func NewCertificateWatcher(metrics *BridgeMetrics) *CertificateWatcher {
+	w := &CertificateWatcher{
+		reloaders: make(map[string]reloader),
+	}
+	if metrics != nil {
+		w.expiry = metrics.CertificateExpiry
+	}
+	return w
+}
+
+// Certificate returns the (shared) reloader of a certificate/key pair
+func (w *CertificateWatcher) Certificate(certFile, keyFile string) (*CertificateReloader, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	key := "cert:" + certFile + ":" + keyFile
+	if r, ok := w.reloaders[key]; ok {
+		return r.(*CertificateReloader), nil
+	}
+
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile, expiry: w.expiry}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	w.reloaders[key] = r
+	return r, nil
+}
+
+// CA returns the (shared) reloader of a CA file
+func (w *CertificateWatcher) CA(file string) (*CAReloader, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	key := "ca:" + file
+	if r, ok := w.reloaders[key]; ok {
+		return r.(*CAReloader), nil
+	}
+
+	r := &CAReloader{file: file, expiry: w.expiry}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	w.reloaders[key] = r
+	return r, nil
+}
+
+// ReloadAll reloads the files that changed
+func (w *CertificateWatcher) ReloadAll() {
+	w.lock.Lock()
+	reloaders := make([]reloader, 0, len(w.reloaders))
+	for _, r := range w.reloaders {
+		reloaders = append(reloaders, r)
+	}
+	w.lock.Unlock()
+
+	for _, r := range reloaders {
+		if err := r.Reload(); err != nil {
+			DefaultLogger().Error("unable to reload certificate", "error", err)
+		}
+	}
+}
+
+// Run checks the files every interval, until stop is closed
+func (w *CertificateWatcher) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.ReloadAll()
+		case <-stop:
+			return
+		}
+	}
+}
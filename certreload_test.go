@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rewrite replaces a file content, making sure its modification time changes
+func rewrite(t *testing.T, filename string, content []byte) {
+	assert.Nil(t, ioutil.WriteFile(filename, content, 0600))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(filename, later, later))
+}
+
+func TestCertificateWatcherServer(t *testing.T) {
+	ca := newTestCA(t)
+	expiry1 := time.Now().Add(time.Hour).Truncate(time.Second)
+	cert1, key1 := ca.issue(t, "v1", expiry1)
+	certFile := writeTempFile(t, cert1)
+	defer os.Remove(certFile)
+	keyFile := writeTempFile(t, key1)
+	defer os.Remove(keyFile)
+
+	metrics := NewBridgeMetrics()
+	watcher := NewCertificateWatcher(metrics)
+	tlsConfig, err := NewServerTLSConfig(ServerTLSOptions{CertFile: certFile, KeyFile: keyFile, Watcher: watcher})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(expiry1.Unix()), metrics.CertificateExpiry.Get(certFile))
+
+	// not httptest.StartTLS, which would add its own certificate
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(tls.NewListener(listener, tlsConfig))
+	defer server.Close()
+	url := "https://" + listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverName := func() string {
+		// new connection each time
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, DisableKeepAlives: true}}
+		resp, err := client.Get(url)
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		defer resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "v1", serverName())
+
+	// cert-manager rotates the certificate
+	expiry2 := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	cert2, key2 := ca.issue(t, "v2", expiry2)
+	rewrite(t, certFile, cert2)
+	rewrite(t, keyFile, key2)
+	watcher.ReloadAll()
+
+	assert.Equal(t, "v2", serverName())
+	assert.Equal(t, float64(expiry2.Unix()), metrics.CertificateExpiry.Get(certFile))
+
+	// a broken file keeps the previous certificate
+	rewrite(t, keyFile, []byte("garbage"))
+	watcher.ReloadAll()
+	assert.Equal(t, "v2", serverName())
+}
+
+func TestCertificateWatcherClient(t *testing.T) {
+	ca1 := newTestCA(t)
+	ca2 := newTestCA(t)
+	caFile := writeTempFile(t, ca1.pem)
+	defer os.Remove(caFile)
+
+	clientCert1, clientKey1 := ca2.issue(t, "client1", time.Now().Add(time.Hour))
+	clientCertFile := writeTempFile(t, clientCert1)
+	defer os.Remove(clientCertFile)
+	clientKeyFile := writeTempFile(t, clientKey1)
+	defer os.Remove(clientKeyFile)
+
+	// the server certificate is signed by ca2, and it asks for a client certificate
+	serverCert, serverKey := ca2.issue(t, "cachet", time.Now().Add(time.Hour))
+	certificate, err := tls.X509KeyPair(serverCert, serverKey)
+	assert.Nil(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}, ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	watcher := NewCertificateWatcher(nil)
+	client, err := NewHTTPClient(HTTPClientOptions{
+		RootCA:     caFile,
+		ClientCert: clientCertFile,
+		ClientKey:  clientKeyFile,
+		Watcher:    watcher,
+	})
+	assert.Nil(t, err)
+
+	// ca1 does not trust the server yet
+	_, err = client.Get(ts.URL)
+	assert.NotNil(t, err)
+
+	rewrite(t, caFile, ca2.pem)
+	clientCert2, clientKey2 := ca2.issue(t, "client2", time.Now().Add(time.Hour))
+	rewrite(t, clientCertFile, clientCert2)
+	rewrite(t, clientKeyFile, clientKey2)
+	watcher.ReloadAll()
+
+	resp, err := client.Get(ts.URL)
+	assert.Nil(t, err)
+	if err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "client2", string(body))
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// DEFAULT_COMMAND_TIMEOUT bounds the backend calls of a command
+const DEFAULT_COMMAND_TIMEOUT = 30 * time.Second
+
+const commandUsage = `usage: prometheus-cachethq [parameters]                 run the bridge
+       prometheus-cachethq <command> [options] [parameters]
+
+commands:
+  components list                   list the components of the backend
+  incidents list --component X      list the incidents of a component
+  incidents resolve <id>            resolve an incident (--message to explain why)
+  send-test-alert --component X     send a test webhook to the bridge (--status firing|resolved)
+  check-config                      check the configuration and the backends
+  replay <file>                     replay recorded webhooks (--target dry-run|real|fake)
+
+The commands take the same parameters (and environment variables) as the bridge, and
+--backend/--tenant to select a backend of the config file.
+`
+
+// command is the parsed command line of a subcommand
+type command struct {
+	stdout     io.Writer
+	stderr     io.Writer
+	parameters *PrometheusCachetParameters
+	args       []string
+	tenant     string
+	backend    string
+}
+
+// RunCommand runs a subcommand (i.e. "components list"), and returns the exit code
+func RunCommand(args []string, stdout, stderr io.Writer) int {
+	name := args[0]
+	if len(args) > 1 && (name == "components" || name == "incidents") {
+		name += " " + args[1]
+	}
+
+	var run func(cmd *command, fs *flag.FlagSet) func() error
+	switch name {
+	case "components list":
+		run = runComponentsList
+	case "incidents list":
+		run = runIncidentsList
+	case "incidents resolve":
+		run = runIncidentsResolve
+	case "send-test-alert":
+		run = runSendTestAlert
+	case "check-config":
+		run = runCheckConfig
+	case "replay":
+		run = runReplay
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, commandUsage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command '%s'\n\n%s", name, commandUsage)
+		return 2
+	}
+
+	cmd := &command{stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("prometheus-cachethq "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&cmd.tenant, "tenant", "", "tenant of the backend (default: the main backends)")
+	fs.StringVar(&cmd.backend, "backend", DEFAULT_BACKEND, "backend of the config file to use")
+	execute := run(cmd, fs)
+
+	rest := args[1:]
+	if name != "send-test-alert" && name != "check-config" && name != "replay" {
+		rest = args[2:]
+	}
+	var err error
+	cmd.parameters, cmd.args, err = NewPrometheusCachetParameters(fs, rest)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+
+	logLevel, err := ParseLogLevel(cmd.parameters.loglevel)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	SetDefaultLogger(NewLogger(stderr, logLevel, cmd.parameters.logFormat))
+
+	if err := execute(); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// config builds the configuration from the parameters, and selects the tenant
+func (cmd *command) config() (*PrometheusCachetConfig, error) {
+	config, err := NewPrometheusCachetConfig(cmd.parameters, NewBridgeMetrics(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.tenant == "" {
+		return config, nil
+	}
+	tenant, ok := config.Tenants[cmd.tenant]
+	if !ok {
+		return nil, fmt.Errorf("unknown tenant '%s'", cmd.tenant)
+	}
+	return tenant, nil
+}
+
+// cachet returns the selected backend
+func (cmd *command) cachet() (Cachet, error) {
+	config, err := cmd.config()
+	if err != nil {
+		return nil, err
+	}
+	backend := config.Backend(cmd.backend)
+	if backend == nil {
+		return nil, fmt.Errorf("unknown backend '%s'", cmd.backend)
+	}
+	return backend, nil
+}
+
+func (cmd *command) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), DEFAULT_COMMAND_TIMEOUT)
+}
+
+func runComponentsList(cmd *command, fs *flag.FlagSet) func() error {
+	return func() error {
+		backend, err := cmd.cachet()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := cmd.context()
+		defer cancel()
+
+		components, err := backend.ListComponentsContext(ctx)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(components))
+		for name := range components {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w := tabwriter.NewWriter(cmd.stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME")
+		for _, name := range names {
+			fmt.Fprintf(w, "%d\t%s\n", components[name], name)
+		}
+		return w.Flush()
+	}
+}
+
+func runIncidentsList(cmd *command, fs *flag.FlagSet) func() error {
+	component := fs.String("component", "", "component whose incidents are listed")
+	return func() error {
+		if *component == "" {
+			return fmt.Errorf("--component is mandatory")
+		}
+		backend, err := cmd.cachet()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := cmd.context()
+		defer cancel()
+
+		componentID, err := backend.SearchComponentContext(ctx, *component)
+		if err != nil {
+			return fmt.Errorf("component %s: %v", *component, err)
+		}
+		incidents, err := backend.SearchIncidentsContext(ctx, componentID)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(cmd.stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tCREATED\tUPDATED")
+		for _, incident := range incidents {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", incident.Id, incidentStatusName(incident.Status), incident.CreatedAt, incident.UpdatedAt)
+		}
+		return w.Flush()
+	}
+}
+
+func incidentStatusName(status int) string {
+	if name, ok := cachet3IncidentStatus[status]; ok {
+		return name
+	}
+	return strconv.Itoa(status)
+}
+
+func runIncidentsResolve(cmd *command, fs *flag.FlagSet) func() error {
+	message := fs.String("message", "", "message of the resolution (default: resolved from the command line)")
+	return func() error {
+		if len(cmd.args) != 1 {
+			return fmt.Errorf("expected the id of the incident to resolve")
+		}
+		incidentID, err := strconv.Atoi(cmd.args[0])
+		if err != nil {
+			return fmt.Errorf("invalid incident id '%s'", cmd.args[0])
+		}
+		backend, err := cmd.cachet()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := cmd.context()
+		defer cancel()
+
+		incident, err := backend.ReadIncidentContext(ctx, incidentID)
+		if err != nil {
+			return err
+		}
+		components, err := backend.ListComponentsContext(ctx)
+		if err != nil {
+			return err
+		}
+		componentName := ""
+		for name, id := range components {
+			if id == incident.ComponentId {
+				componentName = name
+			}
+		}
+		if componentName == "" {
+			return fmt.Errorf("component %d of incident %d not found", incident.ComponentId, incidentID)
+		}
+
+		text := *message
+		if text == "" {
+			text = fmt.Sprintf("Service %s flagged as up from the command line", componentName)
+		}
+		if err := backend.UpdateIncidentContext(ctx, componentName, incident.ComponentId, incidentID, 1, text); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.stdout, "incident %d of %s resolved\n", incidentID, componentName)
+		return nil
+	}
+}
+
+func runSendTestAlert(cmd *command, fs *flag.FlagSet) func() error {
+	component := fs.String("component", "", "component of the test alert (value of the label_name label)")
+	status := fs.String("status", "firing", "status of the test alert: [firing|resolved]")
+	url := fs.String("url", "", "alert endpoint of the bridge (default: http://127.0.0.1:<http_port>/alert[/<tenant>])")
+	return func() error {
+		if *component == "" {
+			return fmt.Errorf("--component is mandatory")
+		}
+		if *status != "firing" && *status != "resolved" {
+			return fmt.Errorf("unknown status '%s' (expected firing or resolved)", *status)
+		}
+		target := *url
+		if target == "" {
+			target = fmt.Sprintf("http://127.0.0.1:%d/alert", cmd.parameters.httpPort)
+			if cmd.tenant != "" {
+				target += "/" + cmd.tenant
+			}
+		}
+
+		labels := map[string]string{
+			"alertname":              "PrometheusCachetHQTestAlert",
+			cmd.parameters.labelName: *component,
+		}
+		alert := PrometheusAlert{
+			Version:      "4",
+			GroupKey:     fmt.Sprintf("{}:{%s=%q}", cmd.parameters.labelName, *component),
+			Status:       *status,
+			Receiver:     "prometheus-cachethq-cli",
+			CommonLabels: labels,
+			Alerts: []PrometheusAlertDetail{{
+				Status:      *status,
+				Fingerprint: fmt.Sprintf("test-%s", *component),
+				Labels:      labels,
+				Annotations: map[string]string{"summary": "test alert sent from the command line"},
+				StartAt:     time.Now().UTC().Format(time.RFC3339),
+			}},
+		}
+		body, err := json.Marshal(&alert)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := cmd.context()
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if cmd.parameters.prometheusToken != "" {
+			req.Header.Set("Authorization", "Bearer "+cmd.parameters.prometheusToken)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		answer, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s answered %d: %s", target, resp.StatusCode, string(answer))
+		}
+		fmt.Fprintf(cmd.stdout, "%s alert sent for %s\n", *status, *component)
+		return nil
+	}
+}
+
+func runCheckConfig(cmd *command, fs *flag.FlagSet) func() error {
+	return func() error {
+		config, err := NewPrometheusCachetConfig(cmd.parameters, NewBridgeMetrics(), nil)
+		if err != nil {
+			return err
+		}
+		if _, err := ParseLogFormat(cmd.parameters.logFormat); err != nil {
+			return err
+		}
+
+		report := SelfCheck(context.Background(), config, DEFAULT_STARTUP_CHECK_TIMEOUT)
+		for _, warning := range report.Warnings {
+			fmt.Fprintf(cmd.stdout, "warning: %s\n", warning)
+		}
+		for _, err := range report.Errors {
+			fmt.Fprintf(cmd.stdout, "error: %s\n", err)
+		}
+		if len(report.Errors) > 0 {
+			return fmt.Errorf("%d backend(s) unusable", len(report.Errors))
+		}
+		fmt.Fprintln(cmd.stdout, "configuration OK")
+		return nil
+	}
+}
+
+func runReplay(cmd *command, fs *flag.FlagSet) func() error {
+	target := fs.String("target", REPLAY_TARGET_DRY_RUN, "backends the webhooks are replayed against: [dry-run|real|fake]")
+	return func() error {
+		if len(cmd.args) != 1 {
+			return fmt.Errorf("expected the record file to replay")
+		}
+		webhooks, err := ReadRecordedWebhooks(cmd.args[0])
+		if err != nil {
+			return err
+		}
+		config, err := NewPrometheusCachetConfig(cmd.parameters, NewBridgeMetrics(), nil)
+		if err != nil {
+			return err
+		}
+		if cmd.parameters.dedupeTTL > 0 {
+			config.Dedupe = NewDeduplicator(cmd.parameters.dedupeTTL)
+		}
+		config.Logger = DefaultLogger()
+
+		holdDown := len(holdDownRoutes(config))
+		results, err := Replay(config, webhooks, *target)
+		if err != nil {
+			return err
+		}
+		if holdDown > 0 {
+			fmt.Fprintf(cmd.stdout, "hold-down disabled on %d route(s): the changes are applied when the webhook is replayed\n", holdDown)
+		}
+
+		changes, failures := 0, 0
+		for _, result := range results {
+			tenant := result.Webhook.Tenant
+			if tenant == "" {
+				tenant = DEFAULT_BACKEND
+			}
+			var alerts PrometheusAlert
+			json.Unmarshal(result.Webhook.Body, &alerts)
+			fmt.Fprintf(cmd.stdout, "%s %s %s %s: %d\n", result.Webhook.Time.Format(time.RFC3339), tenant, alerts.Status, alerts.GroupKey, result.Code)
+			if result.Code != http.StatusOK {
+				failures++
+				fmt.Fprintf(cmd.stdout, "  %s\n", result.Answer)
+			}
+			for _, change := range result.Changes {
+				changes++
+				fmt.Fprintf(cmd.stdout, "  %s %s %s status=%d component_status=%d", change.Backend, change.Component, change.Action, change.Status, change.ComponentStatus)
+				if change.IncidentID != 0 {
+					fmt.Fprintf(cmd.stdout, " incident=%d", change.IncidentID)
+				}
+				if change.Error != nil {
+					fmt.Fprintf(cmd.stdout, " error=%q", change.Error.Error())
+				}
+				fmt.Fprintln(cmd.stdout)
+			}
+		}
+		fmt.Fprintf(cmd.stdout, "%d webhook(s) replayed against %s backends: %d change(s), %d failure(s)\n", len(results), *target, changes, failures)
+		if failures > 0 {
+			return fmt.Errorf("%d webhook(s) failed", failures)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+	"github.com/stretchr/testify/assert"
+)
+
+// newCommandCachetHQ starts a fake CachetHQ with 2 components, component21 having an incident open
+func newCommandCachetHQ() *cachetfake.Server {
+	fake := cachetfake.NewServer()
+	fake.Now = func() time.Time { return time.Date(2026, 10, 18, 20, 0, 0, 0, time.UTC) }
+	component21 := fake.AddComponent("component21", 0)
+	fake.AddComponent("api", 0)
+	fake.AddIncident(component21, "component21 down", cachetfake.INCIDENT_IDENTIFIED)
+	return fake
+}
+
+func runTestCommand(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := RunCommand(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	cachethq := newCommandCachetHQ()
+	defer cachethq.Close()
+
+	code, stdout, _ := runTestCommand("components", "list", "-cachethq_url", cachethq.URL, "-cachethq_token", "secret")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "ID  NAME\n2   api\n1   component21\n", stdout)
+
+	code, stdout, _ = runTestCommand("incidents", "list", "--component", "component21", "-cachethq_url", cachethq.URL)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "1   identified  2026-10-18 20:00:00  2026-10-18 20:00:00")
+
+	code, _, stderr := runTestCommand("incidents", "list", "--component", "unknown", "-cachethq_url", cachethq.URL)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "component unknown: no component found")
+
+	// the flags may follow the positional arguments
+	code, stdout, _ = runTestCommand("incidents", "resolve", "1", "--message", "fixed by hand", "-cachethq_url", cachethq.URL)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "incident 1 of component21 resolved\n", stdout)
+	incident, _ := cachethq.Incident(1)
+	assert.Equal(t, cachetfake.INCIDENT_FIXED, incident.Status)
+	assert.Equal(t, "fixed by hand", incident.Message)
+
+	code, _, stderr = runTestCommand("incidents", "resolve", "twelve", "-cachethq_url", cachethq.URL)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "invalid incident id 'twelve'")
+
+	code, _, stderr = runTestCommand("components", "list", "--backend", "public", "-cachethq_url", cachethq.URL)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "unknown backend 'public'")
+
+	code, _, _ = runTestCommand("incidents", "delete")
+	assert.Equal(t, 2, code)
+}
+
+func TestSendTestAlertCommand(t *testing.T) {
+	var received PrometheusAlert
+	bridge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/alert/teama", r.URL.Path)
+		assert.Equal(t, "Bearer promToken", r.Header.Get("Authorization"))
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	defer bridge.Close()
+
+	code, stdout, _ := runTestCommand("send-test-alert", "--component", "component21", "--status", "resolved", "--tenant", "teama",
+		"--url", bridge.URL+"/alert/teama", "-prometheus_token", "promToken", "-label_name", "service")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "resolved alert sent for component21\n", stdout)
+	assert.Equal(t, "resolved", received.Status)
+	assert.Equal(t, 1, len(received.Alerts))
+	assert.Equal(t, "component21", received.Alerts[0].Labels["service"])
+
+	code, _, stderr := runTestCommand("send-test-alert", "--component", "component21", "--status", "down")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "unknown status 'down'")
+}
+
+func TestCheckConfigCommand(t *testing.T) {
+	cachethq := newSelfCheckServer(t)
+	defer cachethq.Close()
+
+	code, stdout, _ := runTestCommand("check-config", "-cachethq_url", cachethq.URL, "-cachethq_token", "writer", "-cachethq_api_version", "2")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "configuration OK\n", stdout)
+
+	// the token is not allowed to write incidents
+	code, stdout, _ = runTestCommand("check-config", "-cachethq_url", cachethq.URL, "-cachethq_token", "reader", "-cachethq_api_version", "2")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout, "error: ")
+
+	code, _, stderr := runTestCommand("check-config", "-config_file", "/nonexistent.yaml")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "/nonexistent.yaml")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DEFAULT_BACKEND_TIMEOUT is the timeout of each request to a backend, if not configured
+const DEFAULT_BACKEND_TIMEOUT = 30 * time.Second
+
+const (
+	BACKEND_CACHET     = "cachet"
+	BACKEND_STATUSPAGE = "statuspage"
+	BACKEND_WEBHOOK    = "webhook"
+)
+
+// BackendConfig describes one status page backend, as found in the config file
+//
+//	backends:
+//	  public:
+//	    type: cachet
+//	    url: https://status.example.com
+//	    token: xxx
+//	    api_version: auto
+//	  internal:
+//	    type: cachet
+//	    url: https://status.internal
+//	    token: xxx
+//	    root_ca: /etc/ssl/internal-ca.pem
+//	    client_cert_file: /etc/ssl/bridge.crt
+//	    client_key_file: /etc/ssl/bridge.key
+//	    proxy_url: http://proxy.internal:3128
+//	    timeout: 10s
+//	    call_timeout: 20s
+//	  atlassian:
+//	    type: statuspage
+//	    token: xxx
+//	    page_id: yyy
+//	  hook:
+//	    type: webhook
+//	    url: https://example.com/hook
+//	    components: [component21, component22]
+type BackendConfig struct {
+	Type        string            `yaml:"type"`
+	URL         string            `yaml:"url"`
+	Token       string            `yaml:"token"`
+	APIVersion  string            `yaml:"api_version"`
+	RootCA      string            `yaml:"root_ca"`
+	SkipVerify  bool              `yaml:"skip_verify_ssl"`
+	ClientCert  string            `yaml:"client_cert_file"`
+	ClientKey   string            `yaml:"client_key_file"`
+	ProxyURL    string            `yaml:"proxy_url"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	CallTimeout time.Duration     `yaml:"call_timeout"`
+	PageID      string            `yaml:"page_id"`
+	Components  []string          `yaml:"components"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+// RouteConfig select the backend(s) for the alerts matching all the labels
+//
+//	routes:
+//	  - match:
+//	      alertname: component21
+//	    backend: atlassian
+//	  - match:
+//	      team: web
+//	    backends: [public, internal]
+//	    fire_after: 2m
+//	    resolve_after: 5m
+//	    flap_window: 15m
+//	  - match:
+//	      team: beta
+//	    backend: public
+//	    dry_run: true
+type RouteConfig struct {
+	Match        map[string]string `yaml:"match"`
+	Backend      string            `yaml:"backend"`
+	Backends     []string          `yaml:"backends"`
+	FireAfter    time.Duration     `yaml:"fire_after"`
+	ResolveAfter time.Duration     `yaml:"resolve_after"`
+	FlapWindow   time.Duration     `yaml:"flap_window"`
+	DryRun       bool              `yaml:"dry_run"`
+}
+
+// Targets returns all the backends of the route
+func (r *RouteConfig) Targets() []string {
+	targets := make([]string, 0, len(r.Backends)+1)
+	if r.Backend != "" {
+		targets = append(targets, r.Backend)
+	}
+	return append(targets, r.Backends...)
+}
+
+// TenantConfig describes a team having its own /alert/<tenant> endpoint. A tenant
+// only sees its own backends: its "default" backend is used when no route matches
+//
+//	tenants:
+//	  teama:
+//	    tokens: [token1, token2]
+//	    token_files: [/var/run/secrets/teama/token]
+//	    basic_auth:
+//	      alertmanager: password
+//	    label_name: service
+//	    squash_incident: true
+//	    backends:
+//	      default:
+//	        type: cachet
+//	        url: https://status.teama.example.com
+//	        token: xxx
+//	    routes: []
+type TenantConfig struct {
+	Tokens         []string                 `yaml:"tokens"`
+	TokenFiles     []string                 `yaml:"token_files"`
+	BasicAuth      map[string]string        `yaml:"basic_auth"`
+	LabelName      string                   `yaml:"label_name"`
+	SquashIncident bool                     `yaml:"squash_incident"`
+	Backends       map[string]BackendConfig `yaml:"backends"`
+	Routes         []RouteConfig            `yaml:"routes"`
+}
+
+// FileConfig is the content of the (optional) yaml config file
+type FileConfig struct {
+	Backends map[string]BackendConfig `yaml:"backends"`
+	Routes   []RouteConfig            `yaml:"routes"`
+	Tenants  map[string]TenantConfig  `yaml:"tenants"`
+}
+
+func checkRoutes(routes []RouteConfig, backends map[string]BackendConfig, defaultBackend bool) error {
+	for i, route := range routes {
+		if len(route.Targets()) == 0 {
+			return fmt.Errorf("route %d has no backend", i)
+		}
+		if route.FireAfter < 0 || route.ResolveAfter < 0 || route.FlapWindow < 0 {
+			return fmt.Errorf("route %d has a negative hold-down", i)
+		}
+		for _, backend := range route.Targets() {
+			if _, ok := backends[backend]; !ok && !(backend == DEFAULT_BACKEND && defaultBackend) {
+				return fmt.Errorf("route %d uses an unknown backend '%s'", i, backend)
+			}
+		}
+	}
+	return nil
+}
+
+// hasCatchAllRoute returns true if a route (without labels to match) gets all the alerts
+func hasCatchAllRoute(routes []RouteConfig) bool {
+	for _, route := range routes {
+		if len(route.Match) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadConfigFile reads and checks a yaml config file
+func LoadConfigFile(filename string) (*FileConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var config FileConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if err := checkRoutes(config.Routes, config.Backends, true); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	for name, tenant := range config.Tenants {
+		if len(tenant.Tokens) == 0 && len(tenant.TokenFiles) == 0 && len(tenant.BasicAuth) == 0 {
+			return nil, fmt.Errorf("%s: tenant %s has no token", filename, name)
+		}
+		if err := checkRoutes(tenant.Routes, tenant.Backends, false); err != nil {
+			return nil, fmt.Errorf("%s: tenant %s: %v", filename, name, err)
+		}
+		if _, ok := tenant.Backends[DEFAULT_BACKEND]; !ok && !hasCatchAllRoute(tenant.Routes) {
+			return nil, fmt.Errorf("%s: tenant %s has no default backend for the alerts matching no route", filename, name)
+		}
+	}
+
+	return &config, nil
+}
+
+// NewBackend creates the Cachet implementation described by a BackendConfig,
+// with its own http client. The (optional) watcher reloads its certificates
+func NewBackend(backend BackendConfig, watcher *CertificateWatcher) (Cachet, error) {
+	timeout := backend.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_BACKEND_TIMEOUT
+	}
+	client, err := NewHTTPClient(HTTPClientOptions{
+		RootCA:     backend.RootCA,
+		SkipVerify: backend.SkipVerify,
+		ClientCert: backend.ClientCert,
+		ClientKey:  backend.ClientKey,
+		ProxyURL:   backend.ProxyURL,
+		Timeout:    timeout,
+		Watcher:    watcher,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend.Type {
+	case BACKEND_CACHET, "":
+		if backend.URL == "" {
+			return nil, fmt.Errorf("cachet backend needs an url")
+		}
+		version, err := ParseCachetAPIVersion(backend.APIVersion)
+		if err != nil {
+			return nil, err
+		}
+		cachet := NewCachetImpl(backend.URL, backend.Token, client)
+		cachet.SetAPIVersion(version)
+		return WithCallTimeout(cachet, backend.CallTimeout), nil
+	case BACKEND_STATUSPAGE:
+		if backend.PageID == "" {
+			return nil, fmt.Errorf("statuspage backend needs a page_id")
+		}
+		apiURL := backend.URL
+		if apiURL == "" {
+			apiURL = STATUSPAGE_API_URL
+		}
+		return WithCallTimeout(NewStatuspageImpl(apiURL, backend.Token, backend.PageID, client), backend.CallTimeout), nil
+	case BACKEND_WEBHOOK:
+		if backend.URL == "" {
+			return nil, fmt.Errorf("webhook backend needs an url")
+		}
+		return WithCallTimeout(NewWebhookImpl(backend.URL, backend.Components, backend.Headers, client), backend.CallTimeout), nil
+	}
+	return nil, fmt.Errorf("unknown backend type '%s'", backend.Type)
+}
+
+// NewBackends creates the backends and routes described in the config file
+func NewBackends(backendsConfig map[string]BackendConfig, routesConfig []RouteConfig, watcher *CertificateWatcher) (map[string]Cachet, []Route, error) {
+	backends := make(map[string]Cachet)
+	for name, backendConfig := range backendsConfig {
+		backend, err := NewBackend(backendConfig, watcher)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backend %s: %v", name, err)
+		}
+		backends[name] = backend
+	}
+
+	routes := make([]Route, 0, len(routesConfig))
+	for _, route := range routesConfig {
+		routes = append(routes, Route{
+			Match:    route.Match,
+			Backends: route.Targets(),
+			HoldDown: HoldDownPolicy{
+				FireAfter:    route.FireAfter,
+				ResolveAfter: route.ResolveAfter,
+				FlapWindow:   route.FlapWindow,
+			},
+			DryRun: route.DryRun,
+		})
+	}
+	return backends, routes, nil
+}
+
+// NewTenantConfig creates the configuration of a tenant, inheriting the
+// label name, log level, alert timeout, hold-down, dry-run recorder and certificate watcher of the main configuration
+func NewTenantConfig(name string, tenant TenantConfig, parent *PrometheusCachetConfig) (*PrometheusCachetConfig, error) {
+	backends, routes, err := NewBackends(tenant.Backends, tenant.Routes, parent.Certificates)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %v", name, err)
+	}
+
+	auth, err := NewAuthenticator(name, tenant.Tokens, tenant.TokenFiles, tenant.BasicAuth)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %v", name, err)
+	}
+
+	config := &PrometheusCachetConfig{
+		Tenant:           name,
+		Auth:             auth,
+		PrometheusTokens: tenant.Tokens,
+		Cachet:           backends[DEFAULT_BACKEND],
+		Backends:         backends,
+		Routes:           routes,
+		LabelName:        tenant.LabelName,
+		LogLevel:         parent.LogLevel,
+		SquashIncident:   tenant.SquashIncident,
+		AlertTimeout:     parent.AlertTimeout,
+		Metrics:          parent.Metrics,
+		Certificates:     parent.Certificates,
+		HoldDown:         parent.HoldDown,
+		DryRun:           parent.DryRun,
+	}
+	if config.LabelName == "" {
+		config.LabelName = parent.LabelName
+	}
+	return config, nil
+}
+
+// Route is the runtime version of a RouteConfig
+type Route struct {
+	Match    map[string]string
+	Backends []string
+	HoldDown HoldDownPolicy
+	// DryRun records the changes of the route instead of applying them
+	DryRun bool
+}
+
+// Matches returns true if all the route labels are found in the alert labels
+func (r *Route) Matches(labels map[string]string) bool {
+	for name, value := range r.Match {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
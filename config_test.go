@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "prometheus-cachethq-*.yaml")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString(content)
+	assert.Nil(t, err)
+	return f.Name()
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	filename := writeConfigFile(t, `
+backends:
+  atlassian:
+    type: statuspage
+    token: secret
+    page_id: page1
+  hook:
+    type: webhook
+    url: http://127.0.0.1/hook
+    components: [component21]
+    proxy_url: http://127.0.0.1:3128
+    timeout: 5s
+routes:
+  - match:
+      team: web
+    backend: atlassian
+    fire_after: 2m
+    flap_window: 15m
+  - match:
+      team: db
+    backends: [default, hook]
+    dry_run: true
+`)
+	defer os.Remove(filename)
+
+	config, err := LoadConfigFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(config.Backends))
+	assert.Equal(t, 2, len(config.Routes))
+	assert.Equal(t, 5*time.Second, config.Backends["hook"].Timeout)
+	assert.Equal(t, []string{"atlassian"}, config.Routes[0].Targets())
+	assert.Equal(t, []string{DEFAULT_BACKEND, "hook"}, config.Routes[1].Targets())
+
+	_, routes, err := NewBackends(nil, config.Routes, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, HoldDownPolicy{FireAfter: 2 * time.Minute, FlapWindow: 15 * time.Minute}, routes[0].HoldDown)
+	assert.False(t, routes[1].HoldDown.Enabled())
+	assert.False(t, routes[0].DryRun)
+	assert.True(t, routes[1].DryRun)
+
+	backend, err := NewBackend(config.Backends["atlassian"], nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &StatuspageImpl{}, backend)
+
+	backend, err = NewBackend(config.Backends["hook"], nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &WebhookImpl{}, backend)
+
+	_, err = NewBackend(BackendConfig{Type: "unknown"}, nil)
+	assert.NotNil(t, err)
+
+	// the root CA must exist
+	_, err = NewBackend(BackendConfig{Type: "cachet", URL: "https://127.0.0.1", RootCA: "/nonexistent.pem"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigFileUnknownBackend(t *testing.T) {
+	filename := writeConfigFile(t, `
+routes:
+  - match:
+      team: web
+    backend: atlassian
+`)
+	defer os.Remove(filename)
+
+	_, err := LoadConfigFile(filename)
+	assert.NotNil(t, err)
+}
+
+func TestRouteMatches(t *testing.T) {
+	route := Route{Match: map[string]string{"team": "web", "env": "prod"}}
+	assert.True(t, route.Matches(map[string]string{"team": "web", "env": "prod", "alertname": "x"}))
+	assert.False(t, route.Matches(map[string]string{"team": "web"}))
+}
+
+func TestLoadConfigFileTenants(t *testing.T) {
+	filename := writeConfigFile(t, `
+tenants:
+  teama:
+    tokens: [token1, token2]
+    label_name: service
+    backends:
+      default:
+        type: webhook
+        url: http://127.0.0.1/hook
+        components: [component21]
+`)
+	defer os.Remove(filename)
+
+	fileConfig, err := LoadConfigFile(filename)
+	assert.Nil(t, err)
+
+	parent := &PrometheusCachetConfig{LabelName: "alertname", LogLevel: LOG_INFO}
+	tenant, err := NewTenantConfig("teama", fileConfig.Tenants["teama"], parent)
+	assert.Nil(t, err)
+	assert.Equal(t, "service", tenant.LabelName)
+	assert.Equal(t, []string{"token1", "token2"}, tenant.AcceptedTokens())
+	assert.NotNil(t, tenant.Backend(DEFAULT_BACKEND))
+
+	// a tenant cannot route to the main default backend, nor live without token
+	filename2 := writeConfigFile(t, `
+tenants:
+  teamb:
+    tokens: [token]
+    routes:
+      - match:
+          team: b
+        backend: default
+`)
+	defer os.Remove(filename2)
+	_, err = LoadConfigFile(filename2)
+	assert.NotNil(t, err)
+
+	filename3 := writeConfigFile(t, `
+tenants:
+  teamc:
+    backends: {}
+`)
+	defer os.Remove(filename3)
+	_, err = LoadConfigFile(filename3)
+	assert.NotNil(t, err)
+
+	// the alerts matching no route would have no backend
+	filename4 := writeConfigFile(t, `
+tenants:
+  teamd:
+    tokens: [token]
+    backends:
+      hook:
+        type: webhook
+        url: http://127.0.0.1/hook
+    routes:
+      - match:
+          team: d
+        backend: hook
+`)
+	defer os.Remove(filename4)
+	_, err = LoadConfigFile(filename4)
+	assert.NotNil(t, err)
+
+	// unless a route matches all of them
+	filename5 := writeConfigFile(t, `
+tenants:
+  teame:
+    tokens: [token]
+    backends:
+      hook:
+        type: webhook
+        url: http://127.0.0.1/hook
+    routes:
+      - backend: hook
+`)
+	defer os.Remove(filename5)
+	_, err = LoadConfigFile(filename5)
+	assert.Nil(t, err)
+}
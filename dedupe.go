@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEFAULT_DEDUPE_TTL is how long the processed notifications are remembered, longer
+// than the Alertmanager repeat_interval (4h by default)
+const DEFAULT_DEDUPE_TTL = 24 * time.Hour
+
+// Deduplicator remembers the recently processed notifications, so the Alertmanager
+// resends (repeat_interval) and the duplicates of an HA Alertmanager pair are skipped.
+// It also remembers the last status forwarded per component, to skip the no-op transitions.
+// A nil Deduplicator remembers nothing
+type Deduplicator struct {
+	ttl         time.Duration
+	lock        sync.Mutex
+	seen        map[string]dedupeClaim
+	transitions map[string]dedupeTransition
+	nextPrune   time.Time
+}
+
+// dedupeClaim is a notification processed, for the component tenant/name
+type dedupeClaim struct {
+	component string
+	expires   time.Time
+}
+
+type dedupeTransition struct {
+	status  int
+	expires time.Time
+}
+
+func NewDeduplicator(ttl time.Duration) *Deduplicator {
+	return &Deduplicator{
+		ttl:         ttl,
+		seen:        make(map[string]dedupeClaim),
+		transitions: make(map[string]dedupeTransition),
+	}
+}
+
+// DedupeKey identifies the notification of an alert to a backend
+func DedupeKey(tenant, backend, groupKey, fingerprint, status, startsAt string) string {
+	return strings.Join([]string{tenant, backend, groupKey, fingerprint, status, startsAt}, "\xff")
+}
+
+func componentKey(tenant, backend string, componentID int) string {
+	return fmt.Sprintf("%s/%s/%d", tenant, backend, componentID)
+}
+
+// prune forgets the expired entries, at most once a minute (d.lock must be held)
+func (d *Deduplicator) prune(now time.Time) {
+	if now.Before(d.nextPrune) {
+		return
+	}
+	d.nextPrune = now.Add(time.Minute)
+	for key, claim := range d.seen {
+		if !now.Before(claim.expires) {
+			delete(d.seen, key)
+		}
+	}
+	for key, transition := range d.transitions {
+		if !now.Before(transition.expires) {
+			delete(d.transitions, key)
+		}
+	}
+}
+
+// Claim returns false if the notification was already processed (or is being processed),
+// else it is remembered. A notification failing to be forwarded is to be Released
+func (d *Deduplicator) Claim(key, tenant, component string) bool {
+	if d == nil {
+		return true
+	}
+	now := time.Now()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.prune(now)
+
+	if claim, ok := d.seen[key]; ok && now.Before(claim.expires) {
+		return false
+	}
+	d.seen[key] = dedupeClaim{component: overrideKey(tenant, component), expires: now.Add(d.ttl)}
+	return true
+}
+
+// Release forgets a notification, so that its next resend is processed
+func (d *Deduplicator) Release(key string) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.seen, key)
+}
+
+// ReleaseComponent forgets the notifications of a component, so that the next resend of its
+// alerts is processed (i.e. when its override ends)
+func (d *Deduplicator) ReleaseComponent(tenant, component string) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key, claim := range d.seen {
+		if claim.component == overrideKey(tenant, component) {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// Unchanged returns true if the status was the last one forwarded for this component. As the
+// status page may have been changed since (by hand, by another replica, before a restart), the
+// backend is to be checked with backendUnchanged before skipping the alert
+func (d *Deduplicator) Unchanged(tenant, backend string, componentID, status int) bool {
+	if d == nil {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	transition, ok := d.transitions[componentKey(tenant, backend, componentID)]
+	return ok && transition.status == status && time.Now().Before(transition.expires)
+}
+
+// Forwarded records the status forwarded for this component
+func (d *Deduplicator) Forwarded(tenant, backend string, componentID, status int) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.transitions[componentKey(tenant, backend, componentID)] = dedupeTransition{
+		status:  status,
+		expires: time.Now().Add(d.ttl),
+	}
+}
+
+// backendUnchanged returns true if the component still is in the alert status on the backend: an
+// incident open if firing, none if resolved. On error, the alert is to be forwarded
+func backendUnchanged(ctx context.Context, backend Cachet, componentID, status int) bool {
+	incidents, err := backend.SearchIncidentsContext(ctx, componentID)
+	if err != nil {
+		return false
+	}
+	open := len(incidents) > 0 && incidents[0].Status != 4
+	return open == (status != 1)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicator(t *testing.T) {
+	dedupe := NewDeduplicator(50 * time.Millisecond)
+	key := DedupeKey(DEFAULT_BACKEND, DEFAULT_BACKEND, "{}:{}", "f1a2", "firing", "2026-10-18T20:00:00Z")
+
+	assert.True(t, dedupe.Claim(key, DEFAULT_BACKEND, "component21"))
+	assert.False(t, dedupe.Claim(key, DEFAULT_BACKEND, "component21"))
+	dedupe.Release(key)
+	assert.True(t, dedupe.Claim(key, DEFAULT_BACKEND, "component21"))
+	dedupe.ReleaseComponent("teama", "component21")
+	assert.False(t, dedupe.Claim(key, DEFAULT_BACKEND, "component21"))
+	dedupe.ReleaseComponent(DEFAULT_BACKEND, "component21")
+	assert.True(t, dedupe.Claim(key, DEFAULT_BACKEND, "component21"))
+
+	assert.False(t, dedupe.Unchanged(DEFAULT_BACKEND, DEFAULT_BACKEND, 1, 4))
+	dedupe.Forwarded(DEFAULT_BACKEND, DEFAULT_BACKEND, 1, 4)
+	assert.True(t, dedupe.Unchanged(DEFAULT_BACKEND, DEFAULT_BACKEND, 1, 4))
+	assert.False(t, dedupe.Unchanged(DEFAULT_BACKEND, DEFAULT_BACKEND, 1, 1))
+
+	// forgotten after the ttl
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, dedupe.Claim(key, DEFAULT_BACKEND, "component21"))
+	assert.False(t, dedupe.Unchanged(DEFAULT_BACKEND, DEFAULT_BACKEND, 1, 4))
+
+	// without deduplicator, everything is processed
+	var none *Deduplicator
+	assert.True(t, none.Claim(key, DEFAULT_BACKEND, "component21"))
+	assert.True(t, none.Claim(key, DEFAULT_BACKEND, "component21"))
+	assert.False(t, none.Unchanged(DEFAULT_BACKEND, DEFAULT_BACKEND, 1, 4))
+}
+
+// the resends of Alertmanager never create duplicate incidents, even without squash_incident
+func TestDuplicateNotifications(t *testing.T) {
+	var lock sync.Mutex
+	events := make([]webhookEvent, 0)
+	failures := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		events = append(events, webhookEvent{})
+	}))
+	defer hook.Close()
+	countEvents := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(events)
+	}
+
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		Cachet:    NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+		Dedupe:    NewDeduplicator(time.Hour),
+	}
+	router := PrepareGinRouter(&config)
+
+	send := func(status, fingerprint, startsAt string) int {
+		jsonStr := []byte(`{"receiver":"cachethq-receiver","groupKey":"{}:{alertname=\"component21\"}","status":"` + status + `","alerts":[{"status":"` + status + `","fingerprint":"` + fingerprint + `","startsAt":"` + startsAt + `","labels":{"alertname":"component21"}}],"version":"4"}`)
+		req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// repeat_interval resend, and HA pair duplicate
+	assert.Equal(t, http.StatusOK, send("firing", "f1a2", "2026-10-18T20:00:00Z"))
+	assert.Equal(t, http.StatusOK, send("firing", "f1a2", "2026-10-18T20:00:00Z"))
+	assert.Equal(t, http.StatusOK, send("firing", "f1a2", "2026-10-18T20:00:00Z"))
+	assert.Equal(t, 1, countEvents())
+	assert.Equal(t, float64(2), config.Metrics.DuplicatesSkipped.Get(DEFAULT_BACKEND, DEFAULT_BACKEND))
+
+	// another alert of an already failing component is a no-op
+	assert.Equal(t, http.StatusOK, send("firing", "b3c4", "2026-10-18T20:01:00Z"))
+	assert.Equal(t, 1, countEvents())
+
+	assert.Equal(t, http.StatusOK, send("resolved", "f1a2", "2026-10-18T20:00:00Z"))
+	assert.Equal(t, http.StatusOK, send("resolved", "f1a2", "2026-10-18T20:00:00Z"))
+	assert.Equal(t, 2, countEvents())
+
+	// a failed notification is processed again when resent
+	lock.Lock()
+	failures = 1
+	lock.Unlock()
+	assert.Equal(t, http.StatusBadRequest, send("firing", "f1a2", "2026-10-18T21:00:00Z"))
+	assert.Equal(t, http.StatusOK, send("firing", "f1a2", "2026-10-18T21:00:00Z"))
+	assert.Equal(t, 3, countEvents())
+}
+
+// a new alert is forwarded if the status page was changed outside of the bridge since the last one
+func TestDuplicateNotificationsChangedPage(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	cachet := NewCachetImpl(fake.URL, "1234567890abcdef", fake.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+	config := PrometheusCachetConfig{
+		LabelName:      "alertname",
+		Cachet:         cachet,
+		SquashIncident: true,
+		Dedupe:         NewDeduplicator(time.Hour),
+	}
+	router := PrepareGinRouter(&config)
+
+	send := func(status, startsAt string) {
+		jsonStr := []byte(`{"receiver":"cachethq-receiver","status":"` + status + `","alerts":[{"status":"` + status + `","fingerprint":"f1a2","startsAt":"` + startsAt + `","labels":{"alertname":"component21"}}],"version":"4"}`)
+		req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send("firing", "2026-10-18T20:00:00Z")
+	assert.Equal(t, 1, len(fake.Incidents(0)))
+
+	// the incident is still open: the re-fire is a no-op
+	send("firing", "2026-10-18T20:05:00Z")
+	assert.Equal(t, 1, len(fake.Incidents(0)))
+	assert.Equal(t, float64(1), config.Metrics.DuplicatesSkipped.Get(DEFAULT_BACKEND, DEFAULT_BACKEND))
+
+	// fixed by hand in CachetHQ: the next re-fire opens an incident again
+	assert.Nil(t, cachet.UpdateIncident("component21", 1, fake.Incidents(0)[0].ID, 1, "fixed by hand"))
+	send("firing", "2026-10-18T20:10:00Z")
+	assert.Equal(t, 2, len(fake.Incidents(0)))
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+}
+
+// the notifications are claimed with the status of each alert, not of its group
+func TestDuplicateNotificationsAlertStatus(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		Cachet:    NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+		Dedupe:    NewDeduplicator(time.Hour),
+	}
+	router := PrepareGinRouter(&config)
+
+	send := func(status string) {
+		jsonStr := []byte(`{"receiver":"cachethq-receiver","groupKey":"{}:{}","status":"firing","alerts":[{"status":"` + status + `","fingerprint":"f1a2","startsAt":"2026-10-18T20:00:00Z","labels":{"alertname":"component21"}}],"version":"4"}`)
+		req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	send("firing")
+	send("resolved")
+	assert.False(t, config.Dedupe.Claim(DedupeKey(DEFAULT_BACKEND, DEFAULT_BACKEND, "{}:{}", "f1a2", "firing", "2026-10-18T20:00:00Z"), DEFAULT_BACKEND, "component21"))
+	assert.False(t, config.Dedupe.Claim(DedupeKey(DEFAULT_BACKEND, DEFAULT_BACKEND, "{}:{}", "f1a2", "resolved", "2026-10-18T20:00:00Z"), DEFAULT_BACKEND, "component21"))
+}
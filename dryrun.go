@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DEFAULT_DRY_RUN_HISTORY is the number of dry-run changes kept in memory
+const DEFAULT_DRY_RUN_HISTORY = 1000
+
+// DryRunChange is a change the bridge would have made on a status page
+type DryRunChange struct {
+	Time            time.Time `json:"time"`
+	Action          string    `json:"action"`
+	Tenant          string    `json:"tenant"`
+	Backend         string    `json:"backend"`
+	RequestID       string    `json:"request_id,omitempty"`
+	GroupKey        string    `json:"group_key,omitempty"`
+	Fingerprint     string    `json:"fingerprint,omitempty"`
+	Component       string    `json:"component"`
+	ComponentID     int       `json:"component_id"`
+	IncidentID      int       `json:"incident_id,omitempty"`
+	Status          int       `json:"status"`
+	ComponentStatus int       `json:"component_status"`
+	Message         string    `json:"message,omitempty"`
+}
+
+// DryRunRecorder keeps the last dry-run changes, served on /dryrun
+type DryRunRecorder struct {
+	lock    sync.Mutex
+	size    int
+	changes []DryRunChange // oldest first
+}
+
+func NewDryRunRecorder(size int) *DryRunRecorder {
+	if size <= 0 {
+		size = DEFAULT_DRY_RUN_HISTORY
+	}
+	return &DryRunRecorder{size: size}
+}
+
+// Record logs and keeps a change
+func (r *DryRunRecorder) Record(ctx context.Context, change DryRunChange) {
+	info := AlertInfoFrom(ctx)
+	change.Time = time.Now().UTC()
+	change.RequestID = RequestIDFrom(ctx)
+	change.GroupKey = info.GroupKey
+	change.Fingerprint = info.Fingerprint
+
+	// the context logger already knows the component and the backend
+	LoggerFrom(ctx).Info("dry-run: change not applied", "action", change.Action, "incident_id", change.IncidentID,
+		"status", change.Status, "component_status", change.ComponentStatus, "message", change.Message)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.changes = append(r.changes, change)
+	if len(r.changes) > r.size {
+		r.changes = append([]DryRunChange{}, r.changes[len(r.changes)-r.size:]...)
+	}
+}
+
+// Changes returns the last changes, the most recent first
+func (r *DryRunRecorder) Changes(limit int) []DryRunChange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	changes := make([]DryRunChange, 0, len(r.changes))
+	for i := len(r.changes) - 1; i >= 0 && (limit <= 0 || len(changes) < limit); i-- {
+		changes = append(changes, r.changes[i])
+	}
+	return changes
+}
+
+// Handler serves the last changes (limit query parameter, all by default)
+func (r *DryRunRecorder) Handler(c *gin.Context) {
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit: " + err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": r.Changes(limit)})
+}
+
+// dryRunCachet performs the reads on the wrapped backend, but only records the writes
+type dryRunCachet struct {
+	backend  Cachet
+	tenant   string
+	name     string
+	recorder *DryRunRecorder
+}
+
+// WithDryRun records the incidents creations and updates in the recorder, instead of
+// applying them on the backend
+func WithDryRun(backend Cachet, tenant, name string, recorder *DryRunRecorder) Cachet {
+	if backend == nil {
+		return nil
+	}
+	return &dryRunCachet{backend: backend, tenant: tenant, name: name, recorder: recorder}
+}
+
+func (d *dryRunCachet) PingContext(ctx context.Context) error {
+	return pingBackend(ctx, d.backend)
+}
+
+// CheckWriteContext does not reach the backend: in dry-run, nothing is written on the status page
+func (d *dryRunCachet) CheckWriteContext(ctx context.Context) error {
+	return nil
+}
+
+func (d *dryRunCachet) ListComponentsContext(ctx context.Context) (map[string]int, error) {
+	return d.backend.ListComponentsContext(ctx)
+}
+
+func (d *dryRunCachet) SearchComponentContext(ctx context.Context, name string) (int, error) {
+	return d.backend.SearchComponentContext(ctx, name)
+}
+
+func (d *dryRunCachet) ReadIncidentContext(ctx context.Context, incidentId int) (*CachetIncident, error) {
+	return d.backend.ReadIncidentContext(ctx, incidentId)
+}
+
+func (d *dryRunCachet) SearchIncidentsContext(ctx context.Context, componentId int) ([]*CachetIncident, error) {
+	return d.backend.SearchIncidentsContext(ctx, componentId)
+}
+
+func (d *dryRunCachet) CreateIncidentContext(ctx context.Context, componentName string, componentID, status int, componentStatus int) error {
+	incidentStatus, _ := incidentStatuses(status)
+	d.recorder.Record(ctx, DryRunChange{
+		Action:          AUDIT_INCIDENT_CREATED,
+		Tenant:          d.tenant,
+		Backend:         d.name,
+		Component:       componentName,
+		ComponentID:     componentID,
+		Status:          incidentStatus,
+		ComponentStatus: componentStatus,
+	})
+	return nil
+}
+
+func (d *dryRunCachet) UpdateIncidentContext(ctx context.Context, componentName string, componentID, incidentId, status int, message string) error {
+	incidentStatus, componentStatus := incidentStatuses(status)
+	d.recorder.Record(ctx, DryRunChange{
+		Action:          AUDIT_INCIDENT_UPDATED,
+		Tenant:          d.tenant,
+		Backend:         d.name,
+		Component:       componentName,
+		ComponentID:     componentID,
+		IncidentID:      incidentId,
+		Status:          incidentStatus,
+		ComponentStatus: componentStatus,
+		Message:         message,
+	})
+	return nil
+}
+
+func (d *dryRunCachet) WatchIncidentContext(ctx context.Context, componentName string, componentID, incidentId int, message string) error {
+	d.recorder.Record(ctx, DryRunChange{
+		Action:      AUDIT_INCIDENT_WATCHING,
+		Tenant:      d.tenant,
+		Backend:     d.name,
+		Component:   componentName,
+		ComponentID: componentID,
+		IncidentID:  incidentId,
+		Status:      3, // "Watching"
+		Message:     message,
+	})
+	return nil
+}
+
+// RouteBackend returns a backend by its name, recording its changes instead of applying
+// them for a dry-run route. It returns nil if the backend is unknown
+func (config *PrometheusCachetConfig) RouteBackend(name string, dryRun bool) Cachet {
+	backend := config.Backend(name)
+	if dryRun {
+		return WithDryRun(backend, config.TenantName(), name, config.DryRun)
+	}
+	return backend
+}
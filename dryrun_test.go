@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDryRunHook() (*httptest.Server, func() int) {
+	var lock sync.Mutex
+	calls := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+	}))
+	return hook, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return calls
+	}
+}
+
+func readDryRunChanges(t *testing.T, router http.Handler) []DryRunChange {
+	w := adminRequest(router, "GET", "/dryrun", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var answer struct {
+		Changes []DryRunChange `json:"changes"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &answer))
+	return answer.Changes
+}
+
+func TestDryRun(t *testing.T) {
+	hook, calls := newDryRunHook()
+	defer hook.Close()
+
+	recorder := NewDryRunRecorder(0)
+	config := PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "secret",
+		Cachet:          NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+		DryRun:          recorder,
+		Admin:           newTestAdminConsole(),
+	}
+	config.WrapBackends(func(tenant, name string, backend Cachet) Cachet {
+		return WithDryRun(backend, tenant, name, recorder)
+	})
+	router := PrepareGinRouter(&config)
+
+	sendTestAlert(t, router, "secret", "firing", "component21")
+	assert.Equal(t, 0, calls())
+
+	changes := readDryRunChanges(t, router)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, AUDIT_INCIDENT_CREATED, changes[0].Action)
+	assert.Equal(t, DEFAULT_BACKEND, changes[0].Backend)
+	assert.Equal(t, "component21", changes[0].Component)
+	assert.Equal(t, 2, changes[0].Status)
+	assert.Equal(t, "f1a2", changes[0].Fingerprint)
+	assert.Equal(t, `{}:{alertname="component21"}`, changes[0].GroupKey)
+
+	// the changes need the admin credentials
+	req := httptest.NewRequest("GET", "/dryrun", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestDryRunRoute(t *testing.T) {
+	hook, calls := newDryRunHook()
+	defer hook.Close()
+	beta, betaCalls := newDryRunHook()
+	defer beta.Close()
+
+	config := PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "secret",
+		Cachet:          NewWebhookImpl(hook.URL, []string{"component21", "component22"}, nil, hook.Client()),
+		Backends: map[string]Cachet{
+			"beta": NewWebhookImpl(beta.URL, []string{"component22"}, nil, beta.Client()),
+		},
+		Routes: []Route{{Match: map[string]string{"alertname": "component22"}, Backends: []string{DEFAULT_BACKEND, "beta"}, DryRun: true}},
+		Admin:  newTestAdminConsole(),
+	}
+	router := PrepareGinRouter(&config)
+
+	sendTestAlert(t, router, "secret", "firing", "component21")
+	assert.Equal(t, 1, calls())
+
+	sendTestAlert(t, router, "secret", "firing", "component22")
+	assert.Equal(t, 1, calls())
+	assert.Equal(t, 0, betaCalls())
+
+	changes := readDryRunChanges(t, router)
+	assert.Equal(t, 2, len(changes))
+	for _, change := range changes {
+		assert.Equal(t, "component22", change.Component)
+	}
+}
+
+func TestDryRunRecorderHistory(t *testing.T) {
+	recorder := NewDryRunRecorder(2)
+	for _, component := range []string{"api", "web", "db"} {
+		recorder.Record(context.Background(), DryRunChange{Component: component})
+	}
+	changes := recorder.Changes(0)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, "db", changes[0].Component)
+	assert.Equal(t, "web", changes[1].Component)
+	assert.Equal(t, 1, len(recorder.Changes(1)))
+}
+
+// the startup check does not write on the status page either
+func TestDryRunStartupCheck(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	cachet := NewCachetImpl(fake.URL, "1234567890abcdef", fake.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		Cachet:    WithDryRun(cachet, DEFAULT_BACKEND, DEFAULT_BACKEND, NewDryRunRecorder(0)),
+	}
+
+	assert.Nil(t, RunStartupCheck(STARTUP_CHECK_FATAL, &config))
+	for _, request := range fake.Requests() {
+		assert.True(t, strings.HasPrefix(request, "GET "), request)
+	}
+}
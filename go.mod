@@ -5,4 +5,5 @@ go 1.13
 require (
 	github.com/gin-gonic/gin v1.5.0
 	github.com/stretchr/testify v1.4.0
+	gopkg.in/yaml.v2 v2.2.2
 )
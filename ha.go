@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DEFAULT_HA_LEASE_DURATION is how long a leader keeps the lease without renewing it
+const DEFAULT_HA_LEASE_DURATION = 15 * time.Second
+
+// HA_FORWARDED_HEADER marks the webhooks forwarded by a follower (with its identity), that the
+// receiver processes without forwarding them again, if they are signed and it still leads
+const HA_FORWARDED_HEADER = "X-Prometheus-Cachethq-Forwarded-By"
+
+// HA_FORWARDED_AT_HEADER is the time (unix seconds) a webhook was forwarded at
+const HA_FORWARDED_AT_HEADER = "X-Prometheus-Cachethq-Forwarded-At"
+
+// HA_SIGNATURE_HEADER is the HMAC-SHA256 of a forwarded webhook, keyed by the secret shared by the replicas
+const HA_SIGNATURE_HEADER = "X-Prometheus-Cachethq-Signature"
+
+// HA_FORWARD_VALIDITY is how long a signed forwarded webhook is accepted (clock skew included)
+const HA_FORWARD_VALIDITY = time.Minute
+
+// LeaseRecord is the holder of a lease
+type LeaseRecord struct {
+	Holder       string    `json:"holder"`
+	AdvertiseURL string    `json:"advertise_url"`
+	RenewedAt    time.Time `json:"renewed_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Lease elects a leader among the bridge replicas
+type Lease interface {
+	// TryAcquire acquires or renews the lease if it is free, expired or already ours
+	TryAcquire() error
+	// Release frees the lease if we hold it
+	Release() error
+	// IsLeader returns true while we hold a lease not expired
+	IsLeader() bool
+	// Holder returns the last known holder of the lease
+	Holder() LeaseRecord
+}
+
+// FileLease is a Lease stored in a file shared by the replicas (i.e. a ReadWriteMany volume).
+// The updates are serialized by an exclusive lock on a lock file next to it
+type FileLease struct {
+	path         string
+	identity     string
+	advertiseURL string
+	duration     time.Duration
+
+	lock    sync.Mutex
+	leader  bool
+	current LeaseRecord
+}
+
+func NewFileLease(path, identity, advertiseURL string, duration time.Duration) *FileLease {
+	if duration <= 0 {
+		duration = DEFAULT_HA_LEASE_DURATION
+	}
+	return &FileLease{
+		path:         path,
+		identity:     identity,
+		advertiseURL: advertiseURL,
+		duration:     duration,
+	}
+}
+
+// lockFile takes the exclusive lock (flock) of the lock file. The lock file is never removed: the
+// kernel releases the lock of a dead replica, without any stale lock file to detect
+func (l *FileLease) lockFile() (func(), error) {
+	f, err := os.OpenFile(l.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("lease %s is being updated by another replica", l.path)
+		}
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (l *FileLease) read() (LeaseRecord, error) {
+	var record LeaseRecord
+	content, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) || (err == nil && len(content) == 0) {
+		return record, nil
+	}
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(content, &record); err != nil {
+		return record, fmt.Errorf("%s: %v", l.path, err)
+	}
+	return record, nil
+}
+
+func (l *FileLease) write(record LeaseRecord) error {
+	content, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+func (l *FileLease) TryAcquire() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	unlock, err := l.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record, err := l.read()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if record.Holder != "" && record.Holder != l.identity && now.Before(record.ExpiresAt) {
+		l.leader = false
+		l.current = record
+		return nil
+	}
+
+	record = LeaseRecord{
+		Holder:       l.identity,
+		AdvertiseURL: l.advertiseURL,
+		RenewedAt:    now,
+		ExpiresAt:    now.Add(l.duration),
+	}
+	if err := l.write(record); err != nil {
+		return err
+	}
+	l.leader = true
+	l.current = record
+	return nil
+}
+
+func (l *FileLease) Release() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.leader {
+		return nil
+	}
+	l.leader = false
+
+	unlock, err := l.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record, err := l.read()
+	if err != nil || record.Holder != l.identity {
+		return err
+	}
+	record.ExpiresAt = time.Now()
+	l.current = record
+	return l.write(record)
+}
+
+func (l *FileLease) IsLeader() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// a leader unable to renew its lease steps down when it expires
+	return l.leader && time.Now().Before(l.current.ExpiresAt)
+}
+
+func (l *FileLease) Holder() LeaseRecord {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.current
+}
+
+// HighAvailability makes only the leader replica write on the status pages:
+// the followers forward the webhooks they receive to the leader
+type HighAvailability struct {
+	lease    Lease
+	identity string
+	secret   []byte
+	client   *http.Client
+	metrics  *BridgeMetrics
+	elected  []func()
+}
+
+// NewHighAvailability creates the HA mode of a replica: the secret (shared by the replicas)
+// authenticates the webhooks forwarded between them
+func NewHighAvailability(lease Lease, identity, secret string, client *http.Client, metrics *BridgeMetrics) *HighAvailability {
+	return &HighAvailability{
+		lease:    lease,
+		identity: identity,
+		secret:   []byte(secret),
+		client:   client,
+		metrics:  metrics,
+	}
+}
+
+// IsLeader returns true if this replica writes on the status pages (always without HA)
+func (h *HighAvailability) IsLeader() bool {
+	if h == nil {
+		return true
+	}
+	return h.lease.IsLeader()
+}
+
+// Elect tries to acquire (or renew) the lease, and logs the role changes
+func (h *HighAvailability) Elect() {
+	wasLeader := h.lease.IsLeader()
+	if err := h.lease.TryAcquire(); err != nil {
+		DefaultLogger().Warn("unable to acquire the lease", "error", err)
+	}
+
+	leader := h.lease.IsLeader()
+	if leader != wasLeader {
+		if leader {
+			DefaultLogger().Info("elected as leader", "identity", h.identity)
+			for _, fn := range h.elected {
+				fn()
+			}
+		} else {
+			DefaultLogger().Info("following the leader", "identity", h.identity, "leader", h.lease.Holder().Holder)
+		}
+	}
+	if leader {
+		h.metrics.Leader.Set(1)
+	} else {
+		h.metrics.Leader.Set(0)
+	}
+}
+
+// OnElected registers a function called when this replica becomes the leader (before Run)
+func (h *HighAvailability) OnElected(fn func()) {
+	h.elected = append(h.elected, fn)
+}
+
+// Run renews (or tries to acquire) the lease every interval, until stop is closed
+func (h *HighAvailability) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.Elect()
+		}
+	}
+}
+
+// Release frees the lease at shutdown, so a follower takes over without waiting for its expiry
+func (h *HighAvailability) Release() {
+	if err := h.lease.Release(); err != nil {
+		DefaultLogger().Warn("unable to release the lease", "error", err)
+	}
+	h.metrics.Leader.Set(0)
+}
+
+// sign returns the signature of a webhook forwarded by a replica
+func (h *HighAvailability) sign(peer, forwardedAt, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, h.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s %s\n", peer, forwardedAt, method, uri)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// receive checks a webhook forwarded by a follower, and returns true if it was answered: it is
+// only processed if signed by another replica, recently, and while we lead
+func (h *HighAvailability) receive(c *gin.Context) bool {
+	logger := LoggerFrom(c.Request.Context())
+	peer := c.GetHeader(HA_FORWARDED_HEADER)
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return true
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	forwardedAt := c.GetHeader(HA_FORWARDED_AT_HEADER)
+	valid := false
+	if seconds, err := strconv.ParseInt(forwardedAt, 10, 64); err == nil && peer != h.identity {
+		age := time.Since(time.Unix(seconds, 0))
+		expected := h.sign(peer, forwardedAt, c.Request.Method, c.Request.URL.RequestURI(), body)
+		valid = age < HA_FORWARD_VALIDITY && age > -HA_FORWARD_VALIDITY &&
+			hmac.Equal([]byte(expected), []byte(c.GetHeader(HA_SIGNATURE_HEADER)))
+	}
+	if !valid {
+		logger.Warn("forwarded webhook with an invalid signature rejected", "forwarded_by", peer, "client_ip", c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "invalid forwarded webhook signature"})
+		return true
+	}
+
+	// the leadership may have been lost since the follower read the lease
+	if !h.lease.IsLeader() {
+		logger.Warn("forwarded webhook received while not leading", "forwarded_by", peer)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "not the leader"})
+		return true
+	}
+	return false
+}
+
+// Forward sends the webhook to the leader if we are a follower, and returns true if
+// the request was answered. Webhooks already forwarded are processed locally, if authenticated
+func (h *HighAvailability) Forward(c *gin.Context) bool {
+	if h == nil {
+		return false
+	}
+	if c.GetHeader(HA_FORWARDED_HEADER) != "" {
+		return h.receive(c)
+	}
+	if h.lease.IsLeader() {
+		return false
+	}
+	logger := LoggerFrom(c.Request.Context())
+
+	holder := h.lease.Holder()
+	if holder.AdvertiseURL == "" || !time.Now().Before(holder.ExpiresAt) {
+		logger.Warn("no leader to forward the webhook to")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no leader elected"})
+		return true
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return true
+	}
+
+	uri := c.Request.URL.RequestURI()
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, strings.TrimRight(holder.AdvertiseURL, "/")+uri, bytes.NewReader(body))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return true
+	}
+	for _, name := range []string{"Content-Type", "Authorization", "X-Request-Id", "traceparent"} {
+		if value := c.GetHeader(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	forwardedAt := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(HA_FORWARDED_HEADER, h.identity)
+	req.Header.Set(HA_FORWARDED_AT_HEADER, forwardedAt)
+	req.Header.Set(HA_SIGNATURE_HEADER, h.sign(h.identity, forwardedAt, c.Request.Method, uri, body))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		logger.Warn("unable to forward the webhook to the leader", "leader", holder.Holder, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("leader %s unreachable", holder.Holder)})
+		return true
+	}
+	defer resp.Body.Close()
+
+	answer, _ := ioutil.ReadAll(resp.Body)
+	logger.Debug("webhook forwarded to the leader", "leader", holder.Holder, "status", resp.StatusCode)
+	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), answer)
+	return true
+}
+
+// Middleware forwards the requests to the leader if we are a follower (see Forward)
+func (h *HighAvailability) Middleware(c *gin.Context) {
+	if h.Forward(c) {
+		c.Abort()
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lease.json")
+
+	a := NewFileLease(path, "a", "http://a:8080", 100*time.Millisecond)
+	b := NewFileLease(path, "b", "http://b:8080", 100*time.Millisecond)
+
+	assert.Nil(t, a.TryAcquire())
+	assert.True(t, a.IsLeader())
+	assert.Nil(t, b.TryAcquire())
+	assert.False(t, b.IsLeader())
+	assert.Equal(t, "a", b.Holder().Holder)
+	assert.Equal(t, "http://a:8080", b.Holder().AdvertiseURL)
+
+	// released at shutdown: taken over right away
+	assert.Nil(t, a.Release())
+	assert.False(t, a.IsLeader())
+	assert.Nil(t, b.TryAcquire())
+	assert.True(t, b.IsLeader())
+
+	// the leader dies: taken over once the lease expired
+	assert.Nil(t, a.TryAcquire())
+	assert.False(t, a.IsLeader())
+	time.Sleep(150 * time.Millisecond)
+	assert.False(t, b.IsLeader())
+	assert.Nil(t, a.TryAcquire())
+	assert.True(t, a.IsLeader())
+
+	// the lease is not updated while another replica holds the lock
+	unlock, err := b.lockFile()
+	assert.Nil(t, err)
+	assert.NotNil(t, a.TryAcquire())
+	unlock()
+	assert.Nil(t, a.TryAcquire())
+	assert.True(t, a.IsLeader())
+}
+
+// only the leader writes on the status page, the follower forwards it the webhooks
+func TestHAForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lease.json")
+
+	var lock sync.Mutex
+	events := make(map[string]int)
+	newReplica := func(name string) (*PrometheusCachetConfig, *httptest.Server) {
+		hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			events[name]++
+		}))
+		config := &PrometheusCachetConfig{
+			LabelName:       "alertname",
+			PrometheusToken: "secret",
+			Cachet:          NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+			Metrics:         NewBridgeMetrics(),
+		}
+		server := httptest.NewServer(PrepareGinRouter(config))
+		config.HA = NewHighAvailability(NewFileLease(path, name, server.URL, time.Minute), name, "haSecret", server.Client(), config.Metrics)
+		return config, server
+	}
+	countEvents := func(name string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return events[name]
+	}
+
+	leader, leaderServer := newReplica("leader")
+	defer leaderServer.Close()
+	follower, followerServer := newReplica("follower")
+	defer followerServer.Close()
+
+	send := func(token string) int {
+		jsonStr := []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}`)
+		req, _ := http.NewRequest("POST", followerServer.URL+"/alert", bytes.NewBuffer(jsonStr))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// no leader known yet: Alertmanager is to retry
+	assert.Equal(t, http.StatusServiceUnavailable, send("secret"))
+
+	leader.HA.Elect()
+	follower.HA.Elect()
+	assert.Equal(t, float64(1), leader.Metrics.Leader.Get())
+	assert.Equal(t, float64(0), follower.Metrics.Leader.Get())
+
+	// the follower checks the token before forwarding
+	assert.Equal(t, http.StatusUnauthorized, send("wrong"))
+	assert.Equal(t, 0, countEvents("leader"))
+
+	assert.Equal(t, http.StatusOK, send("secret"))
+	assert.Equal(t, 1, countEvents("leader"))
+	assert.Equal(t, 0, countEvents("follower"))
+
+	// a client pretending to forward cannot make the follower write
+	forward := func(peer, signature string) int {
+		jsonStr := []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}`)
+		forwardedAt := strconv.FormatInt(time.Now().Unix(), 10)
+		if signature == "" {
+			signature = leader.HA.sign(peer, forwardedAt, "POST", "/alert", jsonStr)
+		}
+		req, _ := http.NewRequest("POST", followerServer.URL+"/alert", bytes.NewBuffer(jsonStr))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set(HA_FORWARDED_HEADER, peer)
+		req.Header.Set(HA_FORWARDED_AT_HEADER, forwardedAt)
+		req.Header.Set(HA_SIGNATURE_HEADER, signature)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusForbidden, forward("leader", "forged"))
+	assert.Equal(t, http.StatusForbidden, forward("follower", ""))
+	// signed by a replica, but the follower does not lead (anymore): to retry
+	assert.Equal(t, http.StatusServiceUnavailable, forward("leader", ""))
+	assert.Equal(t, 0, countEvents("follower"))
+
+	// the leader stops: no leader until the follower takes over
+	leader.HA.Release()
+	follower.HA.Elect()
+	assert.Equal(t, http.StatusOK, send("secret"))
+	assert.Equal(t, 1, countEvents("leader"))
+	assert.Equal(t, 1, countEvents("follower"))
+}
+
+// the overrides are held by the leader, and taken over by the next one from the file shared by the replicas
+func TestHAOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	events := make(map[string]int)
+	newReplica := func(name string) (*PrometheusCachetConfig, *httptest.Server) {
+		hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			events[name]++
+		}))
+		var router http.Handler
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			router.ServeHTTP(w, r)
+		}))
+		auth, _ := NewAuthenticator("admin", []string{"adminToken"}, nil, nil)
+		overrides, err := NewOverrides(filepath.Join(dir, "overrides.json"))
+		assert.Nil(t, err)
+		config := &PrometheusCachetConfig{
+			LabelName: "alertname",
+			Cachet:    NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+			Metrics:   NewBridgeMetrics(),
+			Admin:     NewAdminConsole(auth, 0),
+			Overrides: overrides,
+		}
+		config.HA = NewHighAvailability(NewFileLease(filepath.Join(dir, "lease.json"), name, server.URL, time.Minute), name, "haSecret", server.Client(), config.Metrics)
+		config.HA.OnElected(overrides.Reload)
+		router = PrepareGinRouter(config)
+		return config, server
+	}
+	countEvents := func(name string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return events[name]
+	}
+
+	leader, leaderServer := newReplica("leader")
+	defer leaderServer.Close()
+	follower, followerServer := newReplica("follower")
+	defer followerServer.Close()
+	leader.HA.Elect()
+	follower.HA.Elect()
+
+	// set on the follower, applied by the leader
+	w := overrideRequest(followerServer.Config.Handler, "PUT", "component21", `{"status":"outage","reason":"maintenance","duration":"1h"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotNil(t, leader.Overrides.Get(DEFAULT_BACKEND, "component21"))
+	assert.Nil(t, follower.Overrides.Get(DEFAULT_BACKEND, "component21"))
+	assert.Equal(t, 1, countEvents("leader"))
+	assert.Equal(t, 0, countEvents("follower"))
+	w = overrideRequest(followerServer.Config.Handler, "GET", "component21", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the next leader knows the override
+	leader.HA.Release()
+	follower.HA.Elect()
+	assert.NotNil(t, follower.Overrides.Get(DEFAULT_BACKEND, "component21"))
+	w = overrideRequest(followerServer.Config.Handler, "DELETE", "component21", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Nil(t, follower.Overrides.Get(DEFAULT_BACKEND, "component21"))
+}
+
+// the admin actions are not applied by a follower
+func TestHAAdminActions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lease.json")
+
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	config := newOverridesConfig(fake)
+	config.HA = NewHighAvailability(NewFileLease(path, "follower", "http://follower:8080", time.Minute), "follower", "haSecret", http.DefaultClient, NewBridgeMetrics())
+	router := PrepareGinRouter(config)
+
+	// the leader has not published its URL: the action is to be retried
+	assert.Nil(t, NewFileLease(path, "leader", "", time.Minute).TryAcquire())
+	config.HA.Elect()
+	for _, action := range []string{"resolve", "resync"} {
+		req := httptest.NewRequest("POST", "/admin/api/"+action, bytes.NewBufferString(`{"component":"component21"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer adminToken")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, action)
+	}
+	assert.Equal(t, 0, lastIncidentStatus(fake))
+}
+
+// the hold-down changes pending on the previous leader are applied by the next one
+func TestHAHoldDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	newReplica := func(name string) (*PrometheusCachetConfig, *holdDownHook, http.Handler) {
+		hook := newHoldDownHook()
+		holdDown, err := NewHoldDown(filepath.Join(dir, "holddown.json"))
+		assert.Nil(t, err)
+		config := newHoldDownConfig(hook, holdDown, HoldDownPolicy{FireAfter: 200 * time.Millisecond})
+		config.HA = NewHighAvailability(NewFileLease(filepath.Join(dir, "lease.json"), name, "http://"+name+":8080", time.Minute), name, "haSecret", http.DefaultClient, NewBridgeMetrics())
+		config.HA.OnElected(holdDown.Reload)
+		return config, hook, PrepareGinRouter(config)
+	}
+
+	leader, leaderHook, leaderRouter := newReplica("leader")
+	defer leaderHook.Close()
+	defer leader.HoldDown.Close()
+	follower, followerHook, _ := newReplica("follower")
+	defer followerHook.Close()
+	defer follower.HoldDown.Close()
+	leader.HA.Elect()
+	follower.HA.Elect()
+
+	sendTestAlert(t, leaderRouter, "", "firing", "component21")
+	leader.HA.Release()
+	follower.HA.Elect()
+	assert.True(t, follower.HA.IsLeader())
+
+	// dropped by the previous leader, applied by the next one
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, len(leaderHook.Events()))
+	events := followerHook.Events()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "incident_created", events[0].Event)
+	leader.HoldDown.lock.Lock()
+	assert.Equal(t, 0, len(leader.HoldDown.states))
+	leader.HoldDown.lock.Unlock()
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DEFAULT_HOLD_DOWN_RETRY is the delay before retrying a delayed transition the backend refused
+const DEFAULT_HOLD_DOWN_RETRY = 30 * time.Second
+
+// DEFAULT_HOLD_DOWN_RETRIES is how many times a delayed transition is retried before being dropped
+const DEFAULT_HOLD_DOWN_RETRIES = 5
+
+const (
+	HOLD_DOWN_FORWARDED = "forwarded"
+	HOLD_DOWN_DELAYED   = "delayed"
+	HOLD_DOWN_CANCELLED = "cancelled"
+	HOLD_DOWN_FLAPPING  = "flapping"
+	HOLD_DOWN_UNCHANGED = "unchanged"
+)
+
+// HoldDownPolicy are the timers of a route:
+// - FireAfter: the incident is only opened once the alert has been firing for this long
+// - ResolveAfter: the incident is only resolved once the alert has stayed resolved for this long
+// - FlapWindow: an alert firing again less than this after being resolved is flapping: the
+// incident stays open (noted as flapping), and is resolved once the alert stayed resolved that long
+type HoldDownPolicy struct {
+	FireAfter    time.Duration
+	ResolveAfter time.Duration
+	FlapWindow   time.Duration
+}
+
+// Enabled returns true if the alerts are not forwarded as is
+func (p HoldDownPolicy) Enabled() bool {
+	return p.FireAfter > 0 || p.ResolveAfter > 0 || p.FlapWindow > 0
+}
+
+func (p HoldDownPolicy) resolveDelay() time.Duration {
+	if p.FlapWindow > p.ResolveAfter {
+		return p.FlapWindow
+	}
+	return p.ResolveAfter
+}
+
+// HoldDownState is the status of a component on a backend, as persisted in the state file
+type HoldDownState struct {
+	Tenant      string `json:"tenant"`
+	Backend     string `json:"backend"`
+	Component   string `json:"component"`
+	ComponentID int    `json:"component_id"`
+	GroupKey    string `json:"group_key,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Firing is the last status received from Alertmanager
+	Firing bool `json:"firing"`
+	// Open is true if the incident is open on the status page
+	Open bool `json:"open"`
+	// Pending is true if the status page must follow Firing at DueAt
+	Pending  bool      `json:"pending"`
+	DueAt    time.Time `json:"due_at"`
+	Attempts int       `json:"attempts,omitempty"`
+	Flapping bool      `json:"flapping"`
+	Flaps    int       `json:"flaps"`
+	// DryRun records the transitions instead of applying them (dry-run route)
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// op serializes the changes of this component (they may call the backend)
+	op    sync.Mutex
+	timer *time.Timer
+}
+
+func (s *HoldDownState) key() string {
+	return holdDownKey(s.Tenant, s.Backend, s.ComponentID)
+}
+
+func holdDownKey(tenant, backend string, componentID int) string {
+	return fmt.Sprintf("%s/%s/%d", tenant, backend, componentID)
+}
+
+type holdDownFile struct {
+	States []*HoldDownState `json:"states"`
+}
+
+// HoldDown delays the incidents opening and resolution of the routes having a
+// HoldDownPolicy. The pending transitions are scheduled in memory, and saved in the
+// (optional) state file, to be scheduled again after a restart. In HA mode, the file
+// is shared by the replicas: only the leader writes it, the next leader loading it
+type HoldDown struct {
+	path    string
+	lock    sync.Mutex
+	states  map[string]*HoldDownState
+	configs map[string]*PrometheusCachetConfig
+	ha      *HighAvailability
+	closed  bool
+}
+
+// NewHoldDown loads the states saved in path (if any). An empty path keeps them in memory only
+func NewHoldDown(path string) (*HoldDown, error) {
+	h := &HoldDown{
+		path:    path,
+		states:  make(map[string]*HoldDownState),
+		configs: make(map[string]*PrometheusCachetConfig),
+	}
+	states, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		h.states[state.key()] = state
+	}
+	return h, nil
+}
+
+// load reads the states saved in the state file
+func (h *HoldDown) load() ([]*HoldDownState, error) {
+	if h.path == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file holdDownFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", h.path, err)
+	}
+	return file.States, nil
+}
+
+// Reload replaces the states by the ones saved in the state file, when this replica becomes the
+// leader: the file shared by the replicas holds the transitions pending on the previous leader
+func (h *HoldDown) Reload() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.path == "" {
+		return
+	}
+	states, err := h.load()
+	if err != nil {
+		DefaultLogger().Error("unable to reload the hold-down state", "file", h.path, "error", err)
+		return
+	}
+	for _, state := range h.states {
+		if state.timer != nil {
+			state.timer.Stop()
+			state.timer = nil
+		}
+	}
+	h.states = make(map[string]*HoldDownState)
+	for _, state := range states {
+		h.states[state.key()] = state
+		if _, ok := h.configs[state.Tenant]; ok && state.Pending {
+			h.schedule(state, time.Until(state.DueAt))
+		}
+	}
+}
+
+// Register makes the tenant backends available to the delayed transitions,
+// and schedules again the transitions of this tenant loaded from the state file
+func (h *HoldDown) Register(config *PrometheusCachetConfig) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	tenant := config.TenantName()
+	h.configs[tenant] = config
+	h.ha = config.HA
+	for _, state := range h.states {
+		if state.Tenant == tenant && state.Pending && state.timer == nil {
+			h.schedule(state, time.Until(state.DueAt))
+		}
+	}
+}
+
+// schedule arms the timer of a pending transition (h.lock must be held)
+func (h *HoldDown) schedule(state *HoldDownState, delay time.Duration) {
+	if h.closed {
+		return
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+	state.timer = time.AfterFunc(delay, func() {
+		h.run(state)
+	})
+}
+
+// cancel disarms the pending transition (h.lock must be held)
+func (h *HoldDown) cancel(state *HoldDownState) {
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	state.Pending = false
+	state.Attempts = 0
+}
+
+// Submit handles the status of a component received from Alertmanager, and returns the
+// action taken. The error is the one of the backend, if the status page was updated now
+func (h *HoldDown) Submit(ctx context.Context, config *PrometheusCachetConfig, policy HoldDownPolicy, backendName string, dryRun bool, componentName string, componentID int, firing bool) (string, error) {
+	tenant := config.TenantName()
+	key := holdDownKey(tenant, backendName, componentID)
+
+	state := h.lockState(key, tenant, backendName, componentName, componentID, firing)
+	defer state.op.Unlock()
+
+	info := AlertInfoFrom(ctx)
+	state.Firing = firing
+	state.GroupKey = info.GroupKey
+	state.Fingerprint = info.Fingerprint
+	state.DryRun = dryRun
+
+	if firing == state.Open {
+		if !state.Pending {
+			h.lock.Unlock()
+			return HOLD_DOWN_UNCHANGED, nil
+		}
+		// back to the status of the status page before the delay expired
+		h.cancel(state)
+		config.Metrics.HoldDownSuppressed.Inc(tenant, backendName)
+		if !firing {
+			h.forget(state)
+			h.save()
+			h.lock.Unlock()
+			return HOLD_DOWN_CANCELLED, nil
+		}
+		state.Flaps++
+		if policy.FlapWindow <= 0 || state.Flapping {
+			h.save()
+			h.lock.Unlock()
+			return HOLD_DOWN_CANCELLED, nil
+		}
+		state.Flapping = true
+		h.save()
+		h.lock.Unlock()
+
+		return HOLD_DOWN_FLAPPING, noteFlapping(ctx, config, config.RouteBackend(backendName, dryRun), componentName, componentID)
+	}
+
+	if state.Pending {
+		// the delay runs from the first webhook
+		h.lock.Unlock()
+		return HOLD_DOWN_DELAYED, nil
+	}
+
+	delay := policy.FireAfter
+	if !firing {
+		delay = policy.resolveDelay()
+	}
+	if delay > 0 {
+		state.Pending = true
+		state.DueAt = time.Now().Add(delay)
+		h.schedule(state, delay)
+		h.save()
+		h.lock.Unlock()
+		return HOLD_DOWN_DELAYED, nil
+	}
+	h.lock.Unlock()
+
+	err := forwardAlert(ctx, config, config.RouteBackend(backendName, dryRun), componentName, componentID, alertStatus(firing), alertStatus(firing))
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err == nil {
+		h.transitioned(state)
+	}
+	h.save()
+	return HOLD_DOWN_FORWARDED, err
+}
+
+// lockState returns the state of a component, locked for an operation, with h.lock held
+func (h *HoldDown) lockState(key, tenant, backendName, componentName string, componentID int, firing bool) *HoldDownState {
+	for {
+		h.lock.Lock()
+		state, ok := h.states[key]
+		if !ok {
+			// without history, a resolution is forwarded: an incident may have been opened before
+			state = &HoldDownState{
+				Tenant:      tenant,
+				Backend:     backendName,
+				Component:   componentName,
+				ComponentID: componentID,
+				Open:        !firing,
+			}
+			h.states[key] = state
+		}
+		h.lock.Unlock()
+
+		state.op.Lock()
+		h.lock.Lock()
+		// the state may have been forgotten while we were waiting
+		if h.states[key] == state {
+			return state
+		}
+		h.lock.Unlock()
+		state.op.Unlock()
+	}
+}
+
+// transitioned records the status page now follows the alert (h.lock must be held)
+func (h *HoldDown) transitioned(state *HoldDownState) {
+	state.Open = state.Firing
+	state.Pending = false
+	state.Attempts = 0
+	state.timer = nil
+	if !state.Open {
+		state.Flapping = false
+		state.Flaps = 0
+		h.forget(state)
+	}
+}
+
+// forget removes a resolved component without pending transition (h.lock must be held)
+func (h *HoldDown) forget(state *HoldDownState) {
+	if !state.Open && !state.Pending && h.states[state.key()] == state {
+		delete(h.states, state.key())
+	}
+}
+
+// run applies a delayed transition, when its timer expires
+func (h *HoldDown) run(state *HoldDownState) {
+	state.op.Lock()
+	defer state.op.Unlock()
+
+	h.lock.Lock()
+	config := h.configs[state.Tenant]
+	// a transition cancelled then scheduled again has its own timer
+	if !state.Pending || time.Now().Before(state.DueAt) || h.closed || config == nil {
+		h.lock.Unlock()
+		return
+	}
+	h.lock.Unlock()
+
+	// only the leader writes on the status pages: the transition is dropped, the next leader
+	// loading the pending transitions from the state file shared by the replicas
+	if !config.HA.IsLeader() {
+		DefaultLogger().Warn("hold-down transition dropped: not the leader anymore", "tenant", state.Tenant, "component", state.Component, "backend", state.Backend, "firing", state.Firing)
+		h.lock.Lock()
+		state.Firing = state.Open
+		h.cancel(state)
+		h.forget(state)
+		h.lock.Unlock()
+		return
+	}
+
+	// the shutdown waits for the transitions being applied, the later ones stay in the state file
+	if !config.Lifecycle.Begin() {
+		return
+	}
+	defer config.Lifecycle.End()
+
+	logger := DefaultLogger().With("tenant", state.Tenant, "group_key", state.GroupKey, "fingerprint", state.Fingerprint, "component", state.Component, "backend", state.Backend)
+
+	// a manual override set during the delay pins the status of the component: the transition is
+	// dropped, the override remembering the alert status to apply it when it ends
+	if config.Overrides.Overridden(state.Tenant, state.Component, state.Firing) {
+		logger.Info("alert not forwarded after hold-down: component overridden", "firing", state.Firing)
+		config.Metrics.AlertsOverridden.Inc(state.Tenant)
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		state.Firing = state.Open
+		h.cancel(state)
+		h.forget(state)
+		h.save()
+		return
+	}
+
+	ctx := WithLogger(context.Background(), logger)
+	if config.AlertTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.AlertTimeout)
+		defer cancel()
+	}
+	ctx, span := config.Tracer.Start(ctx, "hold-down transition", SPAN_KIND_INTERNAL, "")
+	span.SetAttribute("alert.fingerprint", state.Fingerprint)
+	span.SetAttribute("alert.component", state.Component)
+	span.SetAttribute("alert.backends", state.Backend)
+	ctx = WithAlertInfo(ctx, AlertInfo{GroupKey: state.GroupKey, Fingerprint: state.Fingerprint})
+
+	var err error
+	backend := config.RouteBackend(state.Backend, state.DryRun)
+	if backend == nil {
+		err = fmt.Errorf("unknown backend")
+	} else {
+		err = forwardAlert(ctx, config, backend, state.Component, state.ComponentID, alertStatus(state.Firing), alertStatus(state.Firing))
+	}
+	span.SetError(err)
+	span.End()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err == nil {
+		logger.Info("alert forwarded after hold-down", "firing", state.Firing)
+		config.Metrics.IncidentsForwarded.Inc(state.Tenant, state.Backend)
+		h.transitioned(state)
+	} else {
+		config.Metrics.BackendErrors.Inc(state.Tenant, state.Backend)
+		state.Attempts++
+		if state.Attempts >= DEFAULT_HOLD_DOWN_RETRIES || backend == nil {
+			logger.Error("unable to forward the alert after hold-down, giving up", "error", err, "attempts", state.Attempts)
+			state.Firing = state.Open
+			h.cancel(state)
+			h.forget(state)
+		} else {
+			logger.Warn("unable to forward the alert after hold-down, will retry", "error", err, "attempts", state.Attempts)
+			state.DueAt = time.Now().Add(DEFAULT_HOLD_DOWN_RETRY)
+			h.schedule(state, DEFAULT_HOLD_DOWN_RETRY)
+		}
+	}
+	h.save()
+}
+
+// noteFlapping adds a note on the open incident of a flapping component
+func noteFlapping(ctx context.Context, config *PrometheusCachetConfig, backend Cachet, componentName string, componentID int) error {
+	if backend == nil {
+		return fmt.Errorf("unknown backend")
+	}
+	incidents, err := backend.SearchIncidentsContext(ctx, componentID)
+	if err != nil {
+		return err
+	}
+	if len(incidents) == 0 || incidents[0].Status == 4 {
+		return fmt.Errorf("No open incident found for component %d\n", componentID)
+	}
+	return backend.UpdateIncidentContext(ctx, componentName, componentID, incidents[0].Id, 4, fmt.Sprintf("Prometheus flagged service %s as flapping", componentName))
+}
+
+// alertStatus converts a firing flag into the alert status of forwardAlert
+func alertStatus(firing bool) int {
+	if firing {
+		return 4
+	}
+	return 1
+}
+
+// save writes the states in the state file (h.lock must be held)
+func (h *HoldDown) save() {
+	if h.path == "" || !h.ha.IsLeader() {
+		return
+	}
+	file := holdDownFile{States: make([]*HoldDownState, 0, len(h.states))}
+	for _, state := range h.states {
+		file.States = append(file.States, state)
+	}
+	sort.Slice(file.States, func(i, j int) bool { return file.States[i].key() < file.States[j].key() })
+
+	content, err := json.Marshal(&file)
+	if err == nil {
+		// write then rename, not to leave a truncated file behind
+		tmp := h.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, content, 0600); err == nil {
+			err = os.Rename(tmp, h.path)
+		}
+	}
+	if err != nil {
+		DefaultLogger().Error("unable to save the hold-down state", "file", h.path, "error", err)
+	}
+}
+
+// Close stops the timers and saves the states, the pending transitions being
+// scheduled again at the next start
+func (h *HoldDown) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closed = true
+	for _, state := range h.states {
+		if state.timer != nil {
+			state.timer.Stop()
+			state.timer = nil
+		}
+	}
+	h.save()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// holdDownHook records the events POSTed by a webhook backend
+type holdDownHook struct {
+	*httptest.Server
+	lock   sync.Mutex
+	events []webhookEvent
+}
+
+func newHoldDownHook() *holdDownHook {
+	hook := &holdDownHook{}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		hook.lock.Lock()
+		defer hook.lock.Unlock()
+		hook.events = append(hook.events, event)
+	}))
+	return hook
+}
+
+func (hook *holdDownHook) Events() []webhookEvent {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	return append([]webhookEvent{}, hook.events...)
+}
+
+func newHoldDownConfig(hook *holdDownHook, holdDown *HoldDown, policy HoldDownPolicy) *PrometheusCachetConfig {
+	return &PrometheusCachetConfig{
+		LabelName:      "alertname",
+		SquashIncident: true,
+		Cachet:         NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+		Routes:         []Route{{Match: map[string]string{"alertname": "component21"}, Backends: []string{DEFAULT_BACKEND}, HoldDown: policy}},
+		HoldDown:       holdDown,
+	}
+}
+
+func TestHoldDownFireAfter(t *testing.T) {
+	hook := newHoldDownHook()
+	defer hook.Close()
+
+	config := newHoldDownConfig(hook, nil, HoldDownPolicy{FireAfter: 100 * time.Millisecond, ResolveAfter: 100 * time.Millisecond})
+	router := PrepareGinRouter(config)
+
+	// a blip shorter than fire_after is ignored
+	sendTestAlert(t, router, "", "firing", "component21")
+	sendTestAlert(t, router, "", "resolved", "component21")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 0, len(hook.Events()))
+	assert.Equal(t, float64(1), config.Metrics.HoldDownSuppressed.Get(DEFAULT_BACKEND, DEFAULT_BACKEND))
+
+	// the incident is opened once the alert has been firing for fire_after
+	sendTestAlert(t, router, "", "firing", "component21")
+	sendTestAlert(t, router, "", "firing", "component21")
+	assert.Equal(t, 0, len(hook.Events()))
+	time.Sleep(200 * time.Millisecond)
+	events := hook.Events()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "incident_created", events[0].Event)
+	assert.Equal(t, float64(1), config.Metrics.IncidentsForwarded.Get(DEFAULT_BACKEND, DEFAULT_BACKEND))
+
+	// and resolved once it stayed resolved for resolve_after
+	sendTestAlert(t, router, "", "resolved", "component21")
+	assert.Equal(t, 1, len(hook.Events()))
+	time.Sleep(200 * time.Millisecond)
+	events = hook.Events()
+	assert.True(t, len(events) > 1)
+	assert.Equal(t, 4, events[len(events)-1].IncidentStatus)
+}
+
+func TestHoldDownFlapping(t *testing.T) {
+	hook := newHoldDownHook()
+	defer hook.Close()
+
+	config := newHoldDownConfig(hook, nil, HoldDownPolicy{FlapWindow: 100 * time.Millisecond})
+	router := PrepareGinRouter(config)
+
+	sendTestAlert(t, router, "", "firing", "component21")
+	assert.Equal(t, 1, len(hook.Events()))
+
+	// the flaps are collapsed in the open incident, noted once as flapping
+	for i := 0; i < 3; i++ {
+		sendTestAlert(t, router, "", "resolved", "component21")
+		sendTestAlert(t, router, "", "firing", "component21")
+	}
+	events := hook.Events()
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "incident_updated", events[1].Event)
+	assert.Equal(t, 2, events[1].IncidentStatus)
+	assert.Equal(t, "Prometheus flagged service component21 as flapping", events[1].Message)
+	assert.Equal(t, float64(3), config.Metrics.HoldDownSuppressed.Get(DEFAULT_BACKEND, DEFAULT_BACKEND))
+
+	// resolved once stable for the flap window
+	sendTestAlert(t, router, "", "resolved", "component21")
+	time.Sleep(200 * time.Millisecond)
+	events = hook.Events()
+	assert.Equal(t, 4, events[len(events)-1].IncidentStatus)
+
+	config.HoldDown.lock.Lock()
+	assert.Equal(t, 0, len(config.HoldDown.states))
+	config.HoldDown.lock.Unlock()
+}
+
+// the pending transitions are saved at shutdown, and scheduled again at the next start
+func TestHoldDownPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holddown")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "holddown.json")
+
+	hook := newHoldDownHook()
+	defer hook.Close()
+
+	holdDown, err := NewHoldDown(path)
+	assert.Nil(t, err)
+	router := PrepareGinRouter(newHoldDownConfig(hook, holdDown, HoldDownPolicy{FireAfter: 200 * time.Millisecond}))
+	sendTestAlert(t, router, "", "firing", "component21")
+	holdDown.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, len(hook.Events()))
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	var file holdDownFile
+	assert.Nil(t, json.Unmarshal(content, &file))
+	assert.Equal(t, 1, len(file.States))
+	assert.True(t, file.States[0].Pending)
+	assert.Equal(t, "f1a2", file.States[0].Fingerprint)
+
+	// restarted after the due time: the incident is opened right away
+	holdDown, err = NewHoldDown(path)
+	assert.Nil(t, err)
+	defer holdDown.Close()
+	PrepareGinRouter(newHoldDownConfig(hook, holdDown, HoldDownPolicy{FireAfter: 200 * time.Millisecond}))
+	time.Sleep(100 * time.Millisecond)
+	events := hook.Events()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "incident_created", events[0].Event)
+}
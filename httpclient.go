@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HTTPClientOptions are the settings of the http client used to talk to a status page backend
+type HTTPClientOptions struct {
+	// RootCA is an optional PEM file of the CA to trust (else the system CAs are used)
+	RootCA string
+	// SkipVerify disables the check of the server certificate
+	SkipVerify bool
+	// ClientCert and ClientKey are the PEM files of the client certificate (mutual TLS)
+	ClientCert string
+	ClientKey  string
+	// ProxyURL is the HTTP proxy to use (else the HTTP_PROXY/HTTPS_PROXY env variables are used)
+	ProxyURL string
+	// Timeout is the timeout of each request (0 means no timeout)
+	Timeout time.Duration
+	// Watcher (optional) reloads the certificate files when they change
+	Watcher *CertificateWatcher
+}
+
+// reloadingTransport switches to a new transport when the root CA is reloaded
+type reloadingTransport struct {
+	base *http.Transport
+	ca   *CAReloader
+
+	lock       sync.Mutex
+	current    *http.Transport
+	generation int
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool, generation := t.ca.Pool()
+
+	t.lock.Lock()
+	if t.current == nil || generation != t.generation {
+		if t.current != nil {
+			t.current.CloseIdleConnections()
+		}
+		t.current = t.base.Clone()
+		t.current.TLSClientConfig.RootCAs = pool
+		t.generation = generation
+	}
+	current := t.current
+	t.lock.Unlock()
+
+	return current.RoundTrip(req)
+}
+
+// NewHTTPClient creates the http client used to talk to a status page backend
+func NewHTTPClient(options HTTPClientOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: options.SkipVerify,
+	}
+
+	var caReloader *CAReloader
+	if options.RootCA != "" {
+		if options.Watcher != nil {
+			var err error
+			if caReloader, err = options.Watcher.CA(options.RootCA); err != nil {
+				return nil, err
+			}
+		} else {
+			caCertPool, err := loadCertPool(options.RootCA)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = caCertPool
+		}
+	}
+
+	if options.ClientCert != "" || options.ClientKey != "" {
+		if options.ClientCert == "" || options.ClientKey == "" {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		if options.Watcher != nil {
+			certReloader, err := options.Watcher.Certificate(options.ClientCert, options.ClientKey)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.GetClientCertificate = certReloader.GetClientCertificate
+		} else {
+			cert, err := tls.LoadX509KeyPair(options.ClientCert, options.ClientKey)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if options.ProxyURL != "" {
+		proxyURL, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy:           proxy,
+		TLSClientConfig: tlsConfig,
+	}
+	if caReloader != nil {
+		return &http.Client{
+			Timeout:   options.Timeout,
+			Transport: &reloadingTransport{base: transport, ca: caReloader},
+		}, nil
+	}
+
+	return &http.Client{
+		Timeout:   options.Timeout,
+		Transport: transport,
+	}, nil
+}
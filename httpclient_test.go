@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := writeTempFile(t, ca.pem)
+	defer os.Remove(caFile)
+
+	serverCert, serverKey := ca.issue(t, "cachet", time.Now().Add(time.Hour))
+	clientCert, clientKey := ca.issue(t, "bridge", time.Now().Add(time.Hour))
+	clientCertFile := writeTempFile(t, clientCert)
+	defer os.Remove(clientCertFile)
+	clientKeyFile := writeTempFile(t, clientKey)
+	defer os.Remove(clientKeyFile)
+
+	// the mock CachetHQ sits behind a mTLS ingress
+	tlsConfig, err := NewServerTLSConfig(ServerTLSOptions{ClientCAFile: caFile})
+	assert.Nil(t, err)
+	certificate, err := tls.X509KeyPair(serverCert, serverKey)
+	assert.Nil(t, err)
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	}))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	client, err := NewHTTPClient(HTTPClientOptions{RootCA: caFile, ClientCert: clientCertFile, ClientKey: clientKeyFile})
+	assert.Nil(t, err)
+	resp, err := client.Get(ts.URL)
+	assert.Nil(t, err)
+	if err == nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// without client certificate
+	client, err = NewHTTPClient(HTTPClientOptions{RootCA: caFile})
+	assert.Nil(t, err)
+	_, err = client.Get(ts.URL)
+	assert.NotNil(t, err)
+
+	_, err = NewHTTPClient(HTTPClientOptions{ClientCert: clientCertFile})
+	assert.NotNil(t, err)
+}
+
+func TestHTTPClientProxyAndTimeout(t *testing.T) {
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		io.WriteString(w, "proxied")
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(HTTPClientOptions{ProxyURL: proxy.URL})
+	assert.Nil(t, err)
+	resp, err := client.Get("http://cachet.internal/api/v1/ping")
+	assert.Nil(t, err)
+	if err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "proxied", string(body))
+	}
+	assert.Equal(t, "http://cachet.internal/api/v1/ping", proxied)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	client, err = NewHTTPClient(HTTPClientOptions{Timeout: 50 * time.Millisecond})
+	assert.Nil(t, err)
+	_, err = client.Get(slow.URL)
+	assert.NotNil(t, err)
+
+	_, err = NewHTTPClient(HTTPClientOptions{ProxyURL: "://nowhere"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	LOG_TRACE = -1
+	LOG_DEBUG = 0
+	LOG_INFO  = 1
+	LOG_WARN  = 2
+	LOG_ERROR = 3
+)
+
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+)
+
+var logLevelNames = map[int]string{
+	LOG_TRACE: "trace",
+	LOG_DEBUG: "debug",
+	LOG_INFO:  "info",
+	LOG_WARN:  "warn",
+	LOG_ERROR: "error",
+}
+
+// ParseLogLevel converts a "trace", "debug", "info", "warn" or "error" parameter into a LOG_* constant
+func ParseLogLevel(level string) (int, error) {
+	switch strings.ToLower(level) {
+	case "trace":
+		return LOG_TRACE, nil
+	case "debug":
+		return LOG_DEBUG, nil
+	case "", "info":
+		return LOG_INFO, nil
+	case "warn", "warning":
+		return LOG_WARN, nil
+	case "error":
+		return LOG_ERROR, nil
+	}
+	return LOG_INFO, fmt.Errorf("unknown log level '%s' (expected trace, debug, info, warn or error)", level)
+}
+
+// ParseLogFormat checks a "logfmt" or "json" parameter
+func ParseLogFormat(format string) (string, error) {
+	switch format {
+	case "", LOG_FORMAT_LOGFMT:
+		return LOG_FORMAT_LOGFMT, nil
+	case LOG_FORMAT_JSON:
+		return LOG_FORMAT_JSON, nil
+	}
+	return "", fmt.Errorf("unknown log format '%s' (expected logfmt or json)", format)
+}
+
+// Logger writes leveled structured lines, one per event, in logfmt or json.
+// Fields are given as key/value pairs, and inherited by the loggers created by With
+type Logger struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	level  int
+	format string
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, level int, format string) *Logger {
+	return &Logger{
+		out:    out,
+		lock:   &sync.Mutex{},
+		level:  level,
+		format: format,
+	}
+}
+
+// With returns a logger adding the key/value pairs to each line
+func (l *Logger) With(keyvalues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvalues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvalues...)
+	return &Logger{
+		out:    l.out,
+		lock:   l.lock,
+		level:  l.level,
+		format: l.format,
+		fields: fields,
+	}
+}
+
+// Enabled returns true if the lines of this level are written
+func (l *Logger) Enabled(level int) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Trace(msg string, keyvalues ...interface{}) { l.Log(LOG_TRACE, msg, keyvalues...) }
+func (l *Logger) Debug(msg string, keyvalues ...interface{}) { l.Log(LOG_DEBUG, msg, keyvalues...) }
+func (l *Logger) Info(msg string, keyvalues ...interface{})  { l.Log(LOG_INFO, msg, keyvalues...) }
+func (l *Logger) Warn(msg string, keyvalues ...interface{})  { l.Log(LOG_WARN, msg, keyvalues...) }
+func (l *Logger) Error(msg string, keyvalues ...interface{}) { l.Log(LOG_ERROR, msg, keyvalues...) }
+
+// Log writes a line if the level is enabled
+func (l *Logger) Log(level int, msg string, keyvalues ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(keyvalues))
+	fields = append(fields, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", logLevelNames[level], "msg", msg)
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvalues...)
+	if len(fields)%2 == 1 {
+		fields = append(fields, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	if l.format == LOG_FORMAT_JSON {
+		writeJSONLine(&buf, fields)
+	} else {
+		writeLogfmtLine(&buf, fields)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// logValue converts the errors and Stringers, the other values being kept as is
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func writeJSONLine(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+}
+
+func writeLogfmtLine(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+
+		var value string
+		switch v := logValue(fields[i+1]).(type) {
+		case string:
+			value = v
+		case int, int64, float64, bool:
+			value = fmt.Sprint(v)
+		default:
+			if b, err := json.Marshal(v); err == nil {
+				value = string(b)
+			} else {
+				value = fmt.Sprint(v)
+			}
+		}
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+}
+
+var (
+	defaultLoggerLock sync.Mutex
+	defaultLogger     = NewLogger(os.Stderr, LOG_INFO, LOG_FORMAT_LOGFMT)
+)
+
+// SetDefaultLogger replaces the logger used outside of the webhooks handling
+func SetDefaultLogger(logger *Logger) {
+	defaultLoggerLock.Lock()
+	defer defaultLoggerLock.Unlock()
+	defaultLogger = logger
+}
+
+// DefaultLogger returns the logger used outside of the webhooks handling
+func DefaultLogger() *Logger {
+	defaultLoggerLock.Lock()
+	defer defaultLoggerLock.Unlock()
+	return defaultLogger
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying the logger
+func WithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFrom returns the logger of the context, or the default logger
+func LoggerFrom(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return logger
+	}
+	return DefaultLogger()
+}
+
+type requestIDKey struct{}
+
+// RequestIDFrom returns the id of the request being processed, "" if none
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID reuses the X-Request-Id header given by a proxy, or generates one
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if id != "" && len(id) <= 128 && !strings.ContainsAny(id, " \"\t\r\n") {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestLogger gives each request an id (sent back in X-Request-Id), and a logger
+// carrying it in the request context. The requests are logged, but the skipped paths
+func RequestLogger(logger *Logger, skipPaths ...string) gin.HandlerFunc {
+	skip := make(map[string]bool)
+	for _, path := range skipPaths {
+		skip[path] = true
+	}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := requestID(c.Request)
+		c.Header("X-Request-Id", id)
+
+		requestLogger := logger.With("request_id", id)
+		ctx := context.WithValue(c.Request.Context(), requestIDKey{}, id)
+		c.Request = c.Request.WithContext(WithLogger(ctx, requestLogger))
+
+		c.Next()
+
+		if skip[c.Request.URL.Path] {
+			return
+		}
+		level := LOG_INFO
+		if c.Writer.Status() >= 500 {
+			level = LOG_WARN
+		}
+		requestLogger.Log(level, "request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency_ms", time.Since(start).Nanoseconds()/int64(time.Millisecond),
+			"client_ip", c.ClientIP())
+	}
+}
+
+const redacted = "REDACTED"
+
+// secretName returns true for the header or field names likely to hold a secret
+func secretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"authorization", "token", "key", "secret", "password", "cookie"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactHeaders(headers http.Header) map[string]string {
+	redactedHeaders := make(map[string]string, len(headers))
+	for name, values := range headers {
+		if secretName(name) {
+			redactedHeaders[name] = redacted
+		} else {
+			redactedHeaders[name] = strings.Join(values, ", ")
+		}
+	}
+	return redactedHeaders
+}
+
+func redactURL(u *url.URL) string {
+	copyurl := *u
+	if copyurl.User != nil {
+		copyurl.User = url.UserPassword(copyurl.User.Username(), redacted)
+	}
+	query := copyurl.Query()
+	changed := false
+	for name := range query {
+		if secretName(name) {
+			query.Set(name, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		copyurl.RawQuery = query.Encode()
+	}
+	return copyurl.String()
+}
+
+func redactJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if secretName(name) {
+				v[name] = redacted
+			} else {
+				v[name] = redactJSONValue(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactJSONValue(v[i])
+		}
+	}
+	return value
+}
+
+// redactBody hides the secret looking fields of a JSON body
+func redactBody(body []byte) string {
+	var value interface{}
+	if len(body) == 0 || json.Unmarshal(body, &value) != nil {
+		return string(body)
+	}
+	b, err := json.Marshal(redactJSONValue(value))
+	if err != nil {
+		return string(body)
+	}
+	return string(b)
+}
+
+// traceHTTP logs (at trace level) an HTTP exchange with a backend, the secrets being redacted
+func traceHTTP(ctx context.Context, req *http.Request, requestBody []byte, status int, responseBody []byte, start time.Time, err error) {
+	logger := LoggerFrom(ctx)
+	if !logger.Enabled(LOG_TRACE) {
+		return
+	}
+
+	headers := redactHeaders(req.Header)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headerLines := make([]string, 0, len(names))
+	for _, name := range names {
+		headerLines = append(headerLines, name+": "+headers[name])
+	}
+
+	keyvalues := []interface{}{
+		"method", req.Method,
+		"url", redactURL(req.URL),
+		"request_headers", strings.Join(headerLines, "; "),
+		"request_body", redactBody(requestBody),
+		"latency_ms", time.Since(start).Nanoseconds() / int64(time.Millisecond),
+	}
+	if err != nil {
+		keyvalues = append(keyvalues, "error", err)
+	} else {
+		keyvalues = append(keyvalues, "status", status, "response_body", redactBody(responseBody))
+	}
+	logger.Trace("backend http exchange", keyvalues...)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LOG_INFO, LOG_FORMAT_LOGFMT).With("tenant", "teama")
+
+	logger.Debug("hidden")
+	logger.Info("alert forwarded", "component", "API gateway", "backend", "default", "error", errors.New("boom"))
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), `level=info msg="alert forwarded" tenant=teama component="API gateway" backend=default error=boom`)
+
+	buf.Reset()
+	logger = NewLogger(&buf, LOG_TRACE, LOG_FORMAT_JSON)
+	logger.With("request_id", "abc").Trace("exchange", "status", 200)
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "trace", line["level"])
+	assert.Equal(t, "exchange", line["msg"])
+	assert.Equal(t, "abc", line["request_id"])
+	assert.Equal(t, float64(200), line["status"])
+
+	level, err := ParseLogLevel("warn")
+	assert.Nil(t, err)
+	assert.Equal(t, LOG_WARN, level)
+	_, err = ParseLogLevel("verbose")
+	assert.NotNil(t, err)
+	_, err = ParseLogFormat("xml")
+	assert.NotNil(t, err)
+}
+
+// every line about a webhook carries the request id, the group key, the receiver,
+// the fingerprint and the component, and the backend secrets are redacted
+func TestWebhookLogs(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LOG_TRACE, LOG_FORMAT_JSON)
+
+	cachet := NewCachetImpl(fake.URL, "1234567890abcdef", &http.Client{})
+	cachet.SetAPIVersion(CACHET_API_V2)
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		Logger:    logger,
+		Cachet:    cachet,
+	}
+	router := PrepareGinRouter(&config)
+
+	var jsonStr = []byte(`{"receiver":"cachethq-receiver","groupKey":"{}:{alertname=\"component21\"}","status":"firing","alerts":[{"status":"firing","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}`)
+	req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-Id", "req-42")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-Id"))
+	assert.NotContains(t, buf.String(), "1234567890abcdef")
+
+	forwarded, exchanges := 0, 0
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(raw), &line), raw)
+		assert.Equal(t, "req-42", line["request_id"])
+
+		switch line["msg"] {
+		case "alert forwarded":
+			forwarded++
+			assert.Equal(t, "cachethq-receiver", line["receiver"])
+			assert.Equal(t, `{}:{alertname="component21"}`, line["group_key"])
+			assert.Equal(t, "f1a2", line["fingerprint"])
+			assert.Equal(t, "component21", line["component"])
+		case "backend http exchange":
+			exchanges++
+			assert.Contains(t, line["request_headers"], "X-Cachet-Token: REDACTED")
+		}
+	}
+	assert.Equal(t, 1, forwarded)
+	assert.Equal(t, 2, exchanges)
+}
+
+func TestRedactBody(t *testing.T) {
+	assert.Equal(t, `{"name":"API","nested":[{"api_key":"REDACTED"}],"token":"REDACTED"}`,
+		redactBody([]byte(`{"name":"API","token":"secret","nested":[{"api_key":"secret"}]}`)))
+	assert.Equal(t, "not json", redactBody([]byte("not json")))
+}
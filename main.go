@@ -1,73 +1,196 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-const (
-	LOG_DEBUG = 0
-	LOG_INFO  = 1
-)
+// DEFAULT_BACKEND is the name of the CachetHQ backend configured by the command line parameters
+const DEFAULT_BACKEND = "default"
 
 type PrometheusCachetParameters struct {
 	loglevel            string
+	logFormat           string
 	httpPort            int
 	sslCert             string
 	sslKey              string
+	sslClientCA         string
+	sslClientSubjects   string
+	sslClientSANs       string
+	sslMinVersion       string
+	sslCipherSuites     string
+	sslReloadInterval   time.Duration
+	shutdownTimeout     time.Duration
 	cachetRootCA        string
 	cachetSkipVerifySsl bool
+	cachetClientCert    string
+	cachetClientKey     string
+	cachetProxyURL      string
+	cachetTimeout       time.Duration
+	cachetCallTimeout   time.Duration
+	alertTimeout        time.Duration
 	cachetURL           string
 	cachetToken         string
+	cachetAPIVersion    string
 	prometheusToken     string
+	prometheusTokenFile string
+	prometheusBasicAuth string
 	labelName           string
 	squashIncident      bool
+	configFile          string
+	startupCheck        string
+	otlpEndpoint        string
+	otlpHeaders         string
+	traceServiceName    string
+	auditFile           string
+	auditMaxSize        int
+	auditMaxFiles       int
+	recordFile          string
+	recordMaxSize       int
+	recordMaxFiles      int
+	holdDownStateFile   string
+	overridesFile       string
+	dedupeTTL           time.Duration
+	dryRun              bool
+	haLeaseFile         string
+	haIdentity          string
+	haAdvertiseURL      string
+	haLeaseDuration     time.Duration
+	haSecret            string
+	adminToken          string
+	adminBasicAuth      string
+	alertmanagerURL     string
+	silenceAction       string
+	silencePollInterval time.Duration
 }
 
-// NewPrometheusCachetParameters is here to fetch all env variable or parameters
-func NewPrometheusCachetParameters() *PrometheusCachetParameters {
+// NewPrometheusCachetParameters is here to fetch all env variable or parameters. The parameters
+// are registered on fs (which may hold additional flags), and the positional arguments are returned
+func NewPrometheusCachetParameters(fs *flag.FlagSet, args []string) (*PrometheusCachetParameters, []string, error) {
 	p := &PrometheusCachetParameters{}
 
-	flag.StringVar(&p.prometheusToken, "prometheus_token", "", "token sent by Prometheus in the webhook configuration")
-	flag.StringVar(&p.cachetURL, "cachethq_url", "http://127.0.0.1/", "where to find CachetHQ")
-	flag.StringVar(&p.cachetToken, "cachethq_token", "", "token to send to CachetHQ")
-	flag.StringVar(&p.cachetRootCA, "cachethq_root_ca", "", "Root SSL CA to use against CachetHQ")
-	flag.BoolVar(&p.cachetSkipVerifySsl, "cachethq_skip_verify_ssl", false, "Dont check the SSL certificate of the https access to CachetHQ")
-	flag.StringVar(&p.loglevel, "log_level", "info", "log level: [info|debug]")
-	flag.StringVar(&p.sslCert, "ssl_cert_file", "", "to be used with ssl_key: enable https server")
-	flag.StringVar(&p.sslKey, "ssl_key_file", "", "to be used with ssl_cert: enable https server")
-	flag.StringVar(&p.labelName, "label_name", "alertname", "label to look for in Prometheus Alert info")
-	flag.IntVar(&p.httpPort, "http_port", 8080, "port to listen on")
-	flag.BoolVar(&p.squashIncident, "squash_incident", false, "do we want to merge down and up event into one incident")
-	flag.Parse()
+	fs.StringVar(&p.prometheusToken, "prometheus_token", "", "token sent by Prometheus in the webhook configuration")
+	fs.StringVar(&p.prometheusTokenFile, "prometheus_token_file", "", "file containing the token(s) sent by Prometheus, one per line (reloaded on change)")
+	fs.StringVar(&p.prometheusBasicAuth, "prometheus_basic_auth", "", "basic auth accepted instead of a token: user1:password1[,user2:password2]")
+	fs.StringVar(&p.cachetURL, "cachethq_url", "http://127.0.0.1/", "where to find CachetHQ")
+	fs.StringVar(&p.cachetToken, "cachethq_token", "", "token to send to CachetHQ")
+	fs.StringVar(&p.cachetAPIVersion, "cachethq_api_version", "auto", "CachetHQ api version: [auto|2|3]")
+	fs.StringVar(&p.cachetRootCA, "cachethq_root_ca", "", "Root SSL CA to use against CachetHQ")
+	fs.BoolVar(&p.cachetSkipVerifySsl, "cachethq_skip_verify_ssl", false, "Dont check the SSL certificate of the https access to CachetHQ")
+	fs.StringVar(&p.cachetClientCert, "cachethq_client_cert", "", "client certificate file to use against CachetHQ (mutual TLS)")
+	fs.StringVar(&p.cachetClientKey, "cachethq_client_key", "", "client key file to use against CachetHQ (mutual TLS)")
+	fs.StringVar(&p.cachetProxyURL, "cachethq_proxy_url", "", "HTTP proxy to use to reach CachetHQ (default: HTTP_PROXY/HTTPS_PROXY env variables)")
+	fs.DurationVar(&p.cachetTimeout, "cachethq_timeout", DEFAULT_BACKEND_TIMEOUT, "timeout of each request to CachetHQ")
+	fs.DurationVar(&p.cachetCallTimeout, "cachethq_call_timeout", 0, "timeout of each call to CachetHQ, which may send several requests (0 to disable)")
+	fs.DurationVar(&p.alertTimeout, "alert_timeout", DEFAULT_ALERT_TIMEOUT, "overall timeout to forward one webhook to the backends (0 to disable)")
+	fs.StringVar(&p.loglevel, "log_level", "info", "log level: [trace|debug|info|warn|error]")
+	fs.StringVar(&p.logFormat, "log_format", LOG_FORMAT_LOGFMT, "log format: [logfmt|json]")
+	fs.StringVar(&p.sslCert, "ssl_cert_file", "", "to be used with ssl_key: enable https server")
+	fs.StringVar(&p.sslKey, "ssl_key_file", "", "to be used with ssl_cert: enable https server")
+	fs.StringVar(&p.sslClientCA, "ssl_client_ca_file", "", "to be used with ssl_cert/ssl_key: require client certificates signed by this CA")
+	fs.StringVar(&p.sslClientSubjects, "ssl_client_allowed_subjects", "", "comma separated list of allowed client certificate subjects (CN or DN)")
+	fs.StringVar(&p.sslClientSANs, "ssl_client_allowed_sans", "", "comma separated list of allowed client certificate SANs (DNS, email, IP or URI)")
+	fs.StringVar(&p.sslMinVersion, "ssl_min_version", "1.2", "minimum TLS version of the https server: [1.0|1.1|1.2|1.3]")
+	fs.StringVar(&p.sslCipherSuites, "ssl_cipher_suites", "", "comma separated list of the cipher suites of the https server (default: Go defaults)")
+	fs.DurationVar(&p.sslReloadInterval, "ssl_reload_interval", time.Minute, "how often the certificate, key and CA files are checked for rotation (0 to disable)")
+	fs.StringVar(&p.labelName, "label_name", "alertname", "label to look for in Prometheus Alert info")
+	fs.IntVar(&p.httpPort, "http_port", 8080, "port to listen on")
+	fs.BoolVar(&p.squashIncident, "squash_incident", false, "do we want to merge down and up event into one incident")
+	fs.DurationVar(&p.shutdownTimeout, "shutdown_timeout", DEFAULT_SHUTDOWN_TIMEOUT, "how long to wait for the in-flight webhooks at shutdown")
+	fs.StringVar(&p.configFile, "config_file", "", "yaml file describing additional status page backends and routes")
+	fs.StringVar(&p.otlpEndpoint, "otlp_endpoint", "", "OpenTelemetry collector OTLP/HTTP endpoint (i.e. http://collector:4318) to export traces to (default: tracing disabled)")
+	fs.StringVar(&p.otlpHeaders, "otlp_headers", "", "headers sent to the OpenTelemetry collector: name1=value1[,name2=value2]")
+	fs.StringVar(&p.traceServiceName, "trace_service_name", DEFAULT_TRACE_SERVICE_NAME, "service name of the exported traces")
+	fs.StringVar(&p.auditFile, "audit_file", "", "JSON lines file recording every change made on the status pages (default: no audit)")
+	fs.IntVar(&p.auditMaxSize, "audit_max_size", DEFAULT_AUDIT_MAX_SIZE, "size in MB of the audit file triggering its rotation")
+	fs.IntVar(&p.auditMaxFiles, "audit_max_files", DEFAULT_AUDIT_MAX_FILES, "number of rotated audit files kept")
+	fs.StringVar(&p.recordFile, "record_file", "", "JSON lines file recording the webhooks received (without their credentials), to replay them (default: not recorded)")
+	fs.IntVar(&p.recordMaxSize, "record_max_size", DEFAULT_RECORD_MAX_SIZE, "size in MB of the record file triggering its rotation")
+	fs.IntVar(&p.recordMaxFiles, "record_max_files", DEFAULT_RECORD_MAX_FILES, "number of rotated record files kept")
+	fs.StringVar(&p.holdDownStateFile, "hold_down_state_file", "", "file where the pending hold-down transitions are saved, to survive restarts (default: in memory)")
+	fs.StringVar(&p.overridesFile, "overrides_file", "", "file where the manual overrides of the components are saved, to survive restarts (default: in memory)")
+	fs.DurationVar(&p.dedupeTTL, "dedupe_ttl", DEFAULT_DEDUPE_TTL, "how long the processed notifications are remembered to skip the duplicates (0 to disable)")
+	fs.BoolVar(&p.dryRun, "dry_run", false, "log and record on /dryrun the changes of the status pages instead of applying them")
+	fs.StringVar(&p.haLeaseFile, "ha_lease_file", "", "lease file shared by the replicas, enabling the HA mode (only the leader writes on the status pages)")
+	fs.StringVar(&p.haIdentity, "ha_identity", "", "name of this replica in the lease (default: hostname)")
+	fs.StringVar(&p.haAdvertiseURL, "ha_advertise_url", "", "URL the other replicas forward the webhooks to when this replica leads (i.e. http://10.0.0.12:8080)")
+	fs.DurationVar(&p.haLeaseDuration, "ha_lease_duration", DEFAULT_HA_LEASE_DURATION, "how long the lease is kept without being renewed")
+	fs.StringVar(&p.haSecret, "ha_secret", "", "secret shared by the replicas, signing the webhooks forwarded to the leader (mandatory with ha_lease_file)")
+	fs.StringVar(&p.adminToken, "admin_token", "", "token giving access to the admin web UI on /admin (default: no admin UI)")
+	fs.StringVar(&p.adminBasicAuth, "admin_basic_auth", "", "basic auth giving access to the admin web UI on /admin: user1:password1[,user2:password2]")
+	fs.StringVar(&p.alertmanagerURL, "alertmanager_url", "", "Alertmanager URL (i.e. http://alertmanager:9093) polled for the alerts silenced or inhibited while their incident is open (default: not polled)")
+	fs.StringVar(&p.silenceAction, "silence_action", SILENCE_ACTION_WATCHING, "what to do with the incidents of the alerts silenced or inhibited: [off|watching|resolve]")
+	fs.DurationVar(&p.silencePollInterval, "silence_poll_interval", DEFAULT_SILENCE_POLL_INTERVAL, "how often the Alertmanager alerts are polled")
+	fs.StringVar(&p.startupCheck, "startup_check", STARTUP_CHECK_WARN, "check the backends and routes at startup: [off|warn|fatal]")
+	positional, err := parseInterleaved(fs, args)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// grab env variable (docker compliant)
 	if os.Getenv("PROMETHEUS_TOKEN") != "" {
 		p.prometheusToken = os.Getenv("PROMETHEUS_TOKEN")
 	}
+	if os.Getenv("PROMETHEUS_TOKEN_FILE") != "" {
+		p.prometheusTokenFile = os.Getenv("PROMETHEUS_TOKEN_FILE")
+	}
+	if os.Getenv("PROMETHEUS_BASIC_AUTH") != "" {
+		p.prometheusBasicAuth = os.Getenv("PROMETHEUS_BASIC_AUTH")
+	}
 	if os.Getenv("CACHETHQ_URL") != "" {
 		p.cachetURL = os.Getenv("CACHETHQ_URL")
 	}
 	if os.Getenv("CACHETHQ_TOKEN") != "" {
 		p.cachetToken = os.Getenv("CACHETHQ_TOKEN")
 	}
+	if os.Getenv("CACHETHQ_API_VERSION") != "" {
+		p.cachetAPIVersion = os.Getenv("CACHETHQ_API_VERSION")
+	}
 	if os.Getenv("CACHETHQ_ROOT_CA") != "" {
 		p.cachetRootCA = os.Getenv("CACHETHQ_ROOT_CA")
 	}
 	if os.Getenv("CACHETHQ_SKIP_VERIFY_SSL") == "true" {
 		p.cachetSkipVerifySsl = true
 	}
+	if os.Getenv("CACHETHQ_CLIENT_CERT") != "" {
+		p.cachetClientCert = os.Getenv("CACHETHQ_CLIENT_CERT")
+	}
+	if os.Getenv("CACHETHQ_CLIENT_KEY") != "" {
+		p.cachetClientKey = os.Getenv("CACHETHQ_CLIENT_KEY")
+	}
+	if os.Getenv("CACHETHQ_PROXY_URL") != "" {
+		p.cachetProxyURL = os.Getenv("CACHETHQ_PROXY_URL")
+	}
+	if os.Getenv("CACHETHQ_TIMEOUT") != "" {
+		if timeout, err := time.ParseDuration(os.Getenv("CACHETHQ_TIMEOUT")); err == nil {
+			p.cachetTimeout = timeout
+		}
+	}
+	if os.Getenv("CACHETHQ_CALL_TIMEOUT") != "" {
+		if timeout, err := time.ParseDuration(os.Getenv("CACHETHQ_CALL_TIMEOUT")); err == nil {
+			p.cachetCallTimeout = timeout
+		}
+	}
+	if os.Getenv("ALERT_TIMEOUT") != "" {
+		if timeout, err := time.ParseDuration(os.Getenv("ALERT_TIMEOUT")); err == nil {
+			p.alertTimeout = timeout
+		}
+	}
 	if os.Getenv("LOG_LEVEL") != "" {
 		p.loglevel = os.Getenv("LOG_LEVEL")
 	}
+	if os.Getenv("LOG_FORMAT") != "" {
+		p.logFormat = os.Getenv("LOG_FORMAT")
+	}
 	if os.Getenv("HTTP_PORT") != "" {
 		if port, err := strconv.Atoi(os.Getenv("HTTP_PORT")); err == nil {
 			p.httpPort = port
@@ -80,6 +203,28 @@ func NewPrometheusCachetParameters() *PrometheusCachetParameters {
 		p.sslKey = os.Getenv("SSL_KEY_FILE")
 	}
 
+	if os.Getenv("SSL_CLIENT_CA_FILE") != "" {
+		p.sslClientCA = os.Getenv("SSL_CLIENT_CA_FILE")
+	}
+	if os.Getenv("SSL_CLIENT_ALLOWED_SUBJECTS") != "" {
+		p.sslClientSubjects = os.Getenv("SSL_CLIENT_ALLOWED_SUBJECTS")
+	}
+	if os.Getenv("SSL_CLIENT_ALLOWED_SANS") != "" {
+		p.sslClientSANs = os.Getenv("SSL_CLIENT_ALLOWED_SANS")
+	}
+	if os.Getenv("SSL_MIN_VERSION") != "" {
+		p.sslMinVersion = os.Getenv("SSL_MIN_VERSION")
+	}
+	if os.Getenv("SSL_CIPHER_SUITES") != "" {
+		p.sslCipherSuites = os.Getenv("SSL_CIPHER_SUITES")
+	}
+
+	if os.Getenv("SSL_RELOAD_INTERVAL") != "" {
+		if interval, err := time.ParseDuration(os.Getenv("SSL_RELOAD_INTERVAL")); err == nil {
+			p.sslReloadInterval = interval
+		}
+	}
+
 	if os.Getenv("LABEL_NAME") != "" {
 		p.labelName = os.Getenv("LABEL_NAME")
 	}
@@ -87,65 +232,452 @@ func NewPrometheusCachetParameters() *PrometheusCachetParameters {
 	if os.Getenv("SQUASH_INCIDENT") == "true" {
 		p.squashIncident = true
 	}
-	return p
+	if os.Getenv("SHUTDOWN_TIMEOUT") != "" {
+		if timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil {
+			p.shutdownTimeout = timeout
+		}
+	}
+	if os.Getenv("CONFIG_FILE") != "" {
+		p.configFile = os.Getenv("CONFIG_FILE")
+	}
+	if os.Getenv("OTLP_ENDPOINT") != "" {
+		p.otlpEndpoint = os.Getenv("OTLP_ENDPOINT")
+	}
+	if os.Getenv("OTLP_HEADERS") != "" {
+		p.otlpHeaders = os.Getenv("OTLP_HEADERS")
+	}
+	if os.Getenv("TRACE_SERVICE_NAME") != "" {
+		p.traceServiceName = os.Getenv("TRACE_SERVICE_NAME")
+	}
+	if os.Getenv("AUDIT_FILE") != "" {
+		p.auditFile = os.Getenv("AUDIT_FILE")
+	}
+	if os.Getenv("AUDIT_MAX_SIZE") != "" {
+		if size, err := strconv.Atoi(os.Getenv("AUDIT_MAX_SIZE")); err == nil {
+			p.auditMaxSize = size
+		}
+	}
+	if os.Getenv("AUDIT_MAX_FILES") != "" {
+		if files, err := strconv.Atoi(os.Getenv("AUDIT_MAX_FILES")); err == nil {
+			p.auditMaxFiles = files
+		}
+	}
+	if os.Getenv("RECORD_FILE") != "" {
+		p.recordFile = os.Getenv("RECORD_FILE")
+	}
+	if os.Getenv("RECORD_MAX_SIZE") != "" {
+		if size, err := strconv.Atoi(os.Getenv("RECORD_MAX_SIZE")); err == nil {
+			p.recordMaxSize = size
+		}
+	}
+	if os.Getenv("RECORD_MAX_FILES") != "" {
+		if files, err := strconv.Atoi(os.Getenv("RECORD_MAX_FILES")); err == nil {
+			p.recordMaxFiles = files
+		}
+	}
+	if os.Getenv("HOLD_DOWN_STATE_FILE") != "" {
+		p.holdDownStateFile = os.Getenv("HOLD_DOWN_STATE_FILE")
+	}
+	if os.Getenv("OVERRIDES_FILE") != "" {
+		p.overridesFile = os.Getenv("OVERRIDES_FILE")
+	}
+	if os.Getenv("DEDUPE_TTL") != "" {
+		if ttl, err := time.ParseDuration(os.Getenv("DEDUPE_TTL")); err == nil {
+			p.dedupeTTL = ttl
+		}
+	}
+	if os.Getenv("DRY_RUN") == "true" {
+		p.dryRun = true
+	}
+	if os.Getenv("HA_LEASE_FILE") != "" {
+		p.haLeaseFile = os.Getenv("HA_LEASE_FILE")
+	}
+	if os.Getenv("HA_IDENTITY") != "" {
+		p.haIdentity = os.Getenv("HA_IDENTITY")
+	}
+	if os.Getenv("HA_ADVERTISE_URL") != "" {
+		p.haAdvertiseURL = os.Getenv("HA_ADVERTISE_URL")
+	}
+	if os.Getenv("HA_LEASE_DURATION") != "" {
+		if duration, err := time.ParseDuration(os.Getenv("HA_LEASE_DURATION")); err == nil {
+			p.haLeaseDuration = duration
+		}
+	}
+	if os.Getenv("HA_SECRET") != "" {
+		p.haSecret = os.Getenv("HA_SECRET")
+	}
+	if os.Getenv("ADMIN_TOKEN") != "" {
+		p.adminToken = os.Getenv("ADMIN_TOKEN")
+	}
+	if os.Getenv("ADMIN_BASIC_AUTH") != "" {
+		p.adminBasicAuth = os.Getenv("ADMIN_BASIC_AUTH")
+	}
+	if os.Getenv("ALERTMANAGER_URL") != "" {
+		p.alertmanagerURL = os.Getenv("ALERTMANAGER_URL")
+	}
+	if os.Getenv("SILENCE_ACTION") != "" {
+		p.silenceAction = os.Getenv("SILENCE_ACTION")
+	}
+	if os.Getenv("SILENCE_POLL_INTERVAL") != "" {
+		if interval, err := time.ParseDuration(os.Getenv("SILENCE_POLL_INTERVAL")); err == nil {
+			p.silencePollInterval = interval
+		}
+	}
+	if os.Getenv("STARTUP_CHECK") != "" {
+		p.startupCheck = os.Getenv("STARTUP_CHECK")
+	}
+	return p, positional, nil
+}
+
+// parseInterleaved parses the flags found before and after the positional arguments
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
 
 type PrometheusCachetConfig struct {
+	// Tenant is empty for the main /alert endpoint
+	Tenant          string
 	PrometheusToken string
-	Cachet          Cachet
-	LabelName       string
-	LogLevel        int
-	SquashIncident  bool
+	// PrometheusTokens are additional accepted tokens (for rotation)
+	PrometheusTokens []string
+	// Auth checks the webhook requests. If nil, it is built from PrometheusToken(s)
+	Auth *Authenticator
+	// Cachet is the default backend
+	Cachet Cachet
+	// Backends are the additional named backends, selected by Routes
+	Backends       map[string]Cachet
+	Routes         []Route
+	LabelName      string
+	LogLevel       int
+	SquashIncident bool
+	// AlertTimeout bounds the forwarding of one webhook to the backends (0: no limit)
+	AlertTimeout time.Duration
+	// Tenants are served on /alert/<tenant>
+	Tenants map[string]*PrometheusCachetConfig
+	Metrics *BridgeMetrics
+	// Certificates reloads the certificate files when they change
+	Certificates *CertificateWatcher
+	Lifecycle    *Lifecycle
+	// Logger writes the access log, the webhooks handling logs go to the request context logger
+	Logger *Logger
+	// Tracer traces the webhooks processing (nil if disabled)
+	Tracer *Tracer
+	// Audit records the changes made on the status pages (nil if disabled)
+	Audit *AuditLog
+	// Recorder records the webhooks received, to replay them (nil if disabled)
+	Recorder *WebhookRecorder
+	// Readiness checks the backends for the /ready endpoint
+	Readiness *ReadinessChecker
+	// HoldDown schedules the delayed transitions of the routes with hold-down timers
+	HoldDown *HoldDown
+	// Dedupe skips the notifications already processed (nil if disabled)
+	Dedupe *Deduplicator
+	// HA forwards the webhooks to the leader replica (nil if disabled)
+	HA *HighAvailability
+	// DryRun records the changes of the dry-run backends and routes, served on /dryrun
+	DryRun *DryRunRecorder
+	// Overrides pin the status of the components, whatever their alerts
+	Overrides *Overrides
+	// Admin serves the admin web UI on /admin, and keeps the active alerts and the last errors (nil if disabled)
+	Admin *AdminConsole
+}
+
+// NewPrometheusCachetConfig creates the configuration described by the parameters: the default
+// CachetHQ backend, and the backends, routes and tenants of the config file (if any)
+func NewPrometheusCachetConfig(parameters *PrometheusCachetParameters, metrics *BridgeMetrics, certificates *CertificateWatcher) (*PrometheusCachetConfig, error) {
+	logLevel, err := ParseLogLevel(parameters.loglevel)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := NewHTTPClient(HTTPClientOptions{
+		RootCA:     parameters.cachetRootCA,
+		SkipVerify: parameters.cachetSkipVerifySsl,
+		ClientCert: parameters.cachetClientCert,
+		ClientKey:  parameters.cachetClientKey,
+		ProxyURL:   parameters.cachetProxyURL,
+		Timeout:    parameters.cachetTimeout,
+		Watcher:    certificates,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cachetAPIVersion, err := ParseCachetAPIVersion(parameters.cachetAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+	cachet := NewCachetImpl(parameters.cachetURL, parameters.cachetToken, httpClient)
+	cachet.SetAPIVersion(cachetAPIVersion)
+
+	config := &PrometheusCachetConfig{
+		Metrics:         metrics,
+		Certificates:    certificates,
+		PrometheusToken: parameters.prometheusToken,
+		Cachet:          WithCallTimeout(cachet, parameters.cachetCallTimeout),
+		LabelName:       parameters.labelName,
+		LogLevel:        logLevel,
+		SquashIncident:  parameters.squashIncident,
+		AlertTimeout:    parameters.alertTimeout,
+		DryRun:          NewDryRunRecorder(DEFAULT_DRY_RUN_HISTORY),
+	}
+
+	basicAuth, err := ParseBasicAuth(parameters.prometheusBasicAuth)
+	if err != nil {
+		return nil, err
+	}
+	tokenFiles := []string{}
+	if parameters.prometheusTokenFile != "" {
+		tokenFiles = append(tokenFiles, parameters.prometheusTokenFile)
+	}
+	config.Auth, err = NewAuthenticator("prometheus-cachethq", []string{parameters.prometheusToken}, tokenFiles, basicAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	if parameters.configFile != "" {
+		fileConfig, err := LoadConfigFile(parameters.configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Backends, config.Routes, err = NewBackends(fileConfig.Backends, fileConfig.Routes, certificates)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Tenants = make(map[string]*PrometheusCachetConfig)
+		for name, tenant := range fileConfig.Tenants {
+			config.Tenants[name], err = NewTenantConfig(name, tenant, config)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return config, nil
 }
 
 func main() {
-	parameters := NewPrometheusCachetParameters()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(RunCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
+	parameters, _, err := NewPrometheusCachetParameters(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logLevel, err := ParseLogLevel(parameters.loglevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logFormat, err := ParseLogFormat(parameters.logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := NewLogger(os.Stderr, logLevel, logFormat)
+	SetDefaultLogger(logger)
+
+	metrics := NewBridgeMetrics()
+	var certificates *CertificateWatcher
+	if parameters.sslReloadInterval > 0 {
+		certificates = NewCertificateWatcher(metrics)
+	}
+
+	config, err := NewPrometheusCachetConfig(parameters, metrics, certificates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Lifecycle = NewLifecycle()
+	config.Logger = logger
+
+	config.HoldDown, err = NewHoldDown(parameters.holdDownStateFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Lifecycle.OnShutdown(config.HoldDown.Close)
+
+	config.Overrides, err = NewOverrides(parameters.overridesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Lifecycle.OnShutdown(config.Overrides.Close)
+
+	if parameters.dedupeTTL > 0 {
+		config.Dedupe = NewDeduplicator(parameters.dedupeTTL)
+	}
+
+	if parameters.otlpEndpoint != "" {
+		headers, err := ParseHeaders(parameters.otlpHeaders)
+		if err != nil {
+			log.Fatal(err)
+		}
+		exporter := NewOTLPExporter(parameters.otlpEndpoint, headers, parameters.traceServiceName, &http.Client{Timeout: 10 * time.Second}, metrics)
+		config.Tracer = NewTracer(exporter)
+		go exporter.Run(DEFAULT_TRACE_FLUSH_INTERVAL, config.Lifecycle.Stopping())
+		config.Lifecycle.OnShutdown(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := exporter.Flush(ctx); err != nil {
+				logger.Warn("unable to export the last traces", "error", err)
+			}
+		})
+	}
+
+	if parameters.auditFile != "" {
+		config.Audit, err = NewAuditLog(parameters.auditFile, int64(parameters.auditMaxSize)*1024*1024, parameters.auditMaxFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.WrapBackends(func(tenant, name string, backend Cachet) Cachet {
+			return WithAudit(backend, tenant, name, config.Audit)
+		})
+		config.Lifecycle.OnShutdown(func() {
+			config.Audit.Close()
+		})
+	}
 
-	caCertPool := x509.NewCertPool()
-	if parameters.cachetRootCA != "" {
-		caCert, err := ioutil.ReadFile(parameters.cachetRootCA)
+	if parameters.recordFile != "" {
+		config.Recorder, err = NewWebhookRecorder(parameters.recordFile, int64(parameters.recordMaxSize)*1024*1024, parameters.recordMaxFiles)
 		if err != nil {
 			log.Fatal(err)
 		}
+		config.Lifecycle.OnShutdown(func() {
+			config.Recorder.Close()
+		})
+	}
 
-		caCertPool.AppendCertsFromPEM(caCert)
+	// wrapped after the audit, which only records the changes really made
+	if parameters.dryRun {
+		logger.Warn("dry-run mode: the status pages are not updated")
+		config.WrapBackends(func(tenant, name string, backend Cachet) Cachet {
+			return WithDryRun(backend, tenant, name, config.DryRun)
+		})
 	}
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:            caCertPool,
-				InsecureSkipVerify: parameters.cachetSkipVerifySsl,
-			},
-		},
+	// the admin UI has its own credentials, and is disabled without
+	if parameters.adminToken != "" || parameters.adminBasicAuth != "" {
+		adminBasicAuth, err := ParseBasicAuth(parameters.adminBasicAuth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		adminAuth, err := NewAuthenticator("prometheus-cachethq-admin", []string{parameters.adminToken}, nil, adminBasicAuth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// a blank token or basic auth would leave the admin UI open
+		if !adminAuth.Enabled() {
+			log.Fatal("admin_token or admin_basic_auth is set, but gives no credential for the admin UI")
+		}
+		config.Admin = NewAdminConsole(adminAuth, DEFAULT_ADMIN_HISTORY)
+	} else if parameters.auditFile != "" || parameters.dryRun {
+		logger.Warn("without admin_token or admin_basic_auth, the audit log and the dry-run changes are not served")
 	}
 
-	config := PrometheusCachetConfig{
-		PrometheusToken: parameters.prometheusToken,
-		Cachet:          NewCachetImpl(parameters.cachetURL, parameters.cachetToken, httpClient),
-		LabelName:       parameters.labelName,
-		LogLevel:        LOG_INFO,
-		SquashIncident:  parameters.squashIncident,
+	if err := RunStartupCheck(parameters.startupCheck, config); err != nil {
+		log.Fatal(err)
 	}
 
-	config.LogLevel = LOG_INFO
-	if parameters.loglevel == "debug" {
-		config.LogLevel = LOG_DEBUG
+	// the answer must be written after the backends were called
+	writeTimeout := 10 * time.Second
+	if parameters.alertTimeout >= writeTimeout {
+		writeTimeout = parameters.alertTimeout + time.Second
 	}
 
-	router := PrepareGinRouter(&config)
+	if parameters.haLeaseFile != "" {
+		identity := parameters.haIdentity
+		if identity == "" {
+			if identity, err = os.Hostname(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if parameters.haAdvertiseURL == "" {
+			log.Fatal("ha_advertise_url is mandatory with ha_lease_file")
+		}
+		if parameters.haSecret == "" {
+			log.Fatal("ha_secret is mandatory with ha_lease_file")
+		}
+		if parameters.haLeaseDuration <= 0 {
+			parameters.haLeaseDuration = DEFAULT_HA_LEASE_DURATION
+		}
+		lease := NewFileLease(parameters.haLeaseFile, identity, parameters.haAdvertiseURL, parameters.haLeaseDuration)
+		config.HA = NewHighAvailability(lease, identity, parameters.haSecret, &http.Client{Timeout: writeTimeout}, metrics)
+		// the overrides set on the previous leader are in the file shared by the replicas
+		if parameters.overridesFile == "" {
+			DefaultLogger().Warn("without overrides_file on the volume shared by the replicas, the overrides are lost when the leader changes")
+		}
+		if parameters.holdDownStateFile == "" {
+			DefaultLogger().Warn("without hold_down_state_file on the volume shared by the replicas, the pending hold-down changes are lost when the leader changes")
+		}
+		config.HA.OnElected(config.Overrides.Reload)
+		config.HA.OnElected(config.HoldDown.Reload)
+		config.HA.Elect()
+		go config.HA.Run(parameters.haLeaseDuration/3, config.Lifecycle.Stopping())
+		config.Lifecycle.OnShutdown(config.HA.Release)
+	}
+
+	router := PrepareGinRouter(config)
+
+	if parameters.alertmanagerURL != "" {
+		action, err := ParseSilenceAction(parameters.silenceAction)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if parameters.silencePollInterval <= 0 {
+			parameters.silencePollInterval = DEFAULT_SILENCE_POLL_INTERVAL
+		}
+		watcher := NewSilenceWatcher(parameters.alertmanagerURL, &http.Client{Timeout: 10 * time.Second}, action, config)
+		go watcher.Run(parameters.silencePollInterval, config.Lifecycle.Stopping())
+	}
+
+	if certificates != nil {
+		go certificates.Run(parameters.sslReloadInterval, config.Lifecycle.Stopping())
+	}
 
 	server := &http.Server{
 		Addr:           fmt.Sprintf(":%d", parameters.httpPort),
 		Handler:        router,
 		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		WriteTimeout:   writeTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
 
 	if parameters.sslCert != "" && parameters.sslKey != "" {
-		log.Fatal(server.ListenAndServeTLS(parameters.sslCert, parameters.sslKey))
-	} else {
-		log.Fatal(server.ListenAndServe())
+		server.TLSConfig, err = NewServerTLSConfig(ServerTLSOptions{
+			CertFile:        parameters.sslCert,
+			KeyFile:         parameters.sslKey,
+			Watcher:         certificates,
+			ClientCAFile:    parameters.sslClientCA,
+			AllowedSubjects: SplitList(parameters.sslClientSubjects),
+			AllowedSANs:     SplitList(parameters.sslClientSANs),
+			MinVersion:      parameters.sslMinVersion,
+			CipherSuites:    SplitList(parameters.sslCipherSuites),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	listen := server.ListenAndServe
+	if server.TLSConfig != nil {
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+	}
+	if err := ServeUntilSignal(server, listen, signals, config.Lifecycle, parameters.shutdownTimeout); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricVec is a minimal Prometheus metric (counter or gauge) with labels
+type MetricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func (m *MetricVec) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// Add increments the serie identified by the label values
+func (m *MetricVec) Add(value float64, labelValues ...string) {
+	key := m.key(labelValues)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[key] += value
+	m.series[key] = labelValues
+}
+
+// Inc increments by one the serie identified by the label values
+func (m *MetricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set sets the serie identified by the label values (gauges)
+func (m *MetricVec) Set(value float64, labelValues ...string) {
+	key := m.key(labelValues)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[key] = value
+	m.series[key] = labelValues
+}
+
+// Delete removes the serie identified by the label values (gauges)
+func (m *MetricVec) Delete(labelValues ...string) {
+	key := m.key(labelValues)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.values, key)
+	delete(m.series, key)
+}
+
+// Get returns the current value of a serie
+func (m *MetricVec) Get(labelValues ...string) float64 {
+	key := m.key(labelValues)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.values[key]
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *MetricVec) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		pairs := make([]string, len(m.labels))
+		for i, label := range m.labels {
+			pairs[i] = fmt.Sprintf(`%s="%s"`, label, metricLabelEscaper.Replace(m.series[key][i]))
+		}
+		if len(pairs) > 0 {
+			fmt.Fprintf(w, "%s{%s} %v\n", m.name, strings.Join(pairs, ","), m.values[key])
+		} else {
+			fmt.Fprintf(w, "%s %v\n", m.name, m.values[key])
+		}
+	}
+}
+
+// MetricsRegistry holds the metrics exposed on /metrics, in the Prometheus text format
+type MetricsRegistry struct {
+	lock    sync.Mutex
+	metrics []*MetricVec
+}
+
+func (r *MetricsRegistry) register(name, help, kind string, labels []string) *MetricVec {
+	m := &MetricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+		series: make(map[string][]string),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// NewCounterVec registers a new counter
+func (r *MetricsRegistry) NewCounterVec(name, help string, labels ...string) *MetricVec {
+	return r.register(name, help, "counter", labels)
+}
+
+// NewGaugeVec registers a new gauge
+func (r *MetricsRegistry) NewGaugeVec(name, help string, labels ...string) *MetricVec {
+	return r.register(name, help, "gauge", labels)
+}
+
+// WriteText writes all the metrics in the Prometheus text format
+func (r *MetricsRegistry) WriteText(w io.Writer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the metrics
+func (r *MetricsRegistry) Handler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(http.StatusOK)
+	r.WriteText(c.Writer)
+}
+
+// BridgeMetrics are the metrics of the bridge, labelled by tenant
+type BridgeMetrics struct {
+	*MetricsRegistry
+
+	WebhooksReceived   *MetricVec
+	WebhooksRejected   *MetricVec
+	IncidentsForwarded *MetricVec
+	BackendErrors      *MetricVec
+	HoldDownSuppressed *MetricVec
+	DuplicatesSkipped  *MetricVec
+	Leader             *MetricVec
+	CertificateExpiry  *MetricVec
+	Overrides          *MetricVec
+	AlertsOverridden   *MetricVec
+	SilencedIncidents  *MetricVec
+	SpansDropped       *MetricVec
+}
+
+// NewBridgeMetrics creates and registers the bridge metrics
+func NewBridgeMetrics() *BridgeMetrics {
+	registry := &MetricsRegistry{}
+	return &BridgeMetrics{
+		MetricsRegistry:    registry,
+		WebhooksReceived:   registry.NewCounterVec("prometheus_cachethq_webhooks_received_total", "Number of webhooks received from Alertmanager", "tenant", "status"),
+		WebhooksRejected:   registry.NewCounterVec("prometheus_cachethq_webhooks_rejected_total", "Number of webhooks rejected", "tenant", "reason"),
+		IncidentsForwarded: registry.NewCounterVec("prometheus_cachethq_incidents_forwarded_total", "Number of component alerts forwarded to a backend", "tenant", "backend"),
+		BackendErrors:      registry.NewCounterVec("prometheus_cachethq_backend_errors_total", "Number of errors while talking to a backend", "tenant", "backend"),
+		HoldDownSuppressed: registry.NewCounterVec("prometheus_cachethq_holddown_suppressed_total", "Number of delayed transitions cancelled by the alert changing back (blips and flaps)", "tenant", "backend"),
+		DuplicatesSkipped:  registry.NewCounterVec("prometheus_cachethq_duplicates_skipped_total", "Number of alerts not forwarded as already processed, or not changing the component status", "tenant", "backend"),
+		Leader:             registry.NewGaugeVec("prometheus_cachethq_leader", "1 if this replica is the leader writing on the status pages (HA mode)"),
+		CertificateExpiry:  registry.NewGaugeVec("prometheus_cachethq_certificate_expiry_timestamp_seconds", "Expiry time of the certificates and CAs in use", "file"),
+		Overrides:          registry.NewGaugeVec("prometheus_cachethq_override_expiry_timestamp_seconds", "Expiry time of the manual overrides of the components", "tenant", "component", "status"),
+		AlertsOverridden:   registry.NewCounterVec("prometheus_cachethq_alerts_overridden_total", "Number of component alerts not forwarded as the component is overridden", "tenant"),
+		SilencedIncidents:  registry.NewCounterVec("prometheus_cachethq_silenced_incidents_total", "Number of incidents set as watching or resolved as their alert was silenced or inhibited in Alertmanager", "tenant", "backend", "action"),
+		SpansDropped:       registry.NewCounterVec("prometheus_cachethq_trace_spans_dropped_total", "Number of trace spans dropped as the export queue was full (collector slow or unreachable)"),
+	}
+}
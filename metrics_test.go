@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	registry := &MetricsRegistry{}
+	counter := registry.NewCounterVec("test_total", "A test counter", "tenant")
+	gauge := registry.NewGaugeVec("test_gauge", "A test gauge")
+
+	counter.Inc("a")
+	counter.Add(2, "a")
+	counter.Inc(`b"c`)
+	gauge.Set(42)
+
+	assert.Equal(t, float64(3), counter.Get("a"))
+
+	var buf bytes.Buffer
+	registry.WriteText(&buf)
+	assert.Equal(t, `# HELP test_total A test counter
+# TYPE test_total counter
+test_total{tenant="a"} 3
+test_total{tenant="b\"c"} 1
+# HELP test_gauge A test gauge
+# TYPE test_gauge gauge
+test_gauge 42
+`, buf.String())
+
+	gauge.Delete()
+	assert.Equal(t, float64(0), gauge.Get())
+}
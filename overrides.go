@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	OVERRIDE_OPERATIONAL = "operational"
+	OVERRIDE_OUTAGE      = "outage"
+)
+
+// Override pins the status of a component until it expires, whatever its alerts
+type Override struct {
+	Tenant    string    `json:"tenant"`
+	Component string    `json:"component"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Firing is the status of the last alert received, before or while overridden (nil if none),
+	// applied when the override ends (the component being operational if none)
+	Firing *bool `json:"firing,omitempty"`
+
+	timer *time.Timer
+}
+
+func (o *Override) key() string {
+	return overrideKey(o.Tenant, o.Component)
+}
+
+func overrideKey(tenant, component string) string {
+	return tenant + "/" + component
+}
+
+// firing returns true if the override puts the component in outage
+func (o *Override) firing() bool {
+	return o.Status == OVERRIDE_OUTAGE
+}
+
+type overridesFile struct {
+	Overrides []*Override `json:"overrides"`
+}
+
+// Overrides holds the manual overrides of the components: while overridden, the alerts of a
+// component are not forwarded. They are saved in the (optional) state file, to survive restarts.
+// A nil Overrides overrides nothing
+type Overrides struct {
+	path      string
+	lock      sync.Mutex
+	overrides map[string]*Override
+	// alerts is the status of the last alert received per component, overridden or not
+	alerts  map[string]bool
+	configs map[string]*PrometheusCachetConfig
+	metrics *BridgeMetrics
+	ha      *HighAvailability
+	closed  bool
+}
+
+// NewOverrides loads the overrides saved in path (if any). An empty path keeps them in memory only
+func NewOverrides(path string) (*Overrides, error) {
+	o := &Overrides{
+		path:      path,
+		overrides: make(map[string]*Override),
+		alerts:    make(map[string]bool),
+		configs:   make(map[string]*PrometheusCachetConfig),
+	}
+	overrides, err := o.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		o.overrides[override.key()] = override
+	}
+	return o, nil
+}
+
+// load reads the overrides saved in the state file
+func (o *Overrides) load() ([]*Override, error) {
+	if o.path == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file overridesFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", o.path, err)
+	}
+	return file.Overrides, nil
+}
+
+// Reload replaces the overrides by the ones saved in the state file, when this replica becomes
+// the leader: the file shared by the replicas holds the overrides set on the previous leader
+func (o *Overrides) Reload() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	overrides, err := o.load()
+	if err != nil {
+		DefaultLogger().Error("unable to reload the overrides", "file", o.path, "error", err)
+		return
+	}
+	if o.path == "" {
+		return
+	}
+	for _, override := range o.overrides {
+		if override.timer != nil {
+			override.timer.Stop()
+			override.timer = nil
+		}
+		if o.metrics != nil {
+			o.metrics.Overrides.Delete(override.Tenant, override.Component, override.Status)
+		}
+	}
+	o.overrides = make(map[string]*Override)
+	for _, override := range overrides {
+		o.overrides[override.key()] = override
+		if _, ok := o.configs[override.Tenant]; ok {
+			o.schedule(override)
+			o.metrics.Overrides.Set(float64(override.ExpiresAt.Unix()), override.Tenant, override.Component, override.Status)
+		}
+	}
+}
+
+// Register makes the tenant backends available to the overrides ending, and schedules
+// the end of the overrides of this tenant loaded from the state file
+func (o *Overrides) Register(config *PrometheusCachetConfig) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	tenant := config.TenantName()
+	o.configs[tenant] = config
+	o.metrics = config.Metrics
+	o.ha = config.HA
+	for _, override := range o.overrides {
+		if override.Tenant == tenant && override.timer == nil {
+			o.schedule(override)
+			o.metrics.Overrides.Set(float64(override.ExpiresAt.Unix()), override.Tenant, override.Component, override.Status)
+		}
+	}
+}
+
+// schedule arms the timer ending an override (o.lock must be held)
+func (o *Overrides) schedule(override *Override) {
+	if o.closed {
+		return
+	}
+	delay := time.Until(override.ExpiresAt)
+	if delay < 0 {
+		delay = 0
+	}
+	override.timer = time.AfterFunc(delay, func() {
+		o.expire(override)
+	})
+}
+
+// remove forgets an override (o.lock must be held)
+func (o *Overrides) remove(override *Override) {
+	if override.timer != nil {
+		override.timer.Stop()
+		override.timer = nil
+	}
+	delete(o.overrides, override.key())
+	if o.metrics != nil {
+		o.metrics.Overrides.Delete(override.Tenant, override.Component, override.Status)
+	}
+	o.save()
+}
+
+// Get returns a copy of the override of a component, or nil
+func (o *Overrides) Get(tenant, component string) *Override {
+	if o == nil {
+		return nil
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	override, ok := o.overrides[overrideKey(tenant, component)]
+	if !ok {
+		return nil
+	}
+	snapshot := *override
+	snapshot.timer = nil
+	return &snapshot
+}
+
+// List returns a copy of the overrides, sorted by tenant and component
+func (o *Overrides) List() []Override {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	overrides := make([]Override, 0, len(o.overrides))
+	for _, override := range o.overrides {
+		snapshot := *override
+		snapshot.timer = nil
+		overrides = append(overrides, snapshot)
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].key() < overrides[j].key() })
+	return overrides
+}
+
+// Overridden returns true if the component is overridden. The status of its alert is remembered,
+// to apply it when an override ends
+func (o *Overrides) Overridden(tenant, component string, firing bool) bool {
+	if o == nil {
+		return false
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.alerts[overrideKey(tenant, component)] = firing
+	override, ok := o.overrides[overrideKey(tenant, component)]
+	if !ok {
+		return false
+	}
+	if override.Firing == nil || *override.Firing != firing {
+		override.Firing = &firing
+		o.save()
+	}
+	return true
+}
+
+// Set overrides a component (replacing its previous override), and applies its status on the
+// backends of the tenant. It returns false if the component is on none of them
+func (o *Overrides) Set(ctx context.Context, config *PrometheusCachetConfig, override *Override) (bool, error) {
+	o.lock.Lock()
+	if previous, ok := o.overrides[override.key()]; ok {
+		// the alerts received meanwhile are still to be applied at the end
+		override.Firing = previous.Firing
+		o.remove(previous)
+	} else if firing, ok := o.alerts[override.key()]; ok {
+		// the component was alerting (or not) before the override
+		override.Firing = &firing
+	}
+	o.overrides[override.key()] = override
+	o.schedule(override)
+	if o.metrics != nil {
+		o.metrics.Overrides.Set(float64(override.ExpiresAt.Unix()), override.Tenant, override.Component, override.Status)
+	}
+	o.save()
+	o.lock.Unlock()
+
+	message := fmt.Sprintf("Service %s flagged as up (manual override: %s)", override.Component, override.Reason)
+	found, err := applyStatus(ctx, config, override.Component, override.firing(), message)
+	if found == 0 && err == nil {
+		o.lock.Lock()
+		if o.overrides[override.key()] == override {
+			o.remove(override)
+		}
+		o.lock.Unlock()
+		return false, nil
+	}
+	return true, err
+}
+
+// Delete ends the override of a component, and returns it (nil if none)
+func (o *Overrides) Delete(ctx context.Context, tenant, component string) (*Override, error) {
+	o.lock.Lock()
+	override, ok := o.overrides[overrideKey(tenant, component)]
+	if !ok {
+		o.lock.Unlock()
+		return nil, nil
+	}
+	o.remove(override)
+	config := o.configs[tenant]
+	o.lock.Unlock()
+
+	return override, o.restore(ctx, config, override)
+}
+
+// expire ends an override, when its timer expires
+func (o *Overrides) expire(override *Override) {
+	o.lock.Lock()
+	// an override replaced has its own timer
+	if o.overrides[override.key()] != override || o.closed {
+		o.lock.Unlock()
+		return
+	}
+	o.remove(override)
+	config := o.configs[override.Tenant]
+	o.lock.Unlock()
+
+	logger := DefaultLogger().With("tenant", override.Tenant, "component", override.Component)
+	// only the leader writes on the status pages, the followers reload the overrides when elected
+	if !o.ha.IsLeader() {
+		logger.Debug("override expired on a follower", "status", override.Status)
+		return
+	}
+	logger.Info("override expired", "status", override.Status, "reason", override.Reason)
+
+	ctx, cancel := context.WithTimeout(WithLogger(context.Background(), logger), DEFAULT_ADMIN_TIMEOUT)
+	defer cancel()
+	if err := o.restore(ctx, config, override); err != nil {
+		logger.Warn("unable to apply the alert status after the override", "error", err)
+	}
+}
+
+// restore applies the status of the last alert received, the component being operational if
+// none was. The notifications already processed are forgotten, so that their resends are applied
+func (o *Overrides) restore(ctx context.Context, config *PrometheusCachetConfig, override *Override) error {
+	if config == nil {
+		return nil
+	}
+	config.Dedupe.ReleaseComponent(override.Tenant, override.Component)
+	firing := override.Firing != nil && *override.Firing
+	message := fmt.Sprintf("Prometheus flagged service %s as up", override.Component)
+	_, err := applyStatus(ctx, config, override.Component, firing, message)
+	return err
+}
+
+// applyStatus syncs a component on each backend of the configuration having it, and
+// returns on how many backends it was found
+func applyStatus(ctx context.Context, config *PrometheusCachetConfig, component string, firing bool, message string) (int, error) {
+	names := make([]string, 0, len(config.Backends)+1)
+	if config.Cachet != nil {
+		names = append(names, DEFAULT_BACKEND)
+	}
+	for name := range config.Backends {
+		if name != DEFAULT_BACKEND {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	found := 0
+	errors := make([]string, 0)
+	for _, name := range names {
+		backend := config.Backend(name)
+		components, err := backend.ListComponentsContext(ctx)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		componentID, ok := components[component]
+		if !ok {
+			continue
+		}
+		found++
+		if _, err := syncComponent(ctx, backend, component, componentID, firing, message); err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		config.Dedupe.Forwarded(config.TenantName(), name, componentID, alertStatus(firing))
+	}
+	if len(errors) > 0 {
+		return found, fmt.Errorf("%s", strings.Join(errors, ", "))
+	}
+	return found, nil
+}
+
+// save writes the overrides in the state file (o.lock must be held). In HA mode, the file
+// is shared by the replicas, and only written by the leader
+func (o *Overrides) save() {
+	if o.path == "" || !o.ha.IsLeader() {
+		return
+	}
+	file := overridesFile{Overrides: make([]*Override, 0, len(o.overrides))}
+	for _, override := range o.overrides {
+		file.Overrides = append(file.Overrides, override)
+	}
+	sort.Slice(file.Overrides, func(i, j int) bool { return file.Overrides[i].key() < file.Overrides[j].key() })
+
+	content, err := json.Marshal(&file)
+	if err == nil {
+		// write then rename, not to leave a truncated file behind
+		tmp := o.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, content, 0600); err == nil {
+			err = os.Rename(tmp, o.path)
+		}
+	}
+	if err != nil {
+		DefaultLogger().Error("unable to save the overrides", "file", o.path, "error", err)
+	}
+}
+
+// Close stops the timers and saves the overrides, their end being scheduled again at the next start
+func (o *Overrides) Close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.closed = true
+	for _, override := range o.overrides {
+		if override.timer != nil {
+			override.timer.Stop()
+			override.timer = nil
+		}
+	}
+	o.save()
+}
+
+// OverrideRequest is the body of PUT /api/overrides/{component}. The end is given
+// either as a date (expires_at), or as a duration (i.e. "2h")
+type OverrideRequest struct {
+	Status    string    `json:"status" binding:"required"`
+	Reason    string    `json:"reason" binding:"required"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Duration  string    `json:"duration"`
+}
+
+// overrideTenant returns the tenant selected by the tenant query parameter (the main configuration by default)
+func overrideTenant(c *gin.Context, config *PrometheusCachetConfig) *PrometheusCachetConfig {
+	tenant := config.tenantConfig(c.Query("tenant"))
+	if tenant == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown tenant '%s'", c.Query("tenant"))})
+	}
+	return tenant
+}
+
+// ListHandler serves all the overrides
+func (o *Overrides) ListHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"overrides": o.List()})
+}
+
+// GetHandler serves the override of a component
+func (o *Overrides) GetHandler(config *PrometheusCachetConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant := overrideTenant(c, config)
+		if tenant == nil {
+			return
+		}
+		override := o.Get(tenant.TenantName(), c.Param("component"))
+		if override == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no override"})
+			return
+		}
+		c.JSON(http.StatusOK, override)
+	}
+}
+
+// PutHandler overrides a component, and applies its status on the status pages
+func (o *Overrides) PutHandler(config *PrometheusCachetConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant := overrideTenant(c, config)
+		if tenant == nil {
+			return
+		}
+		if c.ContentType() != "application/json" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "expected a JSON body"})
+			return
+		}
+		var request OverrideRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if request.Status != OVERRIDE_OPERATIONAL && request.Status != OVERRIDE_OUTAGE {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown status '%s' (expected operational or outage)", request.Status)})
+			return
+		}
+		now := time.Now().UTC()
+		expiresAt := request.ExpiresAt
+		if request.Duration != "" {
+			duration, err := time.ParseDuration(request.Duration)
+			if err != nil || !expiresAt.IsZero() {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "expected either expires_at, or a valid duration"})
+				return
+			}
+			expiresAt = now.Add(duration)
+		}
+		if !expiresAt.After(now) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the override must expire in the future (expires_at or duration)"})
+			return
+		}
+
+		override := &Override{
+			Tenant:    tenant.TenantName(),
+			Component: c.Param("component"),
+			Status:    request.Status,
+			Reason:    request.Reason,
+			CreatedAt: now,
+			ExpiresAt: expiresAt.UTC(),
+		}
+		logger := LoggerFrom(c.Request.Context()).With("tenant", override.Tenant, "component", override.Component)
+		ctx, cancel := context.WithTimeout(WithLogger(c.Request.Context(), logger), DEFAULT_ADMIN_TIMEOUT)
+		defer cancel()
+
+		found, err := o.Set(ctx, tenant, override)
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("component %s not found on the backends", override.Component)})
+			return
+		}
+		logger.Info("override set", "status", override.Status, "reason", override.Reason, "expires_at", override.ExpiresAt)
+		if err != nil {
+			// the override stays: the alerts of the component are not forwarded
+			logger.Warn("unable to apply the override", "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "override": o.Get(override.Tenant, override.Component)})
+			return
+		}
+		c.JSON(http.StatusOK, o.Get(override.Tenant, override.Component))
+	}
+}
+
+// DeleteHandler ends the override of a component, the status page following its alerts again
+func (o *Overrides) DeleteHandler(config *PrometheusCachetConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant := overrideTenant(c, config)
+		if tenant == nil {
+			return
+		}
+		logger := LoggerFrom(c.Request.Context()).With("tenant", tenant.TenantName(), "component", c.Param("component"))
+		ctx, cancel := context.WithTimeout(WithLogger(c.Request.Context(), logger), DEFAULT_ADMIN_TIMEOUT)
+		defer cancel()
+
+		override, err := o.Delete(ctx, tenant.TenantName(), c.Param("component"))
+		if override == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no override"})
+			return
+		}
+		logger.Info("override removed", "status", override.Status)
+		if err != nil {
+			logger.Warn("unable to apply the alert status after the override", "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
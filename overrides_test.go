@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOverridesConfig(fake *cachetfake.Server) *PrometheusCachetConfig {
+	auth, _ := NewAuthenticator("admin", []string{"adminToken"}, nil, nil)
+	cachet := NewCachetImpl(fake.URL, "1234567890abcdef", fake.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+	return &PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "promToken",
+		Cachet:          cachet,
+		Admin:           NewAdminConsole(auth, 0),
+	}
+}
+
+func overrideRequest(router http.Handler, method, component, body string) *httptest.ResponseRecorder {
+	path := "/api/overrides"
+	if component != "" {
+		path += "/" + component
+	}
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer adminToken")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestOverrides(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	config := newOverridesConfig(fake)
+	router := PrepareGinRouter(config)
+
+	// the admin credentials are needed
+	req := httptest.NewRequest("PUT", "/api/overrides/component21", bytes.NewBufferString(`{}`))
+	req.Header.Set("Authorization", "Bearer promToken")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// forced into outage before any alert
+	w = overrideRequest(router, "PUT", "component21", `{"status":"outage","reason":"datacenter maintenance","duration":"1h"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var override Override
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &override))
+	assert.Equal(t, "datacenter maintenance", override.Reason)
+	assert.Equal(t, DEFAULT_BACKEND, override.Tenant)
+	assert.True(t, override.ExpiresAt.After(time.Now().Add(59*time.Minute)))
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+	assert.Equal(t, float64(override.ExpiresAt.Unix()), config.Metrics.Overrides.Get(DEFAULT_BACKEND, "component21", OVERRIDE_OUTAGE))
+
+	// the alerts do not change the status page
+	sendTestAlert(t, router, "promToken", "resolved", "component21")
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+	assert.Equal(t, float64(1), config.Metrics.AlertsOverridden.Get(DEFAULT_BACKEND))
+	w = overrideRequest(router, "GET", "component21", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"firing":false`)
+
+	// pinned to operational while the alert is known-bad
+	sendTestAlert(t, router, "promToken", "firing", "component21")
+	w = overrideRequest(router, "PUT", "component21", `{"status":"operational","reason":"false positive","duration":"30m"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, cachetfake.INCIDENT_FIXED, lastIncidentStatus(fake))
+	assert.Contains(t, w.Body.String(), `"firing":true`)
+	assert.Equal(t, float64(0), config.Metrics.Overrides.Get(DEFAULT_BACKEND, "component21", OVERRIDE_OUTAGE))
+
+	w = overrideRequest(router, "GET", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"reason":"false positive"`)
+
+	// invalid overrides
+	w = overrideRequest(router, "PUT", "component21", `{"status":"down","reason":"x","duration":"1h"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = overrideRequest(router, "PUT", "component21", `{"status":"outage","reason":"x"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = overrideRequest(router, "PUT", "component21", `{"status":"outage","duration":"1h"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = overrideRequest(router, "PUT", "component99", `{"status":"outage","reason":"x","duration":"1h"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Nil(t, config.Overrides.Get(DEFAULT_BACKEND, "component99"))
+	w = overrideRequest(router, "GET", "component21?tenant=teamz", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// the status page follows the alert again
+	w = overrideRequest(router, "DELETE", "component21", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+	assert.Equal(t, float64(0), config.Metrics.Overrides.Get(DEFAULT_BACKEND, "component21", OVERRIDE_OPERATIONAL))
+	w = overrideRequest(router, "GET", "component21", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = overrideRequest(router, "DELETE", "component21", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestOverrideExpiry(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	config := newOverridesConfig(fake)
+	PrepareGinRouter(config)
+
+	found, err := config.Overrides.Set(context.Background(), config, &Override{
+		Tenant:    DEFAULT_BACKEND,
+		Component: "component21",
+		Status:    OVERRIDE_OUTAGE,
+		Reason:    "test",
+		ExpiresAt: time.Now().Add(100 * time.Millisecond),
+	})
+	assert.True(t, found)
+	assert.Nil(t, err)
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+
+	// without any alert received, the component is operational again at the expiry
+	deadline := time.Now().Add(2 * time.Second)
+	for lastIncidentStatus(fake) != cachetfake.INCIDENT_FIXED && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, cachetfake.INCIDENT_FIXED, lastIncidentStatus(fake))
+	assert.Nil(t, config.Overrides.Get(DEFAULT_BACKEND, "component21"))
+}
+
+// an alert firing before an operational override is applied again at its expiry, and its resends processed
+func TestOverrideExpiryFiring(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	config := newOverridesConfig(fake)
+	config.Dedupe = NewDeduplicator(DEFAULT_DEDUPE_TTL)
+	router := PrepareGinRouter(config)
+
+	sendTestAlert(t, router, "promToken", "firing", "component21")
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+	w := overrideRequest(router, "PUT", "component21", `{"status":"operational","reason":"false positive","duration":"100ms"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"firing":true`)
+	assert.Equal(t, cachetfake.INCIDENT_FIXED, lastIncidentStatus(fake))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for lastIncidentStatus(fake) != cachetfake.INCIDENT_IDENTIFIED && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+	assert.True(t, config.Dedupe.Claim(DedupeKey(DEFAULT_BACKEND, DEFAULT_BACKEND, "", "f1a2", "firing", ""), DEFAULT_BACKEND, "component21"))
+}
+
+func TestOverridesPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "overrides.json")
+
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	config := newOverridesConfig(fake)
+	config.Overrides, err = NewOverrides(path)
+	assert.Nil(t, err)
+	PrepareGinRouter(config)
+
+	_, err = config.Overrides.Set(context.Background(), config, &Override{
+		Tenant:    DEFAULT_BACKEND,
+		Component: "component21",
+		Status:    OVERRIDE_OPERATIONAL,
+		Reason:    "known-bad alert",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	assert.Nil(t, err)
+	config.Overrides.Overridden(DEFAULT_BACKEND, "component21", true)
+	config.Overrides.Close()
+
+	overrides, err := NewOverrides(path)
+	assert.Nil(t, err)
+	override := overrides.Get(DEFAULT_BACKEND, "component21")
+	assert.NotNil(t, override)
+	assert.Equal(t, "known-bad alert", override.Reason)
+	assert.True(t, *override.Firing)
+
+	restarted := newOverridesConfig(fake)
+	restarted.Overrides = overrides
+	PrepareGinRouter(restarted)
+	assert.True(t, restarted.Metrics.Overrides.Get(DEFAULT_BACKEND, "component21", OVERRIDE_OPERATIONAL) > 0)
+	overrides.Close()
+}
+
+// an override set while a transition is held down pins the status: the transition is dropped
+func TestOverrideHoldDown(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	config := newOverridesConfig(fake)
+	config.Routes = []Route{{Match: map[string]string{"alertname": "component21"}, Backends: []string{DEFAULT_BACKEND}, HoldDown: HoldDownPolicy{FireAfter: 100 * time.Millisecond}}}
+	router := PrepareGinRouter(config)
+
+	sendTestAlert(t, router, "promToken", "firing", "component21")
+	assert.Equal(t, 0, lastIncidentStatus(fake))
+	w := overrideRequest(router, "PUT", "component21", `{"status":"operational","reason":"false positive","duration":"1h"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.NotEqual(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+	assert.Equal(t, float64(1), config.Metrics.AlertsOverridden.Get(DEFAULT_BACKEND))
+	assert.Equal(t, float64(0), config.Metrics.IncidentsForwarded.Get(DEFAULT_BACKEND, DEFAULT_BACKEND))
+	config.HoldDown.lock.Lock()
+	assert.Equal(t, 0, len(config.HoldDown.states))
+	config.HoldDown.lock.Unlock()
+
+	// the alert still firing is applied when the override ends
+	w = overrideRequest(router, "GET", "component21", "")
+	assert.Contains(t, w.Body.String(), `"firing":true`)
+	w = overrideRequest(router, "DELETE", "component21", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DEFAULT_READY_CACHE is how long a readiness result is reused, to not hammer the backends
+	DEFAULT_READY_CACHE = 5 * time.Second
+	// DEFAULT_READY_TIMEOUT bounds the check of one backend
+	DEFAULT_READY_TIMEOUT = 5 * time.Second
+)
+
+// Pinger is implemented by the backends able to check their reachability and
+// the validity of their credentials, beyond listing the components
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// pingBackend pings the backend if it is a Pinger (the wrappers forward the ping with it)
+func pingBackend(ctx context.Context, backend Cachet) error {
+	if pinger, ok := backend.(Pinger); ok {
+		return pinger.PingContext(ctx)
+	}
+	return nil
+}
+
+// BackendReadiness is the result of the last check of a backend
+type BackendReadiness struct {
+	Ready     bool   `json:"ready"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+	// LastError is kept after the backend recovered
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Components  int        `json:"components"`
+	// ComponentsAge is the age (in seconds) of the last successful components listing
+	ComponentsAge *float64 `json:"components_age_seconds,omitempty"`
+
+	componentsAt time.Time
+}
+
+// ReadinessChecker checks that every backend is reachable with a valid token
+type ReadinessChecker struct {
+	backends map[string]Cachet
+	cacheFor time.Duration
+	timeout  time.Duration
+
+	lock      sync.Mutex
+	checkedAt time.Time
+	ready     bool
+	results   map[string]*BackendReadiness
+}
+
+func NewReadinessChecker(backends map[string]Cachet, cacheFor, timeout time.Duration) *ReadinessChecker {
+	return &ReadinessChecker{
+		backends: backends,
+		cacheFor: cacheFor,
+		timeout:  timeout,
+		results:  make(map[string]*BackendReadiness),
+	}
+}
+
+// ReadinessBackends returns all the backends served by the bridge, the tenants
+// ones being prefixed by "<tenant>/"
+func (config *PrometheusCachetConfig) ReadinessBackends() map[string]Cachet {
+	backends := make(map[string]Cachet)
+	add := func(prefix string, c *PrometheusCachetConfig) {
+		if c.Cachet != nil {
+			backends[prefix+DEFAULT_BACKEND] = c.Cachet
+		}
+		for name, backend := range c.Backends {
+			backends[prefix+name] = backend
+		}
+	}
+	add("", config)
+	for name, tenant := range config.Tenants {
+		add(name+"/", tenant)
+	}
+	return backends
+}
+
+// checkBackend pings the backend (if possible), then lists its components
+func (r *ReadinessChecker) checkBackend(ctx context.Context, backend Cachet, result *BackendReadiness) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := pingBackend(ctx, backend)
+	if err == nil {
+		var components map[string]int
+		if components, err = backend.ListComponentsContext(ctx); err == nil {
+			result.Components = len(components)
+			result.componentsAt = time.Now()
+		}
+	}
+	result.LatencyMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+
+	result.Ready = err == nil
+	result.Error = ""
+	if err != nil {
+		now := time.Now()
+		result.Error = err.Error()
+		result.LastError = result.Error
+		result.LastErrorAt = &now
+	}
+}
+
+// Check returns the readiness of all the backends, checking them again
+// if the previous result is older than the cache duration
+func (r *ReadinessChecker) Check(ctx context.Context) (bool, map[string]BackendReadiness) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.checkedAt.IsZero() || time.Since(r.checkedAt) >= r.cacheFor {
+		var wg sync.WaitGroup
+		for name, backend := range r.backends {
+			result, ok := r.results[name]
+			if !ok {
+				result = &BackendReadiness{}
+				r.results[name] = result
+			}
+			wg.Add(1)
+			go func(backend Cachet, result *BackendReadiness) {
+				defer wg.Done()
+				r.checkBackend(ctx, backend, result)
+			}(backend, result)
+		}
+		wg.Wait()
+
+		r.checkedAt = time.Now()
+		r.ready = true
+		for _, result := range r.results {
+			r.ready = r.ready && result.Ready
+		}
+	}
+
+	results := make(map[string]BackendReadiness, len(r.results))
+	for name, result := range r.results {
+		copyresult := *result
+		if !result.componentsAt.IsZero() {
+			age := time.Since(result.componentsAt).Seconds()
+			copyresult.ComponentsAge = &age
+		}
+		results[name] = copyresult
+	}
+	return r.ready, results
+}
+
+// Handler answers 200 if all the backends are ready, 503 otherwise
+func (r *ReadinessChecker) Handler(c *gin.Context) {
+	// the result is shared with the other probes: an impatient client must not cancel it
+	ready, results := r.Check(context.Background())
+
+	status := http.StatusOK
+	answer := "ready"
+	if !ready {
+		status = http.StatusServiceUnavailable
+		answer = "unready"
+	}
+
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	unready := make([]string, 0)
+	for _, name := range names {
+		if !results[name].Ready {
+			unready = append(unready, name)
+		}
+	}
+
+	c.JSON(status, gin.H{
+		"status":   answer,
+		"unready":  unready,
+		"backends": results,
+	})
+}
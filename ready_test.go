@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyEndpoint(t *testing.T) {
+	pings := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/ping":
+			pings++
+			io.WriteString(w, `{"data":"Pong!"}`)
+		case "/api/v1/subscribers":
+			if r.Header.Get("X-Cachet-Token") != "good" {
+				w.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(w, `{"errors":[{"status":401,"title":"Unauthorized"}]}`)
+				return
+			}
+			io.WriteString(w, `{"data":[]}`)
+		case "/api/v1/components":
+			io.WriteString(w, `{"meta":{"pagination":{"current_page":1,"total_pages":1}},"data":[{"id":1,"name":"API"},{"id":2,"name":"Web"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	good := NewCachetImpl(ts.URL, "good", ts.Client())
+	good.SetAPIVersion(CACHET_API_V2)
+	bad := NewCachetImpl(ts.URL, "bad", ts.Client())
+	bad.SetAPIVersion(CACHET_API_V2)
+
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		Cachet:    WithCallTimeout(good, time.Second),
+	}
+	router := PrepareGinRouter(&config)
+
+	var answer struct {
+		Status   string                      `json:"status"`
+		Unready  []string                    `json:"unready"`
+		Backends map[string]BackendReadiness `json:"backends"`
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &answer))
+	assert.Equal(t, "ready", answer.Status)
+	assert.True(t, answer.Backends[DEFAULT_BACKEND].Ready)
+	assert.Equal(t, 2, answer.Backends[DEFAULT_BACKEND].Components)
+	assert.NotNil(t, answer.Backends[DEFAULT_BACKEND].ComponentsAge)
+	assert.Equal(t, 1, pings)
+
+	// the result is cached
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, pings)
+
+	// a wrong token makes the bridge unready
+	config = PrometheusCachetConfig{
+		LabelName: "alertname",
+		Cachet:    good,
+		Backends:  map[string]Cachet{"internal": bad},
+	}
+	router = PrepareGinRouter(&config)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &answer))
+	assert.Equal(t, "unready", answer.Status)
+	assert.Equal(t, []string{"internal"}, answer.Unready)
+	assert.Contains(t, answer.Backends["internal"].Error, "401")
+	assert.Equal(t, answer.Backends["internal"].Error, answer.Backends["internal"].LastError)
+	assert.True(t, answer.Backends[DEFAULT_BACKEND].Ready)
+}
+
+// the last error is kept once the backend recovered
+func TestReadinessCheckerLastError(t *testing.T) {
+	failing := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, `{"meta":{"pagination":{"current_page":1,"total_pages":1}},"data":[]}`)
+	}))
+	defer ts.Close()
+
+	cachet := NewCachetImpl(ts.URL, "good", ts.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+	checker := NewReadinessChecker(map[string]Cachet{"default": cachet}, 0, time.Second)
+
+	ready, results := checker.Check(context.Background())
+	assert.False(t, ready)
+	assert.Contains(t, results["default"].Error, "502")
+	assert.Nil(t, results["default"].ComponentsAge)
+
+	failing = false
+	ready, results = checker.Check(context.Background())
+	assert.True(t, ready)
+	assert.Equal(t, "", results["default"].Error)
+	assert.Contains(t, results["default"].LastError, "502")
+	assert.NotNil(t, results["default"].LastErrorAt)
+}
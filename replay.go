@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+)
+
+const (
+	// DEFAULT_RECORD_MAX_SIZE is the size (in MB) of the record file triggering a rotation
+	DEFAULT_RECORD_MAX_SIZE = 100
+	// DEFAULT_RECORD_MAX_FILES is the number of rotated record files kept
+	DEFAULT_RECORD_MAX_FILES = 5
+)
+
+// the backends the webhooks can be replayed against
+const (
+	REPLAY_TARGET_REAL    = "real"
+	REPLAY_TARGET_DRY_RUN = "dry-run"
+	REPLAY_TARGET_FAKE    = "fake"
+)
+
+// RecordedWebhook is a webhook received on /alert, as written in the record file
+type RecordedWebhook struct {
+	Time time.Time `json:"time"`
+	// Tenant is empty for the main /alert endpoint
+	Tenant    string            `json:"tenant,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      json.RawMessage   `json:"body"`
+}
+
+// WebhookRecorder appends the webhooks received to a rotated JSON lines file, to replay them later
+type WebhookRecorder struct {
+	*rotatingFile
+}
+
+func NewWebhookRecorder(path string, maxSize int64, maxFiles int) (*WebhookRecorder, error) {
+	file, err := newRotatingFile(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookRecorder{file}, nil
+}
+
+// Record writes the webhook being handled (if r is not nil), without its secret headers.
+// The request body is left readable
+func (r *WebhookRecorder) Record(c *gin.Context, tenant string) {
+	if r == nil {
+		return
+	}
+	logger := LoggerFrom(c.Request.Context())
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil || !json.Valid(body) {
+		logger.Debug("webhook payload not recorded: not JSON")
+		return
+	}
+
+	webhook := RecordedWebhook{
+		Time:      time.Now().UTC(),
+		Tenant:    tenant,
+		RequestID: RequestIDFrom(c.Request.Context()),
+		Headers:   recordedHeaders(c.Request.Header),
+		Body:      json.RawMessage(body),
+	}
+	if err := r.append(&webhook); err != nil {
+		logger.Error("unable to record the webhook", "error", err)
+	}
+}
+
+// recordedHeaders returns the headers worth replaying: the credentials are left out
+func recordedHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for name, values := range header {
+		if isSecretHeader(name) || len(values) == 0 {
+			continue
+		}
+		headers[name] = values[0]
+	}
+	return headers
+}
+
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"auth", "token", "secret", "password", "cookie", "key"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadRecordedWebhooks reads a record file, the unreadable lines being reported as an error
+func ReadRecordedWebhooks(path string) ([]*RecordedWebhook, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	webhooks := make([]*RecordedWebhook, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var webhook RecordedWebhook
+		if err := json.Unmarshal(scanner.Bytes(), &webhook); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	return webhooks, scanner.Err()
+}
+
+// ReplayChange is a change requested to a backend while replaying a webhook
+type ReplayChange struct {
+	Backend         string
+	Action          string
+	Component       string
+	IncidentID      int
+	Status          int
+	ComponentStatus int
+	Message         string
+	Error           error
+}
+
+// ReplayResult is the outcome of a replayed webhook
+type ReplayResult struct {
+	Webhook *RecordedWebhook
+	// Code and Answer are the HTTP answer of the bridge
+	Code    int
+	Answer  string
+	Changes []ReplayChange
+}
+
+// replayingCachet reports the changes requested to the backends
+type replayingCachet struct {
+	backend Cachet
+	tenant  string
+	name    string
+	report  *replayReport
+}
+
+type replayReport struct {
+	lock    sync.Mutex
+	changes []ReplayChange
+}
+
+func (r *replayReport) add(change ReplayChange) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.changes = append(r.changes, change)
+}
+
+// take returns the changes reported since the last call
+func (r *replayReport) take() []ReplayChange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	changes := r.changes
+	r.changes = nil
+	return changes
+}
+
+// backendName prefixes the backends of the tenants with "<tenant>/"
+func (r *replayingCachet) backendName() string {
+	if r.tenant == DEFAULT_BACKEND {
+		return r.name
+	}
+	return r.tenant + "/" + r.name
+}
+
+func (r *replayingCachet) PingContext(ctx context.Context) error {
+	return pingBackend(ctx, r.backend)
+}
+
+func (r *replayingCachet) CheckWriteContext(ctx context.Context) error {
+	return checkBackendWrite(ctx, r.backend)
+}
+
+func (r *replayingCachet) ListComponentsContext(ctx context.Context) (map[string]int, error) {
+	return r.backend.ListComponentsContext(ctx)
+}
+
+func (r *replayingCachet) SearchComponentContext(ctx context.Context, name string) (int, error) {
+	return r.backend.SearchComponentContext(ctx, name)
+}
+
+func (r *replayingCachet) ReadIncidentContext(ctx context.Context, incidentId int) (*CachetIncident, error) {
+	return r.backend.ReadIncidentContext(ctx, incidentId)
+}
+
+func (r *replayingCachet) SearchIncidentsContext(ctx context.Context, componentId int) ([]*CachetIncident, error) {
+	return r.backend.SearchIncidentsContext(ctx, componentId)
+}
+
+func (r *replayingCachet) CreateIncidentContext(ctx context.Context, componentName string, componentID, status int, componentStatus int) error {
+	err := r.backend.CreateIncidentContext(ctx, componentName, componentID, status, componentStatus)
+	incidentStatus, _ := incidentStatuses(status)
+	r.report.add(ReplayChange{
+		Backend:         r.backendName(),
+		Action:          AUDIT_INCIDENT_CREATED,
+		Component:       componentName,
+		Status:          incidentStatus,
+		ComponentStatus: componentStatus,
+		Error:           err,
+	})
+	return err
+}
+
+func (r *replayingCachet) UpdateIncidentContext(ctx context.Context, componentName string, componentID, incidentId, status int, message string) error {
+	err := r.backend.UpdateIncidentContext(ctx, componentName, componentID, incidentId, status, message)
+	incidentStatus, componentStatus := incidentStatuses(status)
+	r.report.add(ReplayChange{
+		Backend:         r.backendName(),
+		Action:          AUDIT_INCIDENT_UPDATED,
+		Component:       componentName,
+		IncidentID:      incidentId,
+		Status:          incidentStatus,
+		ComponentStatus: componentStatus,
+		Message:         message,
+		Error:           err,
+	})
+	return err
+}
+
+func (r *replayingCachet) WatchIncidentContext(ctx context.Context, componentName string, componentID, incidentId int, message string) error {
+	err := watchBackendIncident(ctx, r.backend, componentName, componentID, incidentId, message)
+	r.report.add(ReplayChange{
+		Backend:    r.backendName(),
+		Action:     AUDIT_INCIDENT_WATCHING,
+		Component:  componentName,
+		IncidentID: incidentId,
+		Status:     3, // "Watching"
+		Message:    message,
+		Error:      err,
+	})
+	return err
+}
+
+// replayComponents returns the components alerted in the webhooks (the values of the label
+// names of the configuration), to populate the fake backends
+func replayComponents(config *PrometheusCachetConfig, webhooks []*RecordedWebhook) []string {
+	labelNames := map[string]bool{config.LabelName: true}
+	for _, tenant := range config.Tenants {
+		labelNames[tenant.LabelName] = true
+	}
+
+	seen := make(map[string]bool)
+	components := make([]string, 0)
+	for _, webhook := range webhooks {
+		var alerts PrometheusAlert
+		if json.Unmarshal(webhook.Body, &alerts) != nil {
+			continue
+		}
+		for _, alert := range alerts.Alerts {
+			for name := range labelNames {
+				if component := alert.Labels[name]; component != "" && !seen[component] {
+					seen[component] = true
+					components = append(components, component)
+				}
+			}
+		}
+	}
+	return components
+}
+
+// holdDownRoutes returns the routes of the configuration and of its tenants having a hold-down
+func holdDownRoutes(config *PrometheusCachetConfig) []*Route {
+	configs := []*PrometheusCachetConfig{config}
+	for _, tenant := range config.Tenants {
+		configs = append(configs, tenant)
+	}
+	routes := make([]*Route, 0)
+	for _, c := range configs {
+		for i := range c.Routes {
+			if c.Routes[i].HoldDown.Enabled() {
+				routes = append(routes, &c.Routes[i])
+			}
+		}
+	}
+	return routes
+}
+
+// Replay feeds the recorded webhooks to SubmitAlert, against the real backends of the
+// configuration, the real backends in dry-run, or in-process fake CachetHQ. The hold-down
+// is disabled: the changes are applied when the webhook is replayed
+func Replay(config *PrometheusCachetConfig, webhooks []*RecordedWebhook, target string) ([]*ReplayResult, error) {
+	switch target {
+	case REPLAY_TARGET_REAL:
+	case REPLAY_TARGET_DRY_RUN:
+		if config.DryRun == nil {
+			config.DryRun = NewDryRunRecorder(DEFAULT_DRY_RUN_HISTORY)
+		}
+		config.WrapBackends(func(tenant, name string, backend Cachet) Cachet {
+			return WithDryRun(backend, tenant, name, config.DryRun)
+		})
+	case REPLAY_TARGET_FAKE:
+		components := replayComponents(config, webhooks)
+		config.WrapBackends(func(tenant, name string, backend Cachet) Cachet {
+			if backend == nil {
+				return nil
+			}
+			fake := cachetfake.NewHandler()
+			for _, component := range components {
+				fake.AddComponent(component, 0)
+			}
+			cachet := NewCachetImpl(fake.URL, "", fake.Client())
+			cachet.SetAPIVersion(CACHET_API_V2)
+			return cachet
+		})
+	default:
+		return nil, fmt.Errorf("unknown target '%s' (expected real, dry-run or fake)", target)
+	}
+
+	report := &replayReport{}
+	config.WrapBackends(func(tenant, name string, backend Cachet) Cachet {
+		if backend == nil {
+			return nil
+		}
+		return &replayingCachet{backend: backend, tenant: tenant, name: name, report: report}
+	})
+	// the hold-down timers would expire in wall-clock time, long after the webhooks were replayed:
+	// the alerts are forwarded at once, their changes being reported with the webhook
+	if routes := holdDownRoutes(config); len(routes) > 0 {
+		DefaultLogger().Warn("hold-down disabled during the replay, the alerts are forwarded at once", "routes", len(routes))
+		for _, route := range routes {
+			route.HoldDown = HoldDownPolicy{}
+		}
+	}
+	// prepares the configuration (metrics, hold-down...) as when serving
+	PrepareGinRouter(config)
+
+	results := make([]*ReplayResult, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		result := &ReplayResult{Webhook: webhook}
+		results = append(results, result)
+
+		target := config
+		if webhook.Tenant != "" {
+			var ok bool
+			if target, ok = config.Tenants[webhook.Tenant]; !ok {
+				result.Code = http.StatusNotFound
+				result.Answer = `{"error":"unknown tenant"}`
+				continue
+			}
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/alert", bytes.NewReader(webhook.Body))
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range webhook.Headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		logger := DefaultLogger().With("request_id", webhook.RequestID)
+		req = req.WithContext(WithLogger(context.Background(), logger))
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = req
+		SubmitAlert(c, target)
+
+		result.Code = w.Code
+		result.Answer = strings.TrimSpace(w.Body.String())
+		result.Changes = report.take()
+	}
+	return results, nil
+}
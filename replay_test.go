@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hook, calls := newDryRunHook()
+	defer hook.Close()
+
+	recorder, err := NewWebhookRecorder(filepath.Join(dir, "webhooks.jsonl"), 0, 0)
+	assert.Nil(t, err)
+	defer recorder.Close()
+
+	config := PrometheusCachetConfig{
+		LabelName:       "alertname",
+		PrometheusToken: "secret",
+		Cachet:          NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+		Recorder:        recorder,
+	}
+	router := PrepareGinRouter(&config)
+
+	jsonStr := `{"receiver":"cachethq-receiver","groupKey":"{}:{alertname=\"component21\"}","status":"firing","alerts":[{"status":"firing","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}`
+	req := httptest.NewRequest("POST", "/alert", bytes.NewBufferString(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Api-Key", "secret")
+	req.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// the recorded webhook is still processed
+	assert.Equal(t, 1, calls())
+
+	// rejected webhooks are not recorded
+	req = httptest.NewRequest("POST", "/alert", bytes.NewBufferString(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	webhooks, err := ReadRecordedWebhooks(filepath.Join(dir, "webhooks.jsonl"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(webhooks))
+	assert.Equal(t, "", webhooks[0].Tenant)
+	assert.Equal(t, "req-1", webhooks[0].RequestID)
+	assert.Equal(t, "application/json", webhooks[0].Headers["Content-Type"])
+	assert.NotContains(t, webhooks[0].Headers, "Authorization")
+	assert.NotContains(t, webhooks[0].Headers, "X-Api-Key")
+	assert.JSONEq(t, jsonStr, string(webhooks[0].Body))
+}
+
+func writeRecordFile(t *testing.T, dir string, lines ...string) string {
+	filename := filepath.Join(dir, "webhooks.jsonl")
+	content := ""
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	assert.Nil(t, ioutil.WriteFile(filename, []byte(content), 0600))
+	return filename
+}
+
+func TestReplayCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := writeRecordFile(t, dir,
+		`{"time":"2026-10-11T20:00:00Z","body":{"receiver":"cachethq-receiver","groupKey":"{}:{alertname=\"component21\"}","status":"firing","alerts":[{"status":"firing","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}}`,
+		`{"time":"2026-10-11T20:10:00Z","body":{"receiver":"cachethq-receiver","groupKey":"{}:{alertname=\"component21\"}","status":"resolved","alerts":[{"status":"resolved","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}}`,
+	)
+
+	// fake backends: the whole story is played in memory
+	code, stdout, _ := runTestCommand("replay", filename, "--target", "fake", "-squash_incident", "-cachethq_url", "http://127.0.0.1:1")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "2026-10-11T20:00:00Z default firing {}:{alertname=\"component21\"}: 200\n  default component21 incident_created status=2 component_status=4\n")
+	assert.Contains(t, stdout, "  default component21 incident_updated status=4 component_status=1 incident=1\n")
+	assert.Contains(t, stdout, "2 webhook(s) replayed against fake backends: 3 change(s), 0 failure(s)\n")
+
+	// dry-run: the incident open on CachetHQ is read, but not updated
+	cachethq := newCommandCachetHQ()
+	defer cachethq.Close()
+	code, stdout, _ = runTestCommand("replay", filename, "-squash_incident", "-cachethq_url", cachethq.URL, "-cachethq_api_version", "2")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "  default component21 incident_updated status=4 component_status=1 incident=1\n")
+	assert.Contains(t, stdout, "against dry-run backends: 2 change(s), 0 failure(s)\n")
+	incident, _ := cachethq.Incident(1)
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, incident.Status)
+
+	// unknown tenant
+	filename = writeRecordFile(t, dir, `{"time":"2026-10-11T20:00:00Z","tenant":"teamz","body":{"status":"firing","alerts":[],"version":"4"}}`)
+	code, stdout, _ = runTestCommand("replay", filename, "--target", "fake")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout, "teamz firing : 404\n")
+
+	code, _, stderr := runTestCommand("replay", filename, "--target", "staging")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "unknown target 'staging'")
+}
+
+// the hold-down is disabled: the changes are reported with their webhook
+func TestReplayHoldDown(t *testing.T) {
+	config := &PrometheusCachetConfig{
+		LabelName: "alertname",
+		Cachet:    NewWebhookImpl("http://127.0.0.1:1", nil, nil, http.DefaultClient),
+		Routes:    []Route{{Match: map[string]string{"alertname": "component21"}, Backends: []string{DEFAULT_BACKEND}, HoldDown: HoldDownPolicy{FireAfter: time.Hour}}},
+	}
+	webhooks := []*RecordedWebhook{{
+		Time: time.Now(),
+		Body: []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}`),
+	}}
+
+	results, err := Replay(config, webhooks, REPLAY_TARGET_FAKE)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, http.StatusOK, results[0].Code)
+	assert.Equal(t, 1, len(results[0].Changes))
+	assert.Equal(t, AUDIT_INCIDENT_CREATED, results[0].Changes[0].Action)
+	assert.False(t, config.Routes[0].HoldDown.Enabled())
+}
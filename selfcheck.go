@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	STARTUP_CHECK_OFF   = "off"
+	STARTUP_CHECK_WARN  = "warn"
+	STARTUP_CHECK_FATAL = "fatal"
+)
+
+// DEFAULT_STARTUP_CHECK_TIMEOUT bounds the check of one backend at startup
+const DEFAULT_STARTUP_CHECK_TIMEOUT = 10 * time.Second
+
+// WriteChecker is implemented by the backends able to check that their
+// credentials allow to write incidents, without creating one
+type WriteChecker interface {
+	CheckWriteContext(ctx context.Context) error
+}
+
+// checkBackendWrite checks the backend credentials if it is a WriteChecker
+func checkBackendWrite(ctx context.Context, backend Cachet) error {
+	if checker, ok := backend.(WriteChecker); ok {
+		return checker.CheckWriteContext(ctx)
+	}
+	return nil
+}
+
+// SelfCheckReport lists the problems found by SelfCheck. Errors make the bridge
+// unable to forward alerts, warnings are likely configuration mistakes
+type SelfCheckReport struct {
+	Errors   []string
+	Warnings []string
+}
+
+// selfCheckBackend pings the backend, checks its token can write incidents and
+// returns its components
+func selfCheckBackend(ctx context.Context, backend Cachet, timeout time.Duration) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := pingBackend(ctx, backend); err != nil {
+		return nil, fmt.Errorf("ping failed: %v", err)
+	}
+	if err := checkBackendWrite(ctx, backend); err != nil {
+		return nil, fmt.Errorf("write check failed: %v", err)
+	}
+	components, err := backend.ListComponentsContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the components: %v", err)
+	}
+	return components, nil
+}
+
+// selfCheckConfig checks the backends of a (tenant) configuration, and warns about
+// the routes selecting a component (through the label name) unknown to their backends
+func selfCheckConfig(ctx context.Context, prefix string, config *PrometheusCachetConfig, timeout time.Duration, report *SelfCheckReport) {
+	backends := make(map[string]Cachet)
+	if config.Cachet != nil {
+		backends[DEFAULT_BACKEND] = config.Cachet
+	}
+	for name, backend := range config.Backends {
+		backends[name] = backend
+	}
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	components := make(map[string]map[string]int)
+	for _, name := range names {
+		list, err := selfCheckBackend(ctx, backends[name], timeout)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("backend %s%s: %v", prefix, name, err))
+			continue
+		}
+		if len(list) == 0 {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("backend %s%s: no component defined", prefix, name))
+		}
+		components[name] = list
+	}
+
+	for i, route := range config.Routes {
+		component, ok := route.Match[config.LabelName]
+		if !ok {
+			continue
+		}
+		for _, backendName := range route.Backends {
+			list, checked := components[backendName]
+			if !checked {
+				continue
+			}
+			if _, found := list[component]; !found {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("route %d%s: component '%s' (label %s) does not exist in backend %s%s",
+					i, tenantSuffix(prefix), component, config.LabelName, prefix, backendName))
+			}
+		}
+	}
+}
+
+func tenantSuffix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return " of tenant " + prefix[:len(prefix)-1]
+}
+
+// SelfCheck verifies the backends of the bridge and its tenants are reachable with
+// a token allowed to write incidents, and that the routed components exist
+func SelfCheck(ctx context.Context, config *PrometheusCachetConfig, timeout time.Duration) *SelfCheckReport {
+	report := &SelfCheckReport{}
+	selfCheckConfig(ctx, "", config, timeout, report)
+
+	tenants := make([]string, 0, len(config.Tenants))
+	for name := range config.Tenants {
+		tenants = append(tenants, name)
+	}
+	sort.Strings(tenants)
+	for _, name := range tenants {
+		selfCheckConfig(ctx, name+"/", config.Tenants[name], timeout, report)
+	}
+	return report
+}
+
+// RunStartupCheck runs the SelfCheck according to the mode (off, warn or fatal).
+// It returns an error only if the mode is fatal and a backend is unusable
+func RunStartupCheck(mode string, config *PrometheusCachetConfig) error {
+	switch mode {
+	case STARTUP_CHECK_OFF:
+		return nil
+	case STARTUP_CHECK_WARN, STARTUP_CHECK_FATAL:
+	default:
+		return fmt.Errorf("unknown startup check mode '%s' (expected off, warn or fatal)", mode)
+	}
+
+	report := SelfCheck(context.Background(), config, DEFAULT_STARTUP_CHECK_TIMEOUT)
+	for _, warning := range report.Warnings {
+		DefaultLogger().Warn("startup check", "warning", warning)
+	}
+	for _, err := range report.Errors {
+		DefaultLogger().Error("startup check", "error", err)
+	}
+	if len(report.Errors) > 0 && mode == STARTUP_CHECK_FATAL {
+		return fmt.Errorf("startup check failed for %d backend(s)", len(report.Errors))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+	"github.com/stretchr/testify/assert"
+)
+
+// the fake CachetHQ accepts the "writer" token to write incidents, the "reader" one only to read
+func newSelfCheckServer(t *testing.T) *cachetfake.Server {
+	fake := cachetfake.NewServer()
+	fake.SetToken("writer")
+	fake.SetReadOnlyToken("reader")
+	fake.AddComponent("component21", 0)
+	return fake
+}
+
+func TestSelfCheck(t *testing.T) {
+	ts := newSelfCheckServer(t)
+	defer ts.Close()
+
+	writer := NewCachetImpl(ts.URL, "writer", ts.Client())
+	writer.SetAPIVersion(CACHET_API_V2)
+	reader := NewCachetImpl(ts.URL, "reader", ts.Client())
+	reader.SetAPIVersion(CACHET_API_V2)
+
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		Cachet:    writer,
+		Routes: []Route{
+			{Match: map[string]string{"alertname": "component21"}, Backends: []string{DEFAULT_BACKEND}},
+			{Match: map[string]string{"alertname": "component99"}, Backends: []string{DEFAULT_BACKEND}},
+			{Match: map[string]string{"team": "web"}, Backends: []string{DEFAULT_BACKEND}},
+		},
+		Tenants: map[string]*PrometheusCachetConfig{
+			"teama": {
+				LabelName: "service",
+				Cachet:    WithCallTimeout(reader, time.Second),
+			},
+		},
+	}
+
+	report := SelfCheck(context.Background(), &config, time.Second)
+	assert.Equal(t, []string{"route 1: component 'component99' (label alertname) does not exist in backend default"}, report.Warnings)
+	assert.Equal(t, 1, len(report.Errors))
+	assert.Contains(t, report.Errors[0], "backend teama/default: write check failed")
+	assert.Contains(t, report.Errors[0], "403")
+	// the write check leaves the status page untouched
+	assert.Equal(t, 0, len(ts.Incidents(0)))
+
+	// a CachetHQ accepting the check would have changed something
+	ts.InjectFault(cachetfake.Fault{Method: "PUT", Path: "/api/v1/incidents/0", Status: 200, Body: "{}", Count: 1})
+	assert.NotNil(t, writer.CheckWriteContext(context.Background()))
+	assert.Nil(t, writer.CheckWriteContext(context.Background()))
+
+	assert.Nil(t, RunStartupCheck(STARTUP_CHECK_OFF, &config))
+	assert.Nil(t, RunStartupCheck(STARTUP_CHECK_WARN, &config))
+	assert.NotNil(t, RunStartupCheck(STARTUP_CHECK_FATAL, &config))
+	assert.NotNil(t, RunStartupCheck("maybe", &config))
+
+	delete(config.Tenants, "teama")
+	assert.Nil(t, RunStartupCheck(STARTUP_CHECK_FATAL, &config))
+}
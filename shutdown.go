@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DEFAULT_SHUTDOWN_TIMEOUT is how long we wait for the in-flight work at shutdown
+const DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// Lifecycle tracks the in-flight work (webhooks being processed, queued actions),
+// and the hooks flushing the persistent state at shutdown
+type Lifecycle struct {
+	lock     sync.Mutex
+	inflight sync.WaitGroup
+	stopping bool
+	stop     chan struct{}
+	hooks    []func()
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{
+		stop: make(chan struct{}),
+	}
+}
+
+// Begin registers a new piece of work. It returns false if we are shutting down
+func (l *Lifecycle) Begin() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopping {
+		return false
+	}
+	l.inflight.Add(1)
+	return true
+}
+
+// End is to be called when the work registered by Begin is done
+func (l *Lifecycle) End() {
+	l.inflight.Done()
+}
+
+// Stopping is closed when the shutdown starts, to stop the background goroutines
+func (l *Lifecycle) Stopping() <-chan struct{} {
+	return l.stop
+}
+
+// OnShutdown registers a hook called at shutdown, once the in-flight work is done
+func (l *Lifecycle) OnShutdown(hook func()) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.hooks = append(l.hooks, hook)
+}
+
+// Shutdown refuses new work, waits for the in-flight work (until the ctx deadline),
+// then calls the shutdown hooks
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.lock.Lock()
+	if !l.stopping {
+		l.stopping = true
+		close(l.stop)
+	}
+	hooks := l.hooks
+	l.hooks = nil
+	l.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// we flush even if some work did not finish in time
+	for _, hook := range hooks {
+		hook()
+	}
+	return err
+}
+
+// Middleware tracks the requests as in-flight work, and answers 503 once we are shutting down
+func (l *Lifecycle) Middleware(c *gin.Context) {
+	if !l.Begin() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "shutting down"})
+		return
+	}
+	defer l.End()
+	c.Next()
+}
+
+// ServeUntilSignal runs the server (listen is ListenAndServe or ListenAndServeTLS) until a
+// signal is received, then stops accepting new connections and drains the in-flight work
+func ServeUntilSignal(server *http.Server, listen func() error, signals <-chan os.Signal, lifecycle *Lifecycle, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- listen()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		DefaultLogger().Info("shutting down, waiting for the in-flight work", "signal", sig, "timeout", timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if lifecycleErr := lifecycle.Shutdown(ctx); err == nil {
+		err = lifecycleErr
+	}
+	if err != nil {
+		DefaultLogger().Error("shutdown did not complete", "error", err)
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycle(t *testing.T) {
+	lifecycle := NewLifecycle()
+	flushed := false
+	lifecycle.OnShutdown(func() { flushed = true })
+
+	assert.True(t, lifecycle.Begin())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lifecycle.End()
+	}()
+
+	assert.Nil(t, lifecycle.Shutdown(context.Background()))
+	assert.True(t, flushed)
+	assert.False(t, lifecycle.Begin())
+
+	select {
+	case <-lifecycle.Stopping():
+	default:
+		t.Error("Stopping() should be closed")
+	}
+}
+
+func TestLifecycleDeadline(t *testing.T) {
+	lifecycle := NewLifecycle()
+	flushed := false
+	lifecycle.OnShutdown(func() { flushed = true })
+
+	// never ending work
+	assert.True(t, lifecycle.Begin())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, lifecycle.Shutdown(ctx))
+	assert.True(t, flushed)
+}
+
+// a SIGTERM received while a webhook is processed lets it finish
+func TestServeUntilSignalDrainsWebhooks(t *testing.T) {
+	delivered := make(chan struct{}, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		delivered <- struct{}{}
+	}))
+	defer hook.Close()
+
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		LogLevel:  LOG_DEBUG,
+		Cachet:    NewWebhookImpl(hook.URL, []string{"component21"}, nil, hook.Client()),
+	}
+	router := PrepareGinRouter(&config)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &http.Server{Handler: router}
+
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeUntilSignal(server, func() error { return server.Serve(listener) }, signals, config.Lifecycle, 5*time.Second)
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		var jsonStr = []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","labels":{"alertname":"component21"}}],"version":"4"}`)
+		resp, err := http.Post("http://"+listener.Addr().String()+"/alert", "application/json", bytes.NewBuffer(jsonStr))
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	signals <- syscall.SIGTERM
+
+	assert.Nil(t, <-served)
+	assert.Equal(t, http.StatusOK, <-status)
+	select {
+	case <-delivered:
+	default:
+		t.Error("the webhook should have been delivered before the shutdown completed")
+	}
+
+	// new webhooks are refused
+	req := httptest.NewRequest("POST", "/alert", bytes.NewBufferString(`{}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SILENCE_ACTION_OFF only logs the silenced alerts having an incident open
+	SILENCE_ACTION_OFF = "off"
+	// SILENCE_ACTION_WATCHING sets their incidents as "Watching"
+	SILENCE_ACTION_WATCHING = "watching"
+	// SILENCE_ACTION_RESOLVE resolves their incidents
+	SILENCE_ACTION_RESOLVE = "resolve"
+)
+
+// DEFAULT_SILENCE_POLL_INTERVAL is how often the Alertmanager alerts are checked
+const DEFAULT_SILENCE_POLL_INTERVAL = time.Minute
+
+// IncidentWatcher is implemented by the backends able to set an incident as "Watching"
+// (the fix is being monitored), the component keeping its status
+type IncidentWatcher interface {
+	WatchIncidentContext(ctx context.Context, componentName string, componentID, incidentId int, message string) error
+}
+
+// errWatchUnsupported is returned for the backends which are not IncidentWatchers
+var errWatchUnsupported = errors.New("the backend cannot set an incident as watching")
+
+// watchBackendIncident sets the incident as "Watching" if the backend is an IncidentWatcher
+func watchBackendIncident(ctx context.Context, backend Cachet, componentName string, componentID, incidentId int, message string) error {
+	if watcher, ok := backend.(IncidentWatcher); ok {
+		return watcher.WatchIncidentContext(ctx, componentName, componentID, incidentId, message)
+	}
+	return errWatchUnsupported
+}
+
+// ParseSilenceAction checks a silence_action parameter
+func ParseSilenceAction(action string) (string, error) {
+	switch action {
+	case SILENCE_ACTION_OFF, SILENCE_ACTION_WATCHING, SILENCE_ACTION_RESOLVE:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown silence action '%s' (expected off, watching or resolve)", action)
+}
+
+// alertmanagerAlert is an alert of the Alertmanager API v2 (GET /api/v2/alerts)
+type alertmanagerAlert struct {
+	Fingerprint string            `json:"fingerprint"`
+	Labels      map[string]string `json:"labels"`
+	Status      struct {
+		// State is active, suppressed (silenced or inhibited) or unprocessed
+		State       string   `json:"state"`
+		SilencedBy  []string `json:"silencedBy"`
+		InhibitedBy []string `json:"inhibitedBy"`
+	} `json:"status"`
+}
+
+// alertmanagerSilence is a silence of the Alertmanager API v2 (GET /api/v2/silence/{id})
+type alertmanagerSilence struct {
+	ID        string    `json:"id"`
+	CreatedBy string    `json:"createdBy"`
+	Comment   string    `json:"comment"`
+	EndsAt    time.Time `json:"endsAt"`
+}
+
+// silencedComponent is the state of a component in the Alertmanager alerts
+type silencedComponent struct {
+	labels     map[string]string
+	active     bool
+	suppressed bool
+	silencedBy []string
+}
+
+// suppressedIncident is a component whose incidents were changed as its alerts were suppressed
+type suppressedIncident struct {
+	backend   string
+	component string
+	id        int
+	dryRun    bool
+}
+
+// SilenceWatcher polls the Alertmanager API for the alerts silenced or inhibited after their
+// incident was opened (Alertmanager does not notify them anymore), and marks their incidents as
+// "Watching", or resolves them. When the alert is active again, the incident follows it again.
+// It handles the alerts of the main /alert endpoint
+type SilenceWatcher struct {
+	url    string
+	client *http.Client
+	action string
+	config *PrometheusCachetConfig
+
+	lock sync.Mutex
+	// suppressed are the components handled, by tenant/backend/component id
+	suppressed map[string]*suppressedIncident
+}
+
+func NewSilenceWatcher(alertmanagerURL string, client *http.Client, action string, config *PrometheusCachetConfig) *SilenceWatcher {
+	return &SilenceWatcher{
+		url:        strings.TrimSuffix(alertmanagerURL, "/"),
+		client:     client,
+		action:     action,
+		config:     config,
+		suppressed: make(map[string]*suppressedIncident),
+	}
+}
+
+func (w *SilenceWatcher) get(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, w.url+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("alertmanager answered %d to %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// components fetches the alerts, and returns the state of their components
+func (w *SilenceWatcher) components(ctx context.Context) (map[string]*silencedComponent, error) {
+	var alerts []alertmanagerAlert
+	if err := w.get(ctx, "/api/v2/alerts?active=true&silenced=true&inhibited=true&unprocessed=false", &alerts); err != nil {
+		return nil, err
+	}
+
+	components := make(map[string]*silencedComponent)
+	for _, alert := range alerts {
+		name := alert.Labels[w.config.LabelName]
+		if name == "" {
+			continue
+		}
+		component, ok := components[name]
+		if !ok {
+			component = &silencedComponent{labels: alert.Labels}
+			components[name] = component
+		}
+		switch alert.Status.State {
+		case "active":
+			component.active = true
+		case "suppressed":
+			component.suppressed = true
+			component.silencedBy = append(component.silencedBy, alert.Status.SilencedBy...)
+		}
+	}
+	return components, nil
+}
+
+// note explains why the alert is suppressed, with the author and comment of its silence
+func (w *SilenceWatcher) note(ctx context.Context, name string, component *silencedComponent) string {
+	if len(component.silencedBy) == 0 {
+		return fmt.Sprintf("Alert of service %s inhibited in Alertmanager", name)
+	}
+	var silence alertmanagerSilence
+	if err := w.get(ctx, "/api/v2/silence/"+url.PathEscape(component.silencedBy[0]), &silence); err != nil {
+		LoggerFrom(ctx).Debug("unable to read the silence", "silence", component.silencedBy[0], "error", err)
+		return fmt.Sprintf("Alert of service %s silenced in Alertmanager", name)
+	}
+	return fmt.Sprintf("Alert of service %s silenced in Alertmanager by %s until %s: %s",
+		name, silence.CreatedBy, silence.EndsAt.UTC().Format("2006-01-02 15:04 MST"), silence.Comment)
+}
+
+// Check compares the Alertmanager alerts with the incidents handled, and updates the incidents
+// of the components whose alerts were suppressed, or are not suppressed anymore
+func (w *SilenceWatcher) Check(ctx context.Context) error {
+	// only the leader writes on the status pages
+	if !w.config.HA.IsLeader() {
+		return nil
+	}
+	components, err := w.components(ctx)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	tenant := w.config.TenantName()
+	lists := make(map[string]map[string]int)
+	seen := make(map[string]bool)
+
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		component := components[name]
+		// the overridden components do not follow their alerts
+		if !component.suppressed || component.active || w.config.Overrides.Get(tenant, name) != nil {
+			continue
+		}
+
+		targets := []string{DEFAULT_BACKEND}
+		dryRun := false
+		if route := w.config.MatchRoute(component.labels); route != nil {
+			targets = route.Backends
+			dryRun = route.DryRun
+		}
+		for _, backendName := range targets {
+			logger := LoggerFrom(ctx).With("tenant", tenant, "component", name, "backend", backendName)
+			backend := w.config.RouteBackend(backendName, dryRun)
+			if backend == nil {
+				continue
+			}
+			list, ok := lists[backendName]
+			if !ok {
+				if list, err = backend.ListComponentsContext(ctx); err != nil {
+					logger.Warn("unable to list the components", "error", err)
+					continue
+				}
+				lists[backendName] = list
+			}
+			componentID, ok := list[name]
+			if !ok {
+				continue
+			}
+			key := componentKey(tenant, backendName, componentID)
+			seen[key] = true
+			if w.suppressed[key] != nil {
+				continue
+			}
+
+			changes, err := w.suppress(WithLogger(ctx, logger), backend, backendName, name, componentID, w.note(ctx, name, component))
+			if err != nil {
+				logger.Warn("unable to update the incidents of the suppressed alert", "action", w.action, "error", err)
+				continue
+			}
+			if changes > 0 || w.action == SILENCE_ACTION_OFF {
+				logger.Info("alert suppressed in Alertmanager", "action", w.action, "incidents", changes)
+			}
+			w.config.Metrics.SilencedIncidents.Add(float64(changes), tenant, backendName, w.action)
+			w.suppressed[key] = &suppressedIncident{backend: backendName, component: name, id: componentID, dryRun: dryRun}
+		}
+	}
+
+	// the alerts active again, or resolved while suppressed (which Alertmanager does not notify)
+	for key, incident := range w.suppressed {
+		if seen[key] {
+			continue
+		}
+		logger := LoggerFrom(ctx).With("tenant", tenant, "component", incident.component, "backend", incident.backend)
+		backend := w.config.RouteBackend(incident.backend, incident.dryRun)
+		if backend == nil {
+			delete(w.suppressed, key)
+			continue
+		}
+		component, firing := components[incident.component]
+		firing = firing && component.active
+		if err := w.restore(WithLogger(ctx, logger), backend, incident, firing); err != nil {
+			logger.Warn("unable to update the incidents of the alert no longer suppressed", "error", err)
+			continue
+		}
+		logger.Info("alert no longer suppressed in Alertmanager", "firing", firing)
+		delete(w.suppressed, key)
+	}
+	return nil
+}
+
+// suppress updates the open incidents of a component according to the action, and returns how many were
+func (w *SilenceWatcher) suppress(ctx context.Context, backend Cachet, backendName, name string, componentID int, note string) (int, error) {
+	incidents, err := backend.SearchIncidentsContext(ctx, componentID)
+	if err != nil {
+		return 0, err
+	}
+	changes := 0
+	for _, incident := range incidents {
+		// already fixed, or watched
+		if incident.Status == 4 || incident.Status == 3 {
+			continue
+		}
+		switch w.action {
+		case SILENCE_ACTION_WATCHING:
+			err = watchBackendIncident(ctx, backend, name, componentID, incident.Id, note)
+		case SILENCE_ACTION_RESOLVE:
+			err = backend.UpdateIncidentContext(ctx, name, componentID, incident.Id, 1, note)
+		}
+		if err != nil {
+			return changes, err
+		}
+		changes++
+	}
+	if w.action == SILENCE_ACTION_RESOLVE {
+		w.config.Dedupe.Forwarded(w.config.TenantName(), backendName, componentID, 1)
+	}
+	return changes, nil
+}
+
+// restore makes the incidents of a component follow its alert again
+func (w *SilenceWatcher) restore(ctx context.Context, backend Cachet, incident *suppressedIncident, firing bool) error {
+	if w.action == SILENCE_ACTION_OFF {
+		return nil
+	}
+	message := fmt.Sprintf("Prometheus flagged service %s as up", incident.component)
+	if firing && w.action == SILENCE_ACTION_WATCHING {
+		// the incidents watched are identified again
+		incidents, err := backend.SearchIncidentsContext(ctx, incident.id)
+		if err != nil {
+			return err
+		}
+		for _, open := range incidents {
+			if open.Status != 3 {
+				continue
+			}
+			if err := backend.UpdateIncidentContext(ctx, incident.component, incident.id, open.Id, 4, fmt.Sprintf("Alert of service %s no longer silenced in Alertmanager", incident.component)); err != nil {
+				return err
+			}
+		}
+	} else if _, err := syncComponent(ctx, backend, incident.component, incident.id, firing, message); err != nil {
+		return err
+	}
+	w.config.Dedupe.Forwarded(w.config.TenantName(), incident.backend, incident.id, alertStatus(firing))
+	return nil
+}
+
+// Run checks the Alertmanager alerts every interval, until stop is closed
+func (w *SilenceWatcher) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := w.Check(ctx); err != nil {
+				DefaultLogger().Warn("unable to check the Alertmanager silences", "error", err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAlertmanager answers the alerts and silences of the Alertmanager API v2
+type fakeAlertmanager struct {
+	*httptest.Server
+	lock   sync.Mutex
+	alerts []alertmanagerAlert
+}
+
+func newFakeAlertmanager() *fakeAlertmanager {
+	am := &fakeAlertmanager{}
+	am.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		am.lock.Lock()
+		defer am.lock.Unlock()
+		switch r.URL.Path {
+		case "/api/v2/alerts":
+			json.NewEncoder(w).Encode(am.alerts)
+		case "/api/v2/silence/silence1":
+			w.Write([]byte(`{"id":"silence1","createdBy":"jdoe","comment":"fix deployed","endsAt":"2026-10-18T22:00:00Z"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return am
+}
+
+// set makes the alert of the component active, suppressed (by silence1, or inhibited), or removes it ("")
+func (am *fakeAlertmanager) set(component, state string, silenced bool) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+	am.alerts = nil
+	if state == "" {
+		return
+	}
+	alert := alertmanagerAlert{Fingerprint: "f1a2", Labels: map[string]string{"alertname": component}}
+	alert.Status.State = state
+	if state == "suppressed" && silenced {
+		alert.Status.SilencedBy = []string{"silence1"}
+	} else if state == "suppressed" {
+		alert.Status.InhibitedBy = []string{"f3b4"}
+	}
+	am.alerts = append(am.alerts, alert)
+}
+
+func TestSilenceWatching(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	am := newFakeAlertmanager()
+	defer am.Close()
+	config := newOverridesConfig(fake)
+	router := PrepareGinRouter(config)
+	watcher := NewSilenceWatcher(am.URL+"/", am.Client(), SILENCE_ACTION_WATCHING, config)
+	ctx := context.Background()
+
+	sendTestAlert(t, router, "promToken", "firing", "component21")
+	am.set("component21", "active", false)
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+
+	// silenced after the incident was opened
+	am.set("component21", "suppressed", true)
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, cachetfake.INCIDENT_WATCHING, lastIncidentStatus(fake))
+	assert.Contains(t, fake.Incidents(0)[0].Message, "silenced in Alertmanager by jdoe until 2026-10-18 22:00 UTC: fix deployed")
+	component, _ := fake.ComponentByName("component21")
+	assert.NotEqual(t, 1, component.Status)
+	assert.Equal(t, float64(1), config.Metrics.SilencedIncidents.Get(DEFAULT_BACKEND, DEFAULT_BACKEND, SILENCE_ACTION_WATCHING))
+
+	// handled once
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, float64(1), config.Metrics.SilencedIncidents.Get(DEFAULT_BACKEND, DEFAULT_BACKEND, SILENCE_ACTION_WATCHING))
+
+	// the silence expired, the alert still firing
+	am.set("component21", "active", false)
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+	assert.Equal(t, 1, len(fake.Incidents(0)))
+
+	// resolved while silenced: Alertmanager does not notify it
+	am.set("component21", "suppressed", false)
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, cachetfake.INCIDENT_WATCHING, lastIncidentStatus(fake))
+	assert.Contains(t, fake.Incidents(0)[0].Message, "inhibited in Alertmanager")
+	am.set("component21", "", false)
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, cachetfake.INCIDENT_FIXED, lastIncidentStatus(fake))
+	component, _ = fake.ComponentByName("component21")
+	assert.Equal(t, 1, component.Status)
+}
+
+func TestSilenceResolve(t *testing.T) {
+	fake := setupFakeCachetHQ()
+	defer fake.Close()
+	am := newFakeAlertmanager()
+	defer am.Close()
+	config := newOverridesConfig(fake)
+	router := PrepareGinRouter(config)
+	watcher := NewSilenceWatcher(am.URL, am.Client(), SILENCE_ACTION_RESOLVE, config)
+	ctx := context.Background()
+
+	sendTestAlert(t, router, "promToken", "firing", "component21")
+	am.set("component21", "suppressed", true)
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, cachetfake.INCIDENT_FIXED, lastIncidentStatus(fake))
+	assert.Equal(t, float64(1), config.Metrics.SilencedIncidents.Get(DEFAULT_BACKEND, DEFAULT_BACKEND, SILENCE_ACTION_RESOLVE))
+
+	// the alert is active again
+	am.set("component21", "active", false)
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+
+	// the overridden components are left alone
+	_, err := config.Overrides.Set(ctx, config, &Override{Tenant: DEFAULT_BACKEND, Component: "component21", Status: OVERRIDE_OUTAGE, Reason: "test", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Nil(t, err)
+	am.set("component21", "suppressed", true)
+	assert.Nil(t, watcher.Check(ctx))
+	assert.Equal(t, cachetfake.INCIDENT_IDENTIFIED, lastIncidentStatus(fake))
+
+	// unreachable Alertmanager
+	am.Close()
+	assert.NotNil(t, watcher.Check(ctx))
+
+	_, err = ParseSilenceAction("close")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const STATUSPAGE_API_URL = "https://api.statuspage.io"
+
+// Statuspage.io uses string identifiers (i.e. "8kbf7d35c070"), while the Cachet
+// interface works with integers. statuspageIDs derives the integer from the remote
+// identifier (a 53 bits hash, exact in JSON), so that it stays the same across restarts
+// (i.e. in the hold-down and overrides state files), and remembers the remote identifiers
+// we came across to map them back
+type statuspageIDs struct {
+	lock     sync.Mutex
+	toString map[int]string
+}
+
+func newStatuspageIDs() *statuspageIDs {
+	return &statuspageIDs{
+		toString: make(map[int]string),
+	}
+}
+
+func (s *statuspageIDs) local(remote string) int {
+	h := fnv.New64a()
+	h.Write([]byte(remote))
+	id := int(h.Sum64() & (1<<53 - 1))
+	if id == 0 {
+		id = 1
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.toString[id] = remote
+	return id
+}
+
+// remote returns the remote identifier of a local one, if we came across it since the start
+func (s *statuspageIDs) remote(local int) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id, ok := s.toString[local]
+	return id, ok
+}
+
+// cf https://developer.statuspage.io/#operation/getPagesPageIdComponents
+type statuspageComponent struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// cf https://developer.statuspage.io/#operation/getPagesPageIdIncidents
+type statuspageIncident struct {
+	Id         string                `json:"id"`
+	Name       string                `json:"name"`
+	Status     string                `json:"status"`
+	CreatedAt  string                `json:"created_at"`
+	UpdatedAt  string                `json:"updated_at"`
+	Components []statuspageComponent `json:"components"`
+}
+
+// cf https://developer.statuspage.io/#operation/postPagesPageIdIncidents
+type statuspageIncidentRequest struct {
+	Incident struct {
+		Name         string            `json:"name"`
+		Status       string            `json:"status"`
+		Body         string            `json:"body"`
+		ComponentIds []string          `json:"component_ids"`
+		Components   map[string]string `json:"components"`
+	} `json:"incident"`
+}
+
+// Cachet component status => Statuspage.io component status
+var statuspageComponentStatus = map[int]string{
+	1: "operational",
+	2: "degraded_performance",
+	3: "partial_outage",
+	4: "major_outage",
+}
+
+// Cachet incident status => Statuspage.io incident status
+var statuspageIncidentStatus = map[int]string{
+	1: "investigating",
+	2: "identified",
+	3: "monitoring",
+	4: "resolved",
+}
+
+// StatuspageImpl implements the Cachet interface against the Atlassian Statuspage.io REST API
+type StatuspageImpl struct {
+	apiURL string
+	apiKey string
+	pageID string
+	client *http.Client
+	ids    *statuspageIDs
+}
+
+// NewStatuspageImpl creates a new Cachet interface implementation talking to Statuspage.io
+func NewStatuspageImpl(apiURL, apiKey, pageID string, client *http.Client) *StatuspageImpl {
+	return &StatuspageImpl{
+		apiURL: strings.TrimRight(apiURL, "/"),
+		apiKey: apiKey,
+		pageID: pageID,
+		client: client,
+		ids:    newStatuspageIDs(),
+	}
+}
+
+func (s *StatuspageImpl) do(ctx context.Context, method, path string, payload interface{}, result interface{}) error {
+	var buf bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&buf).Encode(payload); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/v1/pages/%s%s", s.apiURL, s.pageID, path), &buf)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "OAuth "+s.apiKey)
+
+	requestBody := buf.Bytes()
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		traceHTTP(ctx, req, requestBody, 0, nil, start, err)
+		return err
+	}
+	defer resp.Body.Close()
+	recordHTTPStatus(ctx, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	traceHTTP(ctx, req, requestBody, resp.StatusCode, body, start, err)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("statuspage %s %s: %d %s", method, path, resp.StatusCode, string(body))
+	}
+
+	if result != nil {
+		if informative, ok := result.(informativeResult); ok {
+			// the request succeeded, whatever the answer
+			json.Unmarshal(body, informative.result)
+			return nil
+		}
+		return json.Unmarshal(body, result)
+	}
+	return nil
+}
+
+// statuspage dates are RFC3339, while CachetIncident are using the CachetHQ layout
+func statuspageDate(date string) string {
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return date
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func (s *StatuspageImpl) toCachetIncident(incident *statuspageIncident) *CachetIncident {
+	status := 1
+	for cachetStatus, statuspageStatus := range statuspageIncidentStatus {
+		if statuspageStatus == incident.Status {
+			status = cachetStatus
+		}
+	}
+	if incident.Status == "postmortem" {
+		status = 4
+	}
+
+	componentID := 0
+	if len(incident.Components) > 0 {
+		componentID = s.ids.local(incident.Components[0].Id)
+	}
+
+	return &CachetIncident{
+		Id:          s.ids.local(incident.Id),
+		ComponentId: componentID,
+		Status:      status,
+		CreatedAt:   statuspageDate(incident.CreatedAt),
+		UpdatedAt:   statuspageDate(incident.UpdatedAt),
+	}
+}
+
+func (s *StatuspageImpl) ListComponentsContext(ctx context.Context) (map[string]int, error) {
+	componentsID := make(map[string]int)
+
+	// we loop "only" on the max first 100 pages
+	for page := 1; page < 100; page++ {
+		var components []statuspageComponent
+		if err := s.do(ctx, http.MethodGet, fmt.Sprintf("/components?page=%d&per_page=100", page), nil, &components); err != nil {
+			return nil, err
+		}
+		for _, component := range components {
+			componentsID[component.Name] = s.ids.local(component.Id)
+			for cachetStatus, statuspageStatus := range statuspageComponentStatus {
+				if statuspageStatus == component.Status {
+					recordComponentStatus(ctx, componentsID[component.Name], cachetStatus)
+				}
+			}
+		}
+		if len(components) < 100 {
+			break
+		}
+	}
+	return componentsID, nil
+}
+
+func (s *StatuspageImpl) SearchComponentContext(ctx context.Context, name string) (int, error) {
+	components, err := s.ListComponentsContext(ctx)
+	if err != nil {
+		return -1, err
+	}
+	if id, ok := components[name]; ok {
+		return id, nil
+	}
+	return -1, fmt.Errorf("no component found")
+}
+
+// remoteComponent returns the remote identifier of a component: the components are listed
+// again if it was not since the start
+func (s *StatuspageImpl) remoteComponent(ctx context.Context, componentID int) (string, error) {
+	if remoteID, ok := s.ids.remote(componentID); ok {
+		return remoteID, nil
+	}
+	if _, err := s.ListComponentsContext(ctx); err != nil {
+		return "", err
+	}
+	if remoteID, ok := s.ids.remote(componentID); ok {
+		return remoteID, nil
+	}
+	return "", fmt.Errorf("unknown statuspage component %d", componentID)
+}
+
+// remoteIncident returns the remote identifier of an incident: the incidents are listed
+// again if it was not since the start
+func (s *StatuspageImpl) remoteIncident(ctx context.Context, incidentID int) (string, error) {
+	if remoteID, ok := s.ids.remote(incidentID); ok {
+		return remoteID, nil
+	}
+	if _, err := s.listIncidents(ctx); err != nil {
+		return "", err
+	}
+	if remoteID, ok := s.ids.remote(incidentID); ok {
+		return remoteID, nil
+	}
+	return "", fmt.Errorf("unknown statuspage incident %d", incidentID)
+}
+
+// listIncidents returns all the incidents, the most recent first
+func (s *StatuspageImpl) listIncidents(ctx context.Context) ([]statuspageIncident, error) {
+	incidents := make([]statuspageIncident, 0)
+
+	// we loop "only" on the max first 100 pages
+	for page := 1; page < 100; page++ {
+		var list []statuspageIncident
+		if err := s.do(ctx, http.MethodGet, fmt.Sprintf("/incidents?page=%d&per_page=100", page), nil, &list); err != nil {
+			return nil, err
+		}
+		for i := range list {
+			s.ids.local(list[i].Id)
+		}
+		incidents = append(incidents, list...)
+		if len(list) < 100 {
+			break
+		}
+	}
+	return incidents, nil
+}
+
+func (s *StatuspageImpl) ReadIncidentContext(ctx context.Context, incidentId int) (*CachetIncident, error) {
+	remoteID, err := s.remoteIncident(ctx, incidentId)
+	if err != nil {
+		return nil, err
+	}
+
+	var incident statuspageIncident
+	if err := s.do(ctx, http.MethodGet, "/incidents/"+remoteID, nil, &incident); err != nil {
+		return nil, err
+	}
+	return s.toCachetIncident(&incident), nil
+}
+
+func (s *StatuspageImpl) SearchIncidentsContext(ctx context.Context, componentId int) ([]*CachetIncident, error) {
+	remoteID, err := s.remoteComponent(ctx, componentId)
+	if err != nil {
+		return nil, err
+	}
+
+	// statuspage returns the most recent incidents first
+	list, err := s.listIncidents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	incidents := make([]*CachetIncident, 0)
+	for i := range list {
+		for _, component := range list[i].Components {
+			if component.Id == remoteID {
+				incidents = append(incidents, s.toCachetIncident(&list[i]))
+				break
+			}
+		}
+	}
+	return incidents, nil
+}
+
+func (s *StatuspageImpl) CreateIncidentContext(ctx context.Context, componentName string, componentID, status int, componentStatus int) error {
+	remoteID, err := s.remoteComponent(ctx, componentID)
+	if err != nil {
+		return err
+	}
+
+	var incident statuspageIncidentRequest
+	incident.Incident.Name = fmt.Sprintf("%s down", componentName)
+	incident.Incident.Body = fmt.Sprintf("Prometheus flagged service %s as down", componentName)
+	incident.Incident.Status = statuspageIncidentStatus[2]
+
+	// if we are in status = 1 (alert resolved)
+	if status == 1 {
+		incident.Incident.Name = fmt.Sprintf("%s up", componentName)
+		incident.Incident.Body = fmt.Sprintf("Prometheus flagged service %s as recovered", componentName)
+		incident.Incident.Status = statuspageIncidentStatus[4]
+	}
+	incident.Incident.ComponentIds = []string{remoteID}
+	incident.Incident.Components = map[string]string{remoteID: statuspageComponentStatus[componentStatus]}
+
+	var created statuspageIncident
+	if err := s.do(ctx, http.MethodPost, "/incidents", &incident, informativeResult{&created}); err != nil {
+		return err
+	}
+	if created.Id != "" {
+		recordIncidentID(ctx, s.ids.local(created.Id))
+	}
+	return nil
+}
+
+func (s *StatuspageImpl) UpdateIncidentContext(ctx context.Context, componentName string, componentID, incidentId, status int, message string) error {
+	remoteComponentID, err := s.remoteComponent(ctx, componentID)
+	if err != nil {
+		return err
+	}
+	remoteIncidentID, err := s.remoteIncident(ctx, incidentId)
+	if err != nil {
+		return err
+	}
+
+	var incident statuspageIncidentRequest
+	incident.Incident.Name = fmt.Sprintf("%s down", componentName)
+	incident.Incident.Body = message
+	incident.Incident.Status = statuspageIncidentStatus[2]
+	componentStatus := 4 // "Major Outage"
+
+	// if we are in status = 1 (alert resolved)
+	if status == 1 {
+		incident.Incident.Name = fmt.Sprintf("%s up", componentName)
+		incident.Incident.Status = statuspageIncidentStatus[4]
+		componentStatus = 1 // "Operational"
+	}
+	incident.Incident.ComponentIds = []string{remoteComponentID}
+	incident.Incident.Components = map[string]string{remoteComponentID: statuspageComponentStatus[componentStatus]}
+
+	return s.do(ctx, http.MethodPatch, "/incidents/"+remoteIncidentID, &incident, nil)
+}
+
+// statuspageIncidentWatch sets an incident as "monitoring", the component keeping its status
+type statuspageIncidentWatch struct {
+	Incident struct {
+		Status string `json:"status"`
+		Body   string `json:"body"`
+	} `json:"incident"`
+}
+
+// WatchIncidentContext sets an incident as "monitoring", with a message
+func (s *StatuspageImpl) WatchIncidentContext(ctx context.Context, componentName string, componentID, incidentId int, message string) error {
+	remoteIncidentID, err := s.remoteIncident(ctx, incidentId)
+	if err != nil {
+		return err
+	}
+
+	var incident statuspageIncidentWatch
+	incident.Incident.Status = statuspageIncidentStatus[3]
+	incident.Incident.Body = message
+	return s.do(ctx, http.MethodPatch, "/incidents/"+remoteIncidentID, &incident, nil)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the mock Statuspage.io defines 1 component: "API" (id "abc123") with one incident, on the second page
+func TestStatuspageImpl(t *testing.T) {
+	var created statuspageIncidentRequest
+	var patched statuspageIncidentRequest
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "OAuth secret", r.Header.Get("Authorization"))
+
+		if r.Method == "GET" && r.URL.Path == "/v1/pages/page1/components" {
+			io.WriteString(w, `[{"id":"abc123","name":"API","status":"operational"}]`)
+		} else if r.Method == "GET" && r.URL.Path == "/v1/pages/page1/incidents" && r.FormValue("page") == "1" {
+			// a full page of incidents of other components
+			others := make([]string, 0, 100)
+			for i := 0; i < 100; i++ {
+				others = append(others, fmt.Sprintf(`{"id":"other%d","status":"resolved","components":[{"id":"other"}]}`, i))
+			}
+			io.WriteString(w, "["+strings.Join(others, ",")+"]")
+		} else if r.Method == "GET" && r.URL.Path == "/v1/pages/page1/incidents" {
+			io.WriteString(w, `[
+				{"id":"inc2","name":"Other down","status":"resolved","created_at":"2019-11-15T10:00:00Z","updated_at":"2019-11-15T10:00:00Z","components":[{"id":"other"}]},
+				{"id":"inc1","name":"API down","status":"identified","created_at":"2019-11-15T10:00:00Z","updated_at":"2019-11-15T10:30:00Z","components":[{"id":"abc123"}]}
+			]`)
+		} else if r.Method == "GET" && r.URL.Path == "/v1/pages/page1/incidents/inc1" {
+			io.WriteString(w, `{"id":"inc1","name":"API down","status":"resolved","created_at":"2019-11-15T10:00:00Z","updated_at":"2019-11-15T10:30:00Z","components":[{"id":"abc123"}]}`)
+		} else if r.Method == "POST" && r.URL.Path == "/v1/pages/page1/incidents" {
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"id":"inc3"}`)
+		} else if r.Method == "PATCH" && r.URL.Path == "/v1/pages/page1/incidents/inc1" {
+			json.NewDecoder(r.Body).Decode(&patched)
+			io.WriteString(w, `{"id":"inc1"}`)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error":"not found"}`)
+		}
+	}))
+	defer ts.Close()
+
+	statuspage := NewStatuspageImpl(ts.URL, "secret", "page1", ts.Client())
+	ctx := context.Background()
+
+	components, err := statuspage.ListComponentsContext(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(components))
+	componentID := components["API"]
+
+	id, err := statuspage.SearchComponentContext(ctx, "API")
+	assert.Nil(t, err)
+	assert.Equal(t, componentID, id)
+
+	_, err = statuspage.SearchComponentContext(ctx, "unknown")
+	assert.NotNil(t, err)
+
+	incidents, err := statuspage.SearchIncidentsContext(ctx, componentID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(incidents))
+	assert.Equal(t, 2, incidents[0].Status)
+	assert.Equal(t, componentID, incidents[0].ComponentId)
+	assert.Equal(t, "2019-11-15 10:00:00", incidents[0].CreatedAt)
+
+	incident, err := statuspage.ReadIncidentContext(ctx, incidents[0].Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, incident.Status)
+	assert.Equal(t, "2019-11-15 10:30:00", incident.UpdatedAt)
+
+	err = statuspage.CreateIncidentContext(ctx, "API", componentID, 4, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, "identified", created.Incident.Status)
+	assert.Equal(t, []string{"abc123"}, created.Incident.ComponentIds)
+	assert.Equal(t, "major_outage", created.Incident.Components["abc123"])
+
+	err = statuspage.UpdateIncidentContext(ctx, "API", componentID, incidents[0].Id, 1, "back")
+	assert.Nil(t, err)
+	assert.Equal(t, "resolved", patched.Incident.Status)
+	assert.Equal(t, "back", patched.Incident.Body)
+	assert.Equal(t, "operational", patched.Incident.Components["abc123"])
+
+	// unknown (never listed) ids are refused
+	err = statuspage.CreateIncidentContext(ctx, "API", 999, 4, 4)
+	assert.NotNil(t, err)
+
+	// after a restart, the ids are the same, and resolved again
+	restarted := NewStatuspageImpl(ts.URL, "secret", "page1", ts.Client())
+	err = restarted.UpdateIncidentContext(ctx, "API", componentID, incidents[0].Id, 1, "back again")
+	assert.Nil(t, err)
+	assert.Equal(t, "back again", patched.Incident.Body)
+	assert.Equal(t, "operational", patched.Incident.Components["abc123"])
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// DEFAULT_ALERT_TIMEOUT bounds the handling of one webhook, below the 10s write timeout of the server
+const DEFAULT_ALERT_TIMEOUT = 9 * time.Second
+
+// timeoutCachet gives each call to the wrapped backend its own deadline. A call
+// may send several requests (pagination, Cachet 3.x component update...), each
+// of them being also limited by the timeout of the http client
+type timeoutCachet struct {
+	backend Cachet
+	timeout time.Duration
+}
+
+// WithCallTimeout limits each call to the backend to timeout (0 means no limit
+// other than the one of the caller context)
+func WithCallTimeout(backend Cachet, timeout time.Duration) Cachet {
+	if timeout <= 0 || backend == nil {
+		return backend
+	}
+	return &timeoutCachet{backend: backend, timeout: timeout}
+}
+
+// PingContext forwards the ping to the backend, if it is a Pinger
+func (t *timeoutCachet) PingContext(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return pingBackend(ctx, t.backend)
+}
+
+// CheckWriteContext forwards the check to the backend, if it is a WriteChecker
+func (t *timeoutCachet) CheckWriteContext(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return checkBackendWrite(ctx, t.backend)
+}
+
+// WatchIncidentContext forwards the call to the backend, if it is an IncidentWatcher
+func (t *timeoutCachet) WatchIncidentContext(ctx context.Context, componentName string, componentID, incidentId int, message string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return watchBackendIncident(ctx, t.backend, componentName, componentID, incidentId, message)
+}
+
+func (t *timeoutCachet) ListComponentsContext(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.backend.ListComponentsContext(ctx)
+}
+
+func (t *timeoutCachet) SearchComponentContext(ctx context.Context, name string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.backend.SearchComponentContext(ctx, name)
+}
+
+func (t *timeoutCachet) ReadIncidentContext(ctx context.Context, incidentId int) (*CachetIncident, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.backend.ReadIncidentContext(ctx, incidentId)
+}
+
+func (t *timeoutCachet) SearchIncidentsContext(ctx context.Context, componentId int) ([]*CachetIncident, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.backend.SearchIncidentsContext(ctx, componentId)
+}
+
+func (t *timeoutCachet) CreateIncidentContext(ctx context.Context, componentName string, componentID, status int, componentStatus int) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.backend.CreateIncidentContext(ctx, componentName, componentID, status, componentStatus)
+}
+
+func (t *timeoutCachet) UpdateIncidentContext(ctx context.Context, componentName string, componentID, incidentId, status int, message string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.backend.UpdateIncidentContext(ctx, componentName, componentID, incidentId, status, message)
+}
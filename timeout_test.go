@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hangingServer never answers until it is closed
+func hangingServer() (*httptest.Server, chan struct{}) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	return ts, release
+}
+
+func TestWithCallTimeout(t *testing.T) {
+	ts, release := hangingServer()
+	defer ts.Close()
+	defer close(release)
+
+	cachet := NewCachetImpl(ts.URL, "1234567890abcdef", ts.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+
+	assert.Equal(t, Cachet(cachet), WithCallTimeout(cachet, 0))
+
+	backend := WithCallTimeout(cachet, 100*time.Millisecond)
+	start := time.Now()
+	_, err := backend.ListComponentsContext(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// the caller context is honoured too
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = cachet.CreateIncidentContext(ctx, "API", 1, 4, 4)
+	assert.NotNil(t, err)
+}
+
+// a hanging backend does not block the webhook longer than the alert timeout
+func TestSubmitAlertTimeout(t *testing.T) {
+	ts, release := hangingServer()
+	defer ts.Close()
+	defer close(release)
+
+	cachet := NewCachetImpl(ts.URL, "1234567890abcdef", ts.Client())
+	cachet.SetAPIVersion(CACHET_API_V2)
+
+	config := PrometheusCachetConfig{
+		LabelName:    "alertname",
+		LogLevel:     LOG_INFO,
+		Cachet:       cachet,
+		AlertTimeout: 200 * time.Millisecond,
+	}
+	router := PrepareGinRouter(&config)
+
+	var jsonStr = []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","labels":{"alertname":"component21"}}],"version":"4"}`)
+	req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	router.ServeHTTP(w, req)
+
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "deadline exceeded")
+}
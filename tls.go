@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// ServerTLSOptions are the https server settings
+type ServerTLSOptions struct {
+	// CertFile and KeyFile are the server certificate (optional, it can be given apart)
+	CertFile string
+	KeyFile  string
+	// Watcher (optional) reloads the certificate and client CA files when they change
+	Watcher *CertificateWatcher
+	// ClientCAFile enables mutual TLS: the client certificates must be signed by this CA
+	ClientCAFile string
+	// AllowedSubjects restricts the client certificates by subject (CN or full DN)
+	AllowedSubjects []string
+	// AllowedSANs restricts the client certificates by subject alternative name (DNS, email, IP or URI)
+	AllowedSANs []string
+	// MinVersion is "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string
+	// CipherSuites are names like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (TLS 1.3 suites are not configurable)
+	CipherSuites []string
+}
+
+// SplitList converts a comma separated parameter into a list
+func SplitList(list string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", filename)
+	}
+	return pool, nil
+}
+
+// certificateAllowed checks the subject and the SANs of a client certificate
+func certificateAllowed(cert *x509.Certificate, subjects, sans []string) bool {
+	if len(subjects) == 0 && len(sans) == 0 {
+		return true
+	}
+
+	for _, subject := range subjects {
+		if subject == cert.Subject.CommonName || subject == cert.Subject.String() {
+			return true
+		}
+	}
+
+	names := make([]string, 0)
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, san := range sans {
+		for _, name := range names {
+			if san == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewServerTLSConfig creates the tls.Config of the https server (the certificate itself is given apart)
+func NewServerTLSConfig(options ServerTLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if options.MinVersion != "" {
+		version, ok := tlsVersions[options.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version '%s' (expected 1.0, 1.1, 1.2 or 1.3)", options.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	for _, name := range options.CipherSuites {
+		suite, ok := tlsCipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or unsupported cipher suite '%s'", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+
+	if options.CertFile != "" {
+		if options.Watcher != nil {
+			certReloader, err := options.Watcher.Certificate(options.CertFile, options.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.GetCertificate = certReloader.GetCertificate
+		} else {
+			cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	var caReloader *CAReloader
+	if options.ClientCAFile != "" {
+		if options.Watcher != nil {
+			var err error
+			if caReloader, err = options.Watcher.CA(options.ClientCAFile); err != nil {
+				return nil, err
+			}
+		} else {
+			pool, err := loadCertPool(options.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			config.ClientCAs = pool
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+
+		subjects := options.AllowedSubjects
+		sans := options.AllowedSANs
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				if len(chain) > 0 && certificateAllowed(chain[0], subjects, sans) {
+					return nil
+				}
+			}
+			return fmt.Errorf("client certificate not allowed")
+		}
+	} else if len(options.AllowedSubjects) > 0 || len(options.AllowedSANs) > 0 {
+		return nil, fmt.Errorf("allowed client subjects/SANs need a client CA")
+	}
+
+	if caReloader != nil {
+		// each handshake uses the current client CA
+		base := config.Clone()
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			handshake := base.Clone()
+			handshake.ClientCAs, _ = caReloader.Pool()
+			return handshake, nil
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a PEM certificate and key, valid for 127.0.0.1 and the given DNS names
+func (ca *testCA) issue(t *testing.T, cn string, notAfter time.Time, dnsNames ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeTempFile(t *testing.T, content []byte) string {
+	f, err := ioutil.TempFile("", "prometheus-cachethq-")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	_, err = f.Write(content)
+	assert.Nil(t, err)
+	return f.Name()
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := writeTempFile(t, ca.pem)
+	defer os.Remove(caFile)
+
+	serverCert, serverKey := ca.issue(t, "bridge", time.Now().Add(time.Hour))
+	alertmanagerCert, alertmanagerKey := ca.issue(t, "alertmanager", time.Now().Add(time.Hour), "alertmanager.monitoring.svc")
+	otherCert, otherKey := ca.issue(t, "other", time.Now().Add(time.Hour), "other.default.svc")
+
+	tlsConfig, err := NewServerTLSConfig(ServerTLSOptions{
+		ClientCAFile: caFile,
+		AllowedSANs:  []string{"alertmanager.monitoring.svc"},
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	})
+	assert.Nil(t, err)
+	certificate, err := tls.X509KeyPair(serverCert, serverKey)
+	assert.Nil(t, err)
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certPEM, keyPEM []byte) *http.Client {
+		config := &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			assert.Nil(t, err)
+			config.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+
+	resp, err := client(alertmanagerCert, alertmanagerKey).Get(ts.URL)
+	assert.Nil(t, err)
+	if err == nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// signed by the CA, but not in the allowed SANs
+	_, err = client(otherCert, otherKey).Get(ts.URL)
+	assert.NotNil(t, err)
+
+	// no client certificate
+	_, err = client(nil, nil).Get(ts.URL)
+	assert.NotNil(t, err)
+}
+
+func TestServerTLSOptions(t *testing.T) {
+	_, err := NewServerTLSConfig(ServerTLSOptions{MinVersion: "2.0"})
+	assert.NotNil(t, err)
+
+	_, err = NewServerTLSConfig(ServerTLSOptions{CipherSuites: []string{"TLS_NULL"}})
+	assert.NotNil(t, err)
+
+	_, err = NewServerTLSConfig(ServerTLSOptions{AllowedSubjects: []string{"alertmanager"}})
+	assert.NotNil(t, err)
+
+	config, err := NewServerTLSConfig(ServerTLSOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alertmanager", Organization: []string{"monitoring"}}}
+	assert.True(t, certificateAllowed(cert, []string{"alertmanager"}, nil))
+	assert.True(t, certificateAllowed(cert, []string{"CN=alertmanager,O=monitoring"}, nil))
+	assert.False(t, certificateAllowed(cert, []string{"prometheus"}, nil))
+
+	assert.Equal(t, []string{"a", "b"}, SplitList(" a, ,b"))
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenTelemetry span kinds and status codes, cf https://github.com/open-telemetry/opentelemetry-proto
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2
+	SPAN_KIND_CLIENT   = 3
+
+	SPAN_STATUS_UNSET = 0
+	SPAN_STATUS_OK    = 1
+	SPAN_STATUS_ERROR = 2
+)
+
+const (
+	// DEFAULT_TRACE_SERVICE_NAME is the service.name resource attribute of the exported spans
+	DEFAULT_TRACE_SERVICE_NAME = "prometheus-cachethq"
+	// DEFAULT_TRACE_FLUSH_INTERVAL is how often the spans are exported
+	DEFAULT_TRACE_FLUSH_INTERVAL = 5 * time.Second
+	// traceBatchSize is the number of spans triggering an export before the interval
+	traceBatchSize = 256
+	// traceQueueSize is the number of spans kept while the collector is slow or unreachable, the next
+	// ones being dropped (and counted in prometheus_cachethq_trace_spans_dropped_total)
+	traceQueueSize = 4096
+)
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is a timed operation of a trace. A nil Span (tracing disabled) can be used safely
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	lock          sync.Mutex
+	name          string
+	kind          int
+	start         time.Time
+	end           time.Time
+	attributes    []spanAttribute
+	statusCode    int
+	statusMessage string
+}
+
+// SetAttribute adds an attribute (string, int, float64 or bool) to the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes = append(s.attributes, spanAttribute{key: key, value: value})
+}
+
+// SetError flags the span as failed, if err is not nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statusCode = SPAN_STATUS_ERROR
+	s.statusMessage = err.Error()
+}
+
+// End records the end of the span, and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.end = time.Now()
+	s.lock.Unlock()
+	if s.sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// TraceID returns the hex trace id of the span ("" if tracing is disabled)
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// TraceParent returns the W3C traceparent header identifying the span
+func (s *Span) TraceParent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// parseTraceParent decodes a W3C traceparent header: 00-<trace id>-<parent span id>-<flags>
+func parseTraceParent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+type spanKey struct{}
+
+// SpanFrom returns the current span of the context, nil if none
+func SpanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a child of the current span of the context. Without current
+// span (tracing disabled, or not in a traced request), it returns a nil Span
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, kind)
+	span.traceID = parent.traceID
+	span.parentID = parent.spanID
+	span.sampled = parent.sampled
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Tracer creates the root spans of the traced requests
+type Tracer struct {
+	exporter *OTLPExporter
+}
+
+func NewTracer(exporter *OTLPExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+func (t *Tracer) newSpan(name string, kind int) *Span {
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// Start starts a root span, continuing the trace of the traceparent header if valid
+func (t *Tracer) Start(ctx context.Context, name string, kind int, traceParent string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := t.newSpan(name, kind)
+	if traceID, parentID, sampled, ok := parseTraceParent(traceParent); ok {
+		span.traceID = traceID
+		span.parentID = parentID
+		span.sampled = sampled
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = true
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Middleware traces the request as a server span named after the route, and adds
+// the trace id to the request logger. With a nil Tracer, it does nothing
+func (t *Tracer) Middleware(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if t == nil {
+			c.Next()
+			return
+		}
+
+		ctx, span := t.Start(c.Request.Context(), c.Request.Method+" "+route, SPAN_KIND_SERVER, c.GetHeader("traceparent"))
+		span.SetAttribute("http.method", c.Request.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", c.Request.URL.Path)
+		ctx = WithLogger(ctx, LoggerFrom(ctx).With("trace_id", span.TraceID()))
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		span.SetAttribute("http.status_code", c.Writer.Status())
+		if c.Writer.Status() >= 400 {
+			span.SetError(fmt.Errorf("http status %d", c.Writer.Status()))
+		}
+		span.End()
+	}
+}
+
+// OTLPExporter sends the spans by batches to an OpenTelemetry collector, using OTLP/HTTP with JSON encoding
+type OTLPExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	metrics     *BridgeMetrics
+
+	lock  sync.Mutex
+	queue []*Span
+	flush chan struct{}
+}
+
+// NewOTLPExporter creates an exporter posting to <endpoint>/v1/traces
+func NewOTLPExporter(endpoint string, headers map[string]string, serviceName string, client *http.Client, metrics *BridgeMetrics) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    strings.TrimRight(endpoint, "/") + "/v1/traces",
+		headers:     headers,
+		serviceName: serviceName,
+		client:      client,
+		metrics:     metrics,
+		flush:       make(chan struct{}, 1),
+	}
+}
+
+// Export queues a span, the export being triggered when a batch is full
+func (e *OTLPExporter) Export(span *Span) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.queue) >= traceQueueSize {
+		e.metrics.SpansDropped.Inc()
+		return
+	}
+	e.queue = append(e.queue, span)
+	if len(e.queue) >= traceBatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run exports the queued spans every interval (or when a batch is full), until stop is closed
+func (e *OTLPExporter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+		if err := e.Flush(context.Background()); err != nil {
+			DefaultLogger().Warn("unable to export the traces", "error", err)
+		}
+	}
+}
+
+// Flush exports all the queued spans. The spans not sent are queued again, for the next flush
+func (e *OTLPExporter) Flush(ctx context.Context) error {
+	e.lock.Lock()
+	spans := e.queue
+	e.queue = nil
+	e.lock.Unlock()
+
+	for len(spans) > 0 {
+		batch := spans
+		if len(batch) > traceBatchSize {
+			batch = batch[:traceBatchSize]
+		}
+		if err := e.send(ctx, batch); err != nil {
+			e.requeue(spans)
+			return err
+		}
+		spans = spans[len(batch):]
+	}
+	return nil
+}
+
+// requeue puts back the spans not sent before the ones queued since, the oldest being dropped
+// if the queue is full
+func (e *OTLPExporter) requeue(spans []*Span) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	queue := append(append(make([]*Span, 0, len(spans)+len(e.queue)), spans...), e.queue...)
+	if dropped := len(queue) - traceQueueSize; dropped > 0 {
+		e.metrics.SpansDropped.Add(float64(dropped))
+		queue = queue[dropped:]
+	}
+	e.queue = queue
+}
+
+// cf https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#json-protobuf-encoding
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := fmt.Sprint(v)
+		attribute.Value.IntValue = &s
+	case int64:
+		s := fmt.Sprint(v)
+		attribute.Value.IntValue = &s
+	case float64:
+		attribute.Value.DoubleValue = &v
+	case bool:
+		attribute.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attribute.Value.StringValue = &s
+	}
+	return attribute
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: fmt.Sprint(s.start.UnixNano()),
+		EndTimeUnixNano:   fmt.Sprint(s.end.UnixNano()),
+		Status:            otlpStatus{Code: s.statusCode, Message: s.statusMessage},
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, attribute := range s.attributes {
+		span.Attributes = append(span.Attributes, newOTLPAttribute(attribute.key, attribute.value))
+	}
+	return span
+}
+
+func (e *OTLPExporter) send(ctx context.Context, spans []*Span) error {
+	var scopeSpans otlpScopeSpans
+	scopeSpans.Scope.Name = "github.com/nzin/prometheus_cachethq"
+	for _, span := range spans {
+		scopeSpans.Spans = append(scopeSpans.Spans, span.otlp())
+	}
+	var resourceSpans otlpResourceSpans
+	resourceSpans.Resource.Attributes = []otlpAttribute{newOTLPAttribute("service.name", e.serviceName)}
+	resourceSpans.ScopeSpans = []otlpScopeSpans{scopeSpans}
+	traces := otlpTraces{ResourceSpans: []otlpResourceSpans{resourceSpans}}
+
+	body, err := json.Marshal(&traces)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("otlp %s: %d %s", e.endpoint, resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// ParseHeaders converts a "name1=value1,name2=value2" parameter into a map
+func ParseHeaders(headers string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, header := range SplitList(headers) {
+		i := strings.Index(header, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header '%s' (expected name=value)", header)
+		}
+		parsed[strings.TrimSpace(header[:i])] = strings.TrimSpace(header[i+1:])
+	}
+	return parsed, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nzin/prometheus_cachethq/cachetfake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, parentID, sampled, ok := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.True(t, sampled)
+	assert.Equal(t, byte(0x4b), traceID[0])
+	assert.Equal(t, byte(0xb7), parentID[7])
+
+	_, _, sampled, ok = parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sampled)
+
+	for _, invalid := range []string{"", "00-xyz-00f067aa0ba902b7-01", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		_, _, _, ok = parseTraceParent(invalid)
+		assert.False(t, ok, invalid)
+	}
+
+	// without tracer, the spans are nil and safe to use
+	ctx, span := StartSpan(context.Background(), "nothing", SPAN_KIND_INTERNAL)
+	assert.Nil(t, span)
+	assert.Nil(t, SpanFrom(ctx))
+	span.SetAttribute("key", "value")
+	span.End()
+}
+
+// the /alert handler, the routing decision and the CachetHQ requests are exported
+// as one trace, continuing the trace of the incoming traceparent header
+func TestTracingExport(t *testing.T) {
+	fake := cachetfake.NewHandler()
+	fake.AddComponent("component21", 0)
+	traceParents := make([]string, 0)
+	cachethq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/version" {
+			traceParents = append(traceParents, r.Header.Get("traceparent"))
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer cachethq.Close()
+
+	var exported otlpTraces
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&exported))
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, map[string]string{"X-Api-Key": "secret"}, "bridge-test", collector.Client(), NewBridgeMetrics())
+	config := PrometheusCachetConfig{
+		LabelName: "alertname",
+		Cachet:    NewCachetImpl(cachethq.URL, "1234567890abcdef", &http.Client{}),
+		Tracer:    NewTracer(exporter),
+	}
+	router := PrepareGinRouter(&config)
+
+	var jsonStr = []byte(`{"receiver":"cachethq-receiver","status":"firing","alerts":[{"status":"firing","fingerprint":"f1a2","labels":{"alertname":"component21"}}],"version":"4"}`)
+	req := httptest.NewRequest("POST", "/alert", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Nil(t, exporter.Flush(context.Background()))
+	assert.Equal(t, 1, len(exported.ResourceSpans))
+	assert.Equal(t, "bridge-test", *exported.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+	spans := make(map[string][]otlpSpan)
+	for _, span := range exported.ResourceSpans[0].ScopeSpans[0].Spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+	assert.Equal(t, 1, len(spans["POST /alert"]))
+	assert.Equal(t, 1, len(spans["route alert"]))
+	assert.Equal(t, 3, len(spans["CachetHQ GET"])+len(spans["CachetHQ POST"]))
+
+	root := spans["POST /alert"][0]
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID)
+	assert.Equal(t, SPAN_KIND_SERVER, root.Kind)
+	route := spans["route alert"][0]
+	assert.Equal(t, root.SpanID, route.ParentSpanID)
+	for _, span := range append(spans["CachetHQ GET"], spans["CachetHQ POST"]...) {
+		assert.Equal(t, SPAN_KIND_CLIENT, span.Kind)
+	}
+	assert.Equal(t, route.SpanID, spans["CachetHQ POST"][0].ParentSpanID)
+
+	// the trace context is propagated to CachetHQ
+	assert.Equal(t, 1, len(traceParents))
+	assert.Contains(t, traceParents[0], "00-4bf92f3577b34da6a3ce929d0e0e4736-")
+}
+
+// the spans not exported are retried, the ones not fitting in the queue counted
+func TestTracingExportFailure(t *testing.T) {
+	var lock sync.Mutex
+	failures, exported := 1, 0
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		json.NewDecoder(r.Body).Decode(&traces)
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		exported += len(traces.ResourceSpans[0].ScopeSpans[0].Spans)
+	}))
+	defer collector.Close()
+
+	metrics := NewBridgeMetrics()
+	exporter := NewOTLPExporter(collector.URL, nil, "bridge-test", collector.Client(), metrics)
+	tracer := NewTracer(exporter)
+	for i := 0; i < traceQueueSize+10; i++ {
+		_, span := tracer.Start(context.Background(), "span", SPAN_KIND_INTERNAL, "")
+		span.End()
+	}
+	assert.Equal(t, float64(10), metrics.SpansDropped.Get())
+
+	assert.NotNil(t, exporter.Flush(context.Background()))
+	_, span := tracer.Start(context.Background(), "span", SPAN_KIND_INTERNAL, "")
+	span.End()
+	assert.Equal(t, float64(11), metrics.SpansDropped.Get())
+
+	assert.Nil(t, exporter.Flush(context.Background()))
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, traceQueueSize, exported)
+}
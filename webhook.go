@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookEvent is the payload POSTed by WebhookImpl for each incident change
+//
+//	{
+//	   "event": "incident_created",
+//	   "incident_id": 1,
+//	   "component": "component21",
+//	   "component_id": 1,
+//	   "incident_status": 2,
+//	   "component_status": 4,
+//	   "name": "component21 down",
+//	   "message": "Prometheus flagged service component21 as down",
+//	   "timestamp": "2019-11-15T10:00:00Z"
+//	}
+type webhookEvent struct {
+	Event           string `json:"event"`
+	IncidentID      int    `json:"incident_id"`
+	Component       string `json:"component"`
+	ComponentID     int    `json:"component_id"`
+	IncidentStatus  int    `json:"incident_status"`
+	ComponentStatus int    `json:"component_status"`
+	Name            string `json:"name"`
+	Message         string `json:"message"`
+	Timestamp       string `json:"timestamp"`
+}
+
+// WebhookImpl implements the Cachet interface by POSTing each incident change to
+// a generic webhook. As a webhook cannot be queried, the components are given by
+// configuration, and the incidents are only known in memory (i.e. lost on restart)
+type WebhookImpl struct {
+	url        string
+	headers    map[string]string
+	client     *http.Client
+	components map[string]int
+
+	lock         sync.Mutex
+	incidents    []*CachetIncident // most recent first
+	nextIncident int
+}
+
+// NewWebhookImpl creates a new Cachet interface implementation calling a webhook
+func NewWebhookImpl(url string, components []string, headers map[string]string, client *http.Client) *WebhookImpl {
+	w := &WebhookImpl{
+		url:          url,
+		headers:      headers,
+		client:       client,
+		components:   make(map[string]int),
+		nextIncident: 1,
+	}
+	for i, name := range components {
+		w.components[name] = i + 1
+	}
+	return w
+}
+
+func (w *WebhookImpl) send(ctx context.Context, event *webhookEvent) error {
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(event); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, &buf)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+
+	requestBody := buf.Bytes()
+	start := time.Now()
+	resp, err := w.client.Do(req)
+	if err != nil {
+		traceHTTP(ctx, req, requestBody, 0, nil, start, err)
+		return err
+	}
+	defer resp.Body.Close()
+	recordHTTPStatus(ctx, resp.StatusCode)
+
+	b, err := ioutil.ReadAll(resp.Body)
+	traceHTTP(ctx, req, requestBody, resp.StatusCode, b, start, err)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: %d %s", w.url, resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+func (w *WebhookImpl) ListComponentsContext(ctx context.Context) (map[string]int, error) {
+	componentsID := make(map[string]int)
+	for name, id := range w.components {
+		componentsID[name] = id
+	}
+	return componentsID, nil
+}
+
+func (w *WebhookImpl) SearchComponentContext(ctx context.Context, name string) (int, error) {
+	if id, ok := w.components[name]; ok {
+		return id, nil
+	}
+	return -1, fmt.Errorf("no component found")
+}
+
+func (w *WebhookImpl) ReadIncidentContext(ctx context.Context, incidentId int) (*CachetIncident, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, incident := range w.incidents {
+		if incident.Id == incidentId {
+			copyincident := *incident
+			return &copyincident, nil
+		}
+	}
+	return nil, fmt.Errorf("incident %d not found", incidentId)
+}
+
+func (w *WebhookImpl) SearchIncidentsContext(ctx context.Context, componentId int) ([]*CachetIncident, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	incidents := make([]*CachetIncident, 0)
+	for _, incident := range w.incidents {
+		if incident.ComponentId == componentId {
+			copyincident := *incident
+			incidents = append(incidents, &copyincident)
+		}
+	}
+	return incidents, nil
+}
+
+func (w *WebhookImpl) CreateIncidentContext(ctx context.Context, componentName string, componentID, status int, componentStatus int) error {
+	event := &webhookEvent{
+		Event:           "incident_created",
+		Component:       componentName,
+		ComponentID:     componentID,
+		IncidentStatus:  2, // "Identified"
+		ComponentStatus: componentStatus,
+		Name:            fmt.Sprintf("%s down", componentName),
+		Message:         fmt.Sprintf("Prometheus flagged service %s as down", componentName),
+	}
+
+	// if we are in status = 1 (alert resolved)
+	if status == 1 {
+		event.IncidentStatus = 4 // "Fixed"
+		event.Name = fmt.Sprintf("%s up", componentName)
+		event.Message = fmt.Sprintf("Prometheus flagged service %s as recovered", componentName)
+	}
+
+	w.lock.Lock()
+	event.IncidentID = w.nextIncident
+	w.nextIncident++
+	w.lock.Unlock()
+
+	if err := w.send(ctx, event); err != nil {
+		return err
+	}
+	recordIncidentID(ctx, event.IncidentID)
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+	w.lock.Lock()
+	w.incidents = append([]*CachetIncident{{
+		Id:          event.IncidentID,
+		ComponentId: componentID,
+		Status:      event.IncidentStatus,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}}, w.incidents...)
+	w.lock.Unlock()
+
+	return nil
+}
+
+func (w *WebhookImpl) UpdateIncidentContext(ctx context.Context, componentName string, componentID, incidentId, status int, message string) error {
+	event := &webhookEvent{
+		Event:           "incident_updated",
+		IncidentID:      incidentId,
+		Component:       componentName,
+		ComponentID:     componentID,
+		IncidentStatus:  2, // "Identified"
+		ComponentStatus: 4, // "Major Outage"
+		Name:            fmt.Sprintf("%s down", componentName),
+		Message:         message,
+	}
+
+	// if we are in status = 1 (alert resolved)
+	if status == 1 {
+		event.IncidentStatus = 4  // "Fixed"
+		event.ComponentStatus = 1 // "Operational"
+		event.Name = fmt.Sprintf("%s up", componentName)
+	}
+
+	if err := w.send(ctx, event); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, incident := range w.incidents {
+		if incident.Id == incidentId {
+			incident.Status = event.IncidentStatus
+			incident.UpdatedAt = time.Now().UTC().Format("2006-01-02 15:04:05")
+		}
+	}
+	return nil
+}
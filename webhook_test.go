@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookImpl(t *testing.T) {
+	events := make([]webhookEvent, 0)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "value", r.Header.Get("X-Custom"))
+
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			events = append(events, event)
+		}
+	}))
+	defer ts.Close()
+
+	webhook := NewWebhookImpl(ts.URL, []string{"component21", "component22"}, map[string]string{"X-Custom": "value"}, ts.Client())
+	ctx := context.Background()
+
+	components, err := webhook.ListComponentsContext(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(components))
+	assert.Equal(t, 2, components["component22"])
+
+	err = webhook.CreateIncidentContext(ctx, "component22", 2, 4, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "incident_created", events[0].Event)
+	assert.Equal(t, "component22", events[0].Component)
+	assert.Equal(t, 2, events[0].IncidentStatus)
+	assert.Equal(t, 4, events[0].ComponentStatus)
+
+	incidents, err := webhook.SearchIncidentsContext(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(incidents))
+	assert.Equal(t, 2, incidents[0].Status)
+
+	err = webhook.UpdateIncidentContext(ctx, "component22", 2, incidents[0].Id, 1, "back")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "incident_updated", events[1].Event)
+	assert.Equal(t, "back", events[1].Message)
+	assert.Equal(t, 1, events[1].ComponentStatus)
+
+	incident, err := webhook.ReadIncidentContext(ctx, incidents[0].Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, incident.Status)
+
+	// a failing webhook is reported, and the incident is not recorded
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+
+	failing := NewWebhookImpl(failingServer.URL, []string{"component21"}, nil, failingServer.Client())
+	assert.NotNil(t, failing.CreateIncidentContext(ctx, "component21", 1, 4, 4))
+	incidents, err = failing.SearchIncidentsContext(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(incidents))
+}
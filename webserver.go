@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,16 +25,20 @@ cf https://prometheus.io/docs/alerting/configuration/#webhook_config
 	"externalURL": <string>,  // backlink to the Alertmanager.
 	"alerts": [
 	  {
+		"status": "<resolved|firing>",
 		"labels": <object>,
 		"annotations": <object>,
 		"startsAt": "<rfc3339>",
-		"endsAt": "<rfc3339>"
+		"endsAt": "<rfc3339>",
+		"fingerprint": <string> // fingerprint to identify the alert
 	  },
 	  ...
 	]
   }
 */
 type PrometheusAlertDetail struct {
+	Status      string            `json:"status"`
+	Fingerprint string            `json:"fingerprint"`
 	Labels      map[string]string `json:"labels"`
 	Annotations map[string]string `json:"annotations"`
 	StartAt     string            `json:"startsAt"`
@@ -50,23 +57,96 @@ type PrometheusAlert struct {
 	Alerts            []PrometheusAlertDetail `json:"alerts"`
 }
 
-// SubmitAlert receive an alert from Prometheus, and try to forward it to CachetHQ
-func SubmitAlert(c *gin.Context, config *PrometheusCachetConfig) {
-	// check the Bearer
-	if config.PrometheusToken != "" {
-		bearer := c.GetHeader("Authorization")
-		if bearer != fmt.Sprintf("Bearer %s", config.PrometheusToken) {
-			if config.LogLevel == LOG_DEBUG {
-				log.Println("wrong Authorization header:", bearer)
-			}
-			c.JSON(http.StatusBadRequest, gin.H{"error": "wrong Authorization header"})
-			return
+// RouteAlert returns the backends (targets) the alert must be sent to:
+// the first matching route wins, else the default backend is used
+func (config *PrometheusCachetConfig) RouteAlert(labels map[string]string) []string {
+	if route := config.MatchRoute(labels); route != nil {
+		return route.Backends
+	}
+	return []string{DEFAULT_BACKEND}
+}
+
+// MatchRoute returns the first route matching the labels, or nil
+func (config *PrometheusCachetConfig) MatchRoute(labels map[string]string) *Route {
+	for i := range config.Routes {
+		if config.Routes[i].Matches(labels) {
+			return &config.Routes[i]
+		}
+	}
+	return nil
+}
+
+// Backend returns a backend by its name, or nil if unknown
+func (config *PrometheusCachetConfig) Backend(name string) Cachet {
+	if name == DEFAULT_BACKEND {
+		return config.Cachet
+	}
+	return config.Backends[name]
+}
+
+// forwardAlert creates (or updates if we squash incidents) the incident of a component
+func forwardAlert(ctx context.Context, config *PrometheusCachetConfig, backend Cachet, componentName string, componentID, status, componentStatus int) error {
+	if !config.SquashIncident {
+		// we dont 'squash' so let's create a new incident
+		return backend.CreateIncidentContext(ctx, componentName, componentID, status, componentStatus)
+	}
+
+	incidents, err := backend.SearchIncidentsContext(ctx, componentID)
+	if err != nil {
+		return err
+	}
+
+	// firing
+	if status != 1 {
+		// if no open incident currently, let's create a new one
+		if len(incidents) == 0 || incidents[0].Status == 4 {
+			return backend.CreateIncidentContext(ctx, componentName, componentID, status, componentStatus)
 		}
+		return nil
 	}
 
+	// resolved: if we want to "squash" event for a given incident
+	if len(incidents) == 0 {
+		return fmt.Errorf("No incident found for component %d\n", componentID)
+	}
+
+	incidentID := incidents[0].Id
+	backend.UpdateIncidentContext(ctx, componentName, componentID, incidentID, status, fmt.Sprintf("Prometheus flagged service %s as up", componentName))
+
+	if incident, err := backend.ReadIncidentContext(ctx, incidentID); err == nil {
+		layout := "2006-01-02 15:04:05"
+		createdAt, err1 := time.Parse(layout, incident.CreatedAt)
+		updatedAt, err2 := time.Parse(layout, incident.UpdatedAt)
+
+		if err1 == nil && err2 == nil {
+			backend.UpdateIncidentContext(ctx, componentName, componentID, incidentID, status, fmt.Sprintf("Prometheus flagged service %s as up (service was down for %d minutes)", componentName, int(updatedAt.Sub(createdAt).Minutes())))
+		}
+	}
+	return nil
+}
+
+// SubmitAlert receive an alert from Prometheus, and try to forward it to CachetHQ
+func SubmitAlert(c *gin.Context, config *PrometheusCachetConfig) {
+	tenant := config.TenantName()
+
+	logger := LoggerFrom(c.Request.Context()).With("tenant", tenant)
+
 	// read the payload
 	var alerts PrometheusAlert
 	if err := c.ShouldBindJSON(&alerts); err == nil {
+		config.Metrics.WebhooksReceived.Inc(tenant, alerts.Status)
+
+		logger = logger.With("group_key", alerts.GroupKey, "receiver", alerts.Receiver)
+		logger.Debug("webhook received", "status", alerts.Status, "alerts", len(alerts.Alerts))
+
+		// the backends calls are cancelled if the client goes away, or when the alert timeout is reached
+		ctx := WithLogger(c.Request.Context(), logger)
+		if config.AlertTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.AlertTimeout)
+			defer cancel()
+		}
+
 		// talk to CachetHQ
 		status := 1 // "resolved"
 		componentStatus := 1
@@ -75,90 +155,141 @@ func SubmitAlert(c *gin.Context, config *PrometheusCachetConfig) {
 			componentStatus = 4
 		}
 
-		list, err := config.Cachet.ListComponents()
-		if err != nil {
-			if config.LogLevel == LOG_DEBUG {
-				log.Println(err)
+		// components list per backend
+		lists := make(map[string]map[string]int)
+
+		// each backend is handled independently: one failing does not block the others
+		backendErrors := make(map[string]string)
+		unreachable := make(map[string]bool)
+		var alertSpan *Span
+		addError := func(backendName, componentName, message string) {
+			config.Metrics.BackendErrors.Inc(tenant, backendName)
+			config.Admin.Error(ctx, tenant, backendName, componentName, message)
+			alertSpan.SetError(fmt.Errorf("%s: %s", backendName, message))
+			if previous, ok := backendErrors[backendName]; ok {
+				message = previous + "; " + message
 			}
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
+			backendErrors[backendName] = message
 		}
 
 		// prometheus can send 2 times the same alerts info in one call
-		alreadyFired := make(map[int]int)
+		alreadyFired := make(map[string]int)
 		for _, alert := range alerts.Alerts {
-			// fire something
-			if componentID, ok := list[alert.Labels[config.LabelName]]; ok {
-				if alreadyFired[componentID] == 0 {
-					alreadyFired[componentID] = 1
-
-					if config.SquashIncident {
-						// firing
-						if status != 1 {
-							incidents, err := config.Cachet.SearchIncidents(componentID)
+			componentName := alert.Labels[config.LabelName]
+			targets := []string{DEFAULT_BACKEND}
+			var policy HoldDownPolicy
+			dryRun := false
+			if route := config.MatchRoute(alert.Labels); route != nil {
+				targets = route.Backends
+				policy = route.HoldDown
+				dryRun = route.DryRun
+			}
+
+			// a manual override pins the status of the component
+			if config.Overrides.Overridden(tenant, componentName, status != 1) {
+				logger.Info("alert not forwarded: component overridden", "fingerprint", alert.Fingerprint, "component", componentName, "status", alerts.Status)
+				config.Metrics.AlertsOverridden.Inc(tenant)
+				config.Admin.Alert(tenant, alerts.GroupKey, alert, componentName, nil, dryRun)
+				continue
+			}
+
+			var alertCtx context.Context
+			alertCtx, alertSpan = StartSpan(ctx, "route alert", SPAN_KIND_INTERNAL)
+			alertSpan.SetAttribute("alert.fingerprint", alert.Fingerprint)
+			alertSpan.SetAttribute("alert.component", componentName)
+			alertSpan.SetAttribute("alert.backends", strings.Join(targets, ","))
+			alertCtx = WithAlertInfo(alertCtx, AlertInfo{GroupKey: alerts.GroupKey, Fingerprint: alert.Fingerprint})
+
+			// the component id per backend (0 if unknown), shown on the admin console
+			mapped := make(map[string]int)
+
+			for _, backendName := range targets {
+				alertLogger := logger.With("fingerprint", alert.Fingerprint, "component", componentName, "backend", backendName)
+				if unreachable[backendName] {
+					continue
+				}
+
+				backend := config.RouteBackend(backendName, dryRun)
+				if backend == nil {
+					alertLogger.Error("unknown backend")
+					unreachable[backendName] = true
+					addError(backendName, componentName, "unknown backend")
+					continue
+				}
+
+				list, ok := lists[backendName]
+				if !ok {
+					list, err = backend.ListComponentsContext(WithLogger(alertCtx, alertLogger))
+					if err != nil {
+						alertLogger.Warn("unable to list the components", "error", err)
+						unreachable[backendName] = true
+						addError(backendName, componentName, err.Error())
+						continue
+					}
+					lists[backendName] = list
+				}
+
+				mapped[backendName] = list[componentName]
+
+				// fire something
+				if componentID, ok := list[componentName]; ok {
+					key := fmt.Sprintf("%s/%d", backendName, componentID)
+					if alreadyFired[key] == 0 {
+						alreadyFired[key] = 1
+
+						// Alertmanager resends the notifications (repeat_interval, HA pairs), claimed with the
+						// status of the alert: a group still firing may carry the resolution of one of its alerts
+						dedupeKey := DedupeKey(tenant, backendName, alerts.GroupKey, alert.Fingerprint, alert.Status, alert.StartAt)
+						if !config.Dedupe.Claim(dedupeKey, tenant, componentName) {
+							alertLogger.Debug("duplicate notification skipped", "status", alert.Status)
+							config.Metrics.DuplicatesSkipped.Inc(tenant, backendName)
+						} else if policy.Enabled() {
+							// the hold-down decides when the status page follows the alert
+							action, err := config.HoldDown.Submit(WithLogger(alertCtx, alertLogger), config, policy, backendName, dryRun, componentName, componentID, status != 1)
 							if err != nil {
-								c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-								return
-							}
-							// if no open incident currently, let's create a new one
-							if len(incidents) == 0 || incidents[0].Status == 4 {
-								if err := config.Cachet.CreateIncident(alert.Labels[config.LabelName], componentID, status, componentStatus); err != nil {
-									if config.LogLevel == LOG_DEBUG {
-										log.Println(err)
-									}
-									c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-									return
-								}
-							}
-						} else { // resolved
-							// if we want to "squash" event for a given incident
-							if incidents, err := config.Cachet.SearchIncidents(componentID); err == nil {
-								if len(incidents) > 0 {
-									if err == nil {
-										config.Cachet.UpdateIncident(alert.Labels[config.LabelName], componentID, incidents[0].Id, status, fmt.Sprintf("Prometheus flagged service %s as up", alert.Labels[config.LabelName]))
-
-										incidentID := incidents[0].Id
-										componentName := alert.Labels[config.LabelName]
-
-										if incident, err := config.Cachet.ReadIncident(incidentID); err == nil {
-											layout := "2006-01-02 15:04:05"
-											createdAt, err1 := time.Parse(layout, incident.CreatedAt)
-											updatedAt, err2 := time.Parse(layout, incident.UpdatedAt)
-
-											if err1 == nil && err2 == nil {
-												config.Cachet.UpdateIncident(componentName, componentID, incidentID, status, fmt.Sprintf("Prometheus flagged service %s as up (service was down for %d minutes)", componentName, int(updatedAt.Sub(createdAt).Minutes())))
-											}
-										}
-									} else {
-										c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-										return
-									}
-								} else {
-									c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No incident found for component %d\n", componentID)})
-									return
-								}
+								alertLogger.Warn("unable to forward the alert", "error", err, "hold_down", action)
+								addError(backendName, componentName, err.Error())
+								config.Dedupe.Release(dedupeKey)
+							} else if action == HOLD_DOWN_FORWARDED {
+								alertLogger.Info("alert forwarded", "status", alerts.Status)
+								config.Metrics.IncidentsForwarded.Inc(tenant, backendName)
 							} else {
-								c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-								return
+								alertLogger.Info("alert held down", "status", alerts.Status, "hold_down", action)
 							}
-						}
-					} else { // we dont 'squash' so let's create a new incident
-						if err := config.Cachet.CreateIncident(alert.Labels[config.LabelName], componentID, status, componentStatus); err != nil {
-							if config.LogLevel == LOG_DEBUG {
-								log.Println(err)
-							}
-							c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-							return
+						} else if config.Dedupe.Unchanged(tenant, backendName, componentID, status) && backendUnchanged(alertCtx, backend, componentID, status) {
+							alertLogger.Debug("component already in this status, alert skipped", "status", alerts.Status)
+							config.Metrics.DuplicatesSkipped.Inc(tenant, backendName)
+						} else if err := forwardAlert(WithLogger(alertCtx, alertLogger), config, backend, componentName, componentID, status, componentStatus); err != nil {
+							alertLogger.Warn("unable to forward the alert", "error", err)
+							addError(backendName, componentName, err.Error())
+							config.Dedupe.Release(dedupeKey)
+						} else {
+							alertLogger.Info("alert forwarded", "status", alerts.Status)
+							config.Metrics.IncidentsForwarded.Inc(tenant, backendName)
+							config.Dedupe.Forwarded(tenant, backendName, componentID, status)
 						}
 					}
+				} else {
+					alertLogger.Debug("component not found in the backend, alert ignored")
 				}
 			}
+			config.Admin.Alert(tenant, alerts.GroupKey, alert, componentName, mapped, dryRun)
+			alertSpan.End()
 		}
 
-	} else {
-		if config.LogLevel == LOG_DEBUG {
-			log.Println(err)
+		if len(backendErrors) > 0 {
+			messages := make([]string, 0, len(backendErrors))
+			for backendName, message := range backendErrors {
+				messages = append(messages, fmt.Sprintf("%s: %s", backendName, message))
+			}
+			sort.Strings(messages)
+			c.JSON(http.StatusBadRequest, gin.H{"error": strings.Join(messages, ", "), "backends": backendErrors})
+			return
 		}
+
+	} else {
+		logger.Warn("invalid webhook payload", "error", err)
+		config.Metrics.WebhooksRejected.Inc(tenant, "payload")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -166,17 +297,136 @@ func SubmitAlert(c *gin.Context, config *PrometheusCachetConfig) {
 	c.JSON(http.StatusOK, gin.H{"status": "OK"})
 }
 
+// TenantName returns the tenant name used in metrics ("default" for the main /alert endpoint)
+func (config *PrometheusCachetConfig) TenantName() string {
+	if config.Tenant == "" {
+		return DEFAULT_BACKEND
+	}
+	return config.Tenant
+}
+
+// AcceptedTokens returns all the bearer tokens accepted (none means no authentication)
+func (config *PrometheusCachetConfig) AcceptedTokens() []string {
+	tokens := make([]string, 0, len(config.PrometheusTokens)+1)
+	if config.PrometheusToken != "" {
+		tokens = append(tokens, config.PrometheusToken)
+	}
+	return append(tokens, config.PrometheusTokens...)
+}
+
+// rejectAuth counts the requests refused by the Authenticator
+func (config *PrometheusCachetConfig) rejectAuth(c *gin.Context, status int) {
+	LoggerFrom(c.Request.Context()).Warn("wrong Authorization header", "tenant", config.TenantName(), "client_ip", c.ClientIP(), "status", status)
+	config.Metrics.WebhooksRejected.Inc(config.TenantName(), "authorization")
+}
+
+// authenticate checks the credential of a webhook sent to the tenant (config for /alert): a
+// credential of another tenant (or of /alert) is authenticated but not allowed here (403)
+func (config *PrometheusCachetConfig) authenticate(c *gin.Context, tenant *PrometheusCachetConfig) bool {
+	if tenant.Auth.Check(c.Request) != http.StatusOK {
+		allowedElsewhere := tenant != config && config.Auth.Accepts(c.Request)
+		for _, other := range config.Tenants {
+			if other != tenant && other.Auth.Accepts(c.Request) {
+				allowedElsewhere = true
+			}
+		}
+		if allowedElsewhere {
+			tenant.rejectAuth(c, http.StatusForbidden)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "credential not allowed on this endpoint"})
+			return false
+		}
+	}
+	return tenant.Auth.Authenticate(c, tenant.rejectAuth)
+}
+
+// prepareAuth creates the Authenticator from the tokens, if not given
+func (config *PrometheusCachetConfig) prepareAuth() {
+	if config.Auth == nil {
+		config.Auth, _ = NewAuthenticator("prometheus-cachethq", config.AcceptedTokens(), nil, nil)
+	}
+}
+
 func PrepareGinRouter(config *PrometheusCachetConfig) *gin.Engine {
+	if config.Metrics == nil {
+		config.Metrics = NewBridgeMetrics()
+	}
+	if config.Lifecycle == nil {
+		config.Lifecycle = NewLifecycle()
+	}
+	if config.HoldDown == nil {
+		config.HoldDown, _ = NewHoldDown("")
+	}
+	if config.DryRun == nil {
+		config.DryRun = NewDryRunRecorder(DEFAULT_DRY_RUN_HISTORY)
+	}
+	if config.Overrides == nil {
+		config.Overrides, _ = NewOverrides("")
+	}
+	config.prepareAuth()
+	config.HoldDown.Register(config)
+	config.Overrides.Register(config)
+	for _, tenant := range config.Tenants {
+		tenant.Metrics = config.Metrics
+		tenant.Lifecycle = config.Lifecycle
+		tenant.HoldDown = config.HoldDown
+		tenant.Dedupe = config.Dedupe
+		tenant.HA = config.HA
+		tenant.DryRun = config.DryRun
+		tenant.Admin = config.Admin
+		tenant.Overrides = config.Overrides
+		tenant.prepareAuth()
+		config.HoldDown.Register(tenant)
+		config.Overrides.Register(tenant)
+	}
+
+	if config.Logger == nil {
+		config.Logger = NewLogger(os.Stderr, config.LogLevel, LOG_FORMAT_LOGFMT)
+	}
+	if config.Readiness == nil {
+		config.Readiness = NewReadinessChecker(config.ReadinessBackends(), DEFAULT_READY_CACHE, DEFAULT_READY_TIMEOUT)
+	}
+
 	router := gin.New()
-	router.Use(gin.LoggerWithWriter(gin.DefaultWriter, "/health"))
+	router.Use(RequestLogger(config.Logger, "/health", "/ready", "/metrics"))
 	router.Use(gin.Recovery())
 
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "OK"})
 	})
 
-	router.POST("/alert", func(c *gin.Context) {
-		SubmitAlert(c, config)
+	router.GET("/ready", func(c *gin.Context) {
+		select {
+		case <-config.Lifecycle.Stopping():
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+		default:
+			config.Readiness.Handler(c)
+		}
+	})
+
+	router.GET("/metrics", config.Metrics.Handler)
+
+	// the audit log and the dry-run changes are served with the admin UI
+	if config.Admin != nil {
+		config.Admin.Register(router, config)
+	}
+
+	router.POST("/alert", config.Tracer.Middleware("/alert"), config.Lifecycle.Middleware, func(c *gin.Context) {
+		if config.authenticate(c, config) && !config.HA.Forward(c) {
+			config.Recorder.Record(c, "")
+			SubmitAlert(c, config)
+		}
+	})
+
+	router.POST("/alert/:tenant", config.Tracer.Middleware("/alert/:tenant"), config.Lifecycle.Middleware, func(c *gin.Context) {
+		tenant, ok := config.Tenants[c.Param("tenant")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown tenant"})
+			return
+		}
+		if config.authenticate(c, tenant) && !config.HA.Forward(c) {
+			config.Recorder.Record(c, tenant.Tenant)
+			SubmitAlert(c, tenant)
+		}
 	})
 
 	return router